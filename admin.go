@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminPrincipal is recorded for requests authenticated by the admin token
+const adminPrincipal = "admin"
+
+// health tracks whether the server should receive traffic
+type health struct {
+	ready   int32
+	started time.Time
+}
+
+func newHealth() *health {
+	return &health{started: time.Now()}
+}
+
+// setReady flips readiness, false until the store is loaded and again once
+// a graceful shutdown starts
+func (h *health) setReady(ready bool) {
+	value := int32(0)
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&h.ready, value)
+}
+
+func (h *health) isReady() bool {
+	return atomic.LoadInt32(&h.ready) == 1
+}
+
+// Healthz reports the process is alive and able to serve requests
+func (h *health) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// Readyz reports whether the store is loaded and the server is not
+// shutting down
+func (h *health) Readyz(w http.ResponseWriter, r *http.Request) {
+	if !h.isReady() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// adminAuth only lets through requests holding the admin token in a
+// "Bearer" Authorization header, an empty token refuses every request
+func adminAuth(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			provided := strings.TrimPrefix(header, "Bearer ")
+			if token == "" || provided == header || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			setPrincipal(r, adminPrincipal)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// buildInfo describes the running binary from the module information
+// embedded by the go tool
+func buildInfo() *BuildInfo {
+	build := &BuildInfo{GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		build.Path = info.Main.Path
+		build.Version = info.Main.Version
+	}
+	return build
+}
+
+// Stats responds with an AdminStats object
+func (h *health) Stats(repo *NotebookRepo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		stats := repo.stats()
+
+		result := &AdminStats{
+			Goroutines:    int64(runtime.NumGoroutine()),
+			HeapAlloc:     mem.HeapAlloc,
+			HeapInuse:     mem.HeapInuse,
+			HeapObjects:   mem.HeapObjects,
+			GcCycles:      mem.NumGC,
+			Notebooks:     int64(stats.notebooks),
+			Notes:         int64(stats.notes),
+			Tags:          int64(stats.tags),
+			UptimeSeconds: time.Since(h.started).Seconds(),
+			Ready:         h.isReady(),
+			Build:         buildInfo(),
+		}
+		response, err := json.Marshal(result)
+		if err != nil {
+			repo.log(r).Error("Unable to marshal response", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(response)
+	}
+}
+
+// newAdminRouter registers the /admin namespace served on the admin
+// listener, every route requires the admin bearer token
+func newAdminRouter(repo *NotebookRepo, h *health, cfg AdminConfig) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(loggingMiddleware(repo.logger))
+	r.HandleFunc("/healthz", h.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", h.Readyz).Methods("GET")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(adminAuth(cfg.Token))
+	admin.HandleFunc("/stats", h.Stats(repo)).Methods("GET")
+	admin.HandleFunc("/backup", repo.Backup).Methods("GET")
+	admin.HandleFunc("/restore", repo.Restore).Methods("POST")
+	admin.HandleFunc("/attachments/sweep", repo.SweepAttachments).Methods("POST")
+
+	if cfg.Pprof {
+		// pprof.Index only resolves profiles under /debug/pprof/, so each
+		// named profile is routed to its handler explicitly
+		admin.HandleFunc("/debug/pprof/", pprof.Index)
+		admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		admin.HandleFunc("/debug/pprof/{profile}", func(w http.ResponseWriter, r *http.Request) {
+			pprof.Handler(mux.Vars(r)["profile"]).ServeHTTP(w, r)
+		})
+	}
+	return r
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyz(t *testing.T) {
+	h := newHealth()
+	router := newRouter(NewNotebookRepo(nil), h, defaultConfig())
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Result().StatusCode
+	}
+
+	assert.Equal(t, 200, status("/healthz"))
+	assert.Equal(t, 503, status("/readyz"))
+	h.setReady(true)
+	assert.Equal(t, 200, status("/readyz"))
+	h.setReady(false)
+	assert.Equal(t, 503, status("/readyz"))
+	assert.Equal(t, 200, status("/healthz"))
+}
+
+func TestAdminRouter(t *testing.T) {
+	repo := newBackupRepo()
+	h := newHealth()
+	h.setReady(true)
+	request := func(router *mux.Router, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Stats/Success", func(t *testing.T) {
+		router := newAdminRouter(repo, h, AdminConfig{Token: "secret"})
+		w := request(router, "/admin/stats", "secret")
+
+		assert.Equal(t, 200, w.Result().StatusCode)
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		stats := &AdminStats{}
+		assert.NoError(t, json.Unmarshal(body, stats))
+		assert.Equal(t, int64(1), stats.Notebooks)
+		assert.Equal(t, int64(2), stats.Notes)
+		assert.Equal(t, int64(2), stats.Tags)
+		assert.True(t, stats.Ready)
+		assert.NotZero(t, stats.Goroutines)
+		assert.NotZero(t, stats.HeapAlloc)
+		assert.NotEmpty(t, stats.Build.GoVersion)
+	})
+	t.Run("WrongToken/Unauthorized", func(t *testing.T) {
+		router := newAdminRouter(repo, h, AdminConfig{Token: "secret"})
+
+		assert.Equal(t, 401, request(router, "/admin/stats", "").Result().StatusCode)
+		assert.Equal(t, 401, request(router, "/admin/backup", "guess").Result().StatusCode)
+	})
+	t.Run("BareToken/Unauthorized", func(t *testing.T) {
+		router := newAdminRouter(repo, h, AdminConfig{Token: "secret"})
+		for _, header := range []string{"secret", "Basic secret"} {
+			req := httptest.NewRequest("GET", "/admin/stats", nil)
+			req.Header.Set("Authorization", header)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, 401, w.Code, header)
+		}
+	})
+	t.Run("Sweep", func(t *testing.T) {
+		repo := newBackupRepo()
+		repo.blobs = newBlobStore(tempDir(t))
+		router := newAdminRouter(repo, h, AdminConfig{Token: "secret"})
+		req := httptest.NewRequest("POST", "/admin/attachments/sweep", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.JSONEq(t, `{}`, w.Body.String())
+	})
+	t.Run("NoToken/Unauthorized", func(t *testing.T) {
+		router := newAdminRouter(repo, h, AdminConfig{})
+
+		assert.Equal(t, 401, request(router, "/admin/stats", "").Result().StatusCode)
+	})
+	t.Run("Pprof", func(t *testing.T) {
+		disabled := newAdminRouter(repo, h, AdminConfig{Token: "secret"})
+		assert.Equal(t, 404, request(disabled, "/admin/debug/pprof/", "secret").Result().StatusCode)
+
+		enabled := newAdminRouter(repo, h, AdminConfig{Token: "secret", Pprof: true})
+		assert.Equal(t, 200, request(enabled, "/admin/debug/pprof/", "secret").Result().StatusCode)
+		assert.Equal(t, 200, request(enabled, "/admin/debug/pprof/goroutine", "secret").Result().StatusCode)
+		assert.Equal(t, 401, request(enabled, "/admin/debug/pprof/heap", "").Result().StatusCode)
+	})
+}
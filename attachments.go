@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+)
+
+// attachment defaults used when storage.attachments_dir and
+// limits.max_attachment_bytes are not configured
+const (
+	defaultAttachmentsDir     = "attachments"
+	defaultMaxAttachmentBytes = 10 << 20
+)
+
+// sniffLen is the number of leading bytes http.DetectContentType considers
+const sniffLen = 512
+
+// errAttachmentTooLarge is returned by blobStore.put for content larger
+// than its limit
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+// blobStore stores attachment content on disk under its SHA-256, content
+// attached several times is stored once and removed when its last
+// reference is released. References are counted in memory, like the
+// notebooks holding them, so content left on disk by a previous process is
+// unreferenced until a restore retains it, and is removed by sweep
+type blobStore struct {
+	dir  string
+	mu   sync.Mutex
+	refs map[string]int64
+}
+
+func newBlobStore(dir string) *blobStore {
+	return &blobStore{dir: dir, refs: make(map[string]int64)}
+}
+
+// path fans blobs out over directories named after their first two hex
+// digits
+func (s *blobStore) path(digest string) string {
+	return filepath.Join(s.dir, digest[:2], digest)
+}
+
+// sniffWriter keeps the first sniffLen bytes written to it
+type sniffWriter struct {
+	head []byte
+}
+
+func (w *sniffWriter) Write(p []byte) (int, error) {
+	if missing := sniffLen - len(w.head); missing > 0 {
+		if missing > len(p) {
+			missing = len(p)
+		}
+		w.head = append(w.head, p[:missing]...)
+	}
+	return len(p), nil
+}
+
+// put stores the content read from r, at most limit bytes, and references
+// it once. It returns the digest and size of the content along with its
+// leading bytes
+func (s *blobStore) put(r io.Reader, limit int64) (digest string, size int64, head []byte, err error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return "", 0, nil, err
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	sniff := &sniffWriter{}
+	size, err = io.Copy(io.MultiWriter(tmp, h, sniff), io.LimitReader(r, limit+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if size > limit {
+		return "", 0, nil, errAttachmentTooLarge
+	}
+	digest = hex.EncodeToString(h.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(digest)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", 0, nil, err
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return "", 0, nil, err
+		}
+	}
+	s.refs[digest]++
+	return digest, size, sniff.head, nil
+}
+
+// retain references content already stored under digest, such as the
+// attachments of a restored backup
+func (s *blobStore) retain(digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs[digest]++
+}
+
+// release drops a reference to digest, removing its content once it is no
+// longer referenced
+func (s *blobStore) release(digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs[digest]--; s.refs[digest] > 0 {
+		return nil
+	}
+	delete(s.refs, digest)
+	if err := os.Remove(s.path(digest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// sweep removes the content stored on disk that is not referenced, and
+// returns how many blobs it removed. Uploads reference their content as
+// soon as it is stored, so that a sweep never races them
+func (s *blobStore) sweep() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fanouts, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var removed int64
+	for _, fanout := range fanouts {
+		if !fanout.IsDir() {
+			continue
+		}
+		blobs, err := ioutil.ReadDir(filepath.Join(s.dir, fanout.Name()))
+		if err != nil {
+			return removed, err
+		}
+		for _, blob := range blobs {
+			digest := blob.Name()
+			if !validDigest(digest) || digest[:2] != fanout.Name() || s.refs[digest] > 0 {
+				continue
+			}
+			if err := os.Remove(s.path(digest)); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// validDigest reports whether name is a hex encoded SHA-256, files of the
+// attachments directory named otherwise are left alone
+func validDigest(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// exists reports whether content is stored under digest
+func (s *blobStore) exists(digest string) bool {
+	_, err := os.Stat(s.path(digest))
+	return err == nil
+}
+
+// open returns the content stored under digest
+func (s *blobStore) open(digest string) (*os.File, error) {
+	return os.Open(s.path(digest))
+}
+
+// detectContentType sniffs the type of content starting with head, falling
+// back to the extension of name when sniffing only finds generic types
+func detectContentType(name string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	if sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain") {
+		if byExt := mime.TypeByExtension(filepath.Ext(name)); byExt != "" {
+			return byExt
+		}
+	}
+	return sniffed
+}
+
+// attachmentBytes returns the total size of the attachments of a notebook
+func (nb Notebook) attachmentBytes() int64 {
+	var total int64
+	for _, attachments := range nb.attachments {
+		for _, attachment := range attachments {
+			total += attachment.Size
+		}
+	}
+	return total
+}
+
+// checkAttachment returns a quotaError when attaching size bytes to the
+// notebook named name would exceed q
+func (q QuotaConfig) checkAttachment(name string, nb Notebook, size int64) error {
+	if q.MaxAttachmentBytes != 0 && nb.attachmentBytes()+size > q.MaxAttachmentBytes {
+		return &quotaError{name, fmt.Sprintf("the attachments of a notebook hold at most %d bytes", q.MaxAttachmentBytes)}
+	}
+	return nil
+}
+
+// SweepAttachments removes the content no attachment references anymore,
+// such as content left by a previous process that no restore retained
+func (n *NotebookRepo) SweepAttachments(w http.ResponseWriter, r *http.Request) {
+	// the lock keeps attachments from being restored while unreferenced
+	// content is looked for
+	n.mu.Lock()
+	removed, err := n.blobs.sweep()
+	n.mu.Unlock()
+	if err != nil {
+		n.log(r).Error("Unable to sweep attachments", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := &SweepAttachmentsResponse{Removed: removed}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// findAttachment returns the attachment of the note with id
+func (nb Notebook) findAttachment(id, attachmentID string) (int, *Attachment, error) {
+	for i, attachment := range nb.attachments[id] {
+		if attachment.Id == attachmentID {
+			return i, attachment, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("Attachment with id '%s' does not exist", attachmentID)
+}
+
+// releaseAttachments detaches every attachment of the note with id,
+// callers must hold n.mu for writing
+func (n *NotebookRepo) releaseAttachments(nb Notebook, id string) {
+	for _, attachment := range nb.attachments[id] {
+		if err := n.blobs.release(attachment.Sha256); err != nil {
+			n.logger.Error("Unable to remove attachment content", "sha256", attachment.Sha256, "error", err)
+		}
+	}
+	delete(nb.attachments, id)
+}
+
+// collectAttachments releases the attachments of the notes no longer held
+// by the notebook, callers must hold n.mu for writing
+func (n *NotebookRepo) collectAttachments(nb Notebook) {
+	for id := range nb.attachments {
+		if _, ok := nb.notes[id]; !ok {
+			n.releaseAttachments(nb, id)
+		}
+	}
+}
+
+// UploadAttachment reads an UploadAttachmentRequest from the query
+// parameters and attaches the request body to the note
+func (n *NotebookRepo) UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	body := &UploadAttachmentRequest{
+		NotebookName: query.Get("notebook_name"),
+		Id:           query.Get("id"),
+		Name:         query.Get("name"),
+	}
+	if !n.validRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	_, _, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	n.mu.RUnlock()
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the content is stored before taking the lock, uploads can be slow
+	digest, size, head, err := n.blobs.put(r.Body, n.maxAttachmentBytes)
+	if err == errAttachmentTooLarge {
+		errMsg := fmt.Sprintf("Attachment must be at most %d bytes", n.maxAttachmentBytes)
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		n.log(r).Error("Unable to store attachment", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	notebook, _, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	if err == nil {
+		err = n.quota.checkAttachment(body.GetNotebookName(), notebook, size)
+	}
+	if err != nil {
+		n.blobs.release(digest)
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	attachment := &Attachment{
+		Id:          uuid.New().String(),
+		Name:        body.GetName(),
+		ContentType: detectContentType(body.GetName(), head),
+		Size:        size,
+		Sha256:      digest,
+		Created:     ptypes.TimestampNow(),
+	}
+	notebook.attachments[body.GetId()] = append(notebook.attachments[body.GetId()], attachment)
+
+	result := &UploadAttachmentResponse{Attachment: attachment}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// DownloadAttachment reads a DownloadAttachmentRequest from the query
+// parameters and responds with the content of the attachment, honouring
+// Range requests
+func (n *NotebookRepo) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	body := &DownloadAttachmentRequest{
+		NotebookName: query.Get("notebook_name"),
+		Id:           query.Get("id"),
+		AttachmentId: query.Get("attachment_id"),
+	}
+	if !n.validRequest(w, r, body) {
+		return
+	}
+
+	// the content is opened under the lock so that a concurrent delete
+	// cannot remove it first
+	n.mu.RLock()
+	notebook, _, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	var attachment *Attachment
+	if err == nil {
+		_, attachment, err = notebook.findAttachment(body.GetId(), body.GetAttachmentId())
+	}
+	if err != nil {
+		n.mu.RUnlock()
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := n.blobs.open(attachment.Sha256)
+	n.mu.RUnlock()
+	// the path of the content is logged but never sent to the client
+	if os.IsNotExist(err) {
+		errMsg := fmt.Sprintf("Content of attachment '%s' is missing", attachment.Id)
+		n.log(r).Error(errMsg, "error", err)
+		http.Error(w, errMsg, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		n.log(r).Error("Unable to open attachment", "error", err)
+		http.Error(w, "Unable to open attachment", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	created, _ := ptypes.Timestamp(attachment.Created)
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("ETag", `"`+attachment.Sha256+`"`)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+	http.ServeContent(w, r, attachment.Name, created, f)
+}
+
+// ListAttachments takes a request body attempting to deserialise it to a
+// ListAttachmentsRequest object
+func (n *NotebookRepo) ListAttachments(w http.ResponseWriter, r *http.Request) {
+	body := &ListAttachmentsRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, _, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &ListAttachmentsResponse{Attachments: notebook.attachments[body.GetId()]}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// DeleteAttachment takes a request body attempting to deserialise it to a
+// DeleteAttachmentRequest object
+func (n *NotebookRepo) DeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	body := &DeleteAttachmentRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, _, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	var i int
+	var attachment *Attachment
+	if err == nil {
+		i, attachment, err = notebook.findAttachment(body.GetId(), body.GetAttachmentId())
+	}
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	attachments := notebook.attachments[body.GetId()]
+	remaining := append(append([]*Attachment(nil), attachments[:i]...), attachments[i+1:]...)
+	if len(remaining) == 0 {
+		delete(notebook.attachments, body.GetId())
+	} else {
+		notebook.attachments[body.GetId()] = remaining
+	}
+	if err := n.blobs.release(attachment.Sha256); err != nil {
+		n.log(r).Error("Unable to remove attachment content", "sha256", attachment.Sha256, "error", err)
+	}
+
+	result := &DeleteAttachmentResponse{Attachment: attachment}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
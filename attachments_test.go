@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pngContent starts with the PNG signature so that it is sniffed as such
+var pngContent = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{1}, 64)...)
+
+func newAttachmentsRepo(t *testing.T) *NotebookRepo {
+	repo := newTestRepo("files_notebook",
+		&Note{Id: "id_1", Title: "t1", Body: "b1"},
+		&Note{Id: "id_2", Title: "t2", Body: "b2"},
+	)
+	repo.blobs = newBlobStore(tempDir(t))
+	return repo
+}
+
+// blobFiles lists the content files held by the blob store
+func blobFiles(t *testing.T, repo *NotebookRepo) []string {
+	var files []string
+	filepath.Walk(repo.blobs.dir, func(path string, info os.FileInfo, err error) error {
+		assert.NoError(t, err)
+		if !info.IsDir() {
+			files = append(files, filepath.Base(path))
+		}
+		return nil
+	})
+	return files
+}
+
+func TestAttachments(t *testing.T) {
+	request := func(repo *NotebookRepo, method, path string, body []byte, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		newRouter(repo, newHealth(), defaultConfig()).ServeHTTP(w, req)
+		return w
+	}
+	upload := func(repo *NotebookRepo, id, name string, content []byte) (int, *Attachment) {
+		query := url.Values{"notebook_name": {"files_notebook"}, "id": {id}, "name": {name}}
+		w := request(repo, "POST", "/note/attachment?"+query.Encode(), content)
+		result := &UploadAttachmentResponse{}
+		if w.Code == 200 {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		}
+		return w.Code, result.Attachment
+	}
+	download := func(repo *NotebookRepo, id, attachmentID string, header ...string) *httptest.ResponseRecorder {
+		query := url.Values{"notebook_name": {"files_notebook"}, "id": {id}, "attachment_id": {attachmentID}}
+		return request(repo, "GET", "/note/attachment?"+query.Encode(), nil, header...)
+	}
+
+	t.Run("Upload/Download", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		code, attachment := upload(repo, "id_1", "screen.bin", pngContent)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, "image/png", attachment.ContentType)
+		assert.Equal(t, int64(len(pngContent)), attachment.Size)
+		assert.Len(t, attachment.Sha256, 64)
+
+		w := download(repo, "id_1", attachment.Id)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, pngContent, w.Body.Bytes())
+		assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename=screen.bin`, w.Header().Get("Content-Disposition"))
+	})
+	t.Run("Download/Range", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		_, attachment := upload(repo, "id_1", "screen.png", pngContent)
+		w := download(repo, "id_1", attachment.Id, "Range", "bytes=1-3")
+
+		assert.Equal(t, 206, w.Code)
+		assert.Equal(t, []byte("PNG"), w.Body.Bytes())
+		assert.Equal(t, "bytes 1-3/72", w.Header().Get("Content-Range"))
+	})
+	t.Run("ContentType/Extension", func(t *testing.T) {
+		_, attachment := upload(newAttachmentsRepo(t), "id_1", "data.json", []byte(`{"a": 1}`))
+
+		assert.Equal(t, "application/json", attachment.ContentType)
+	})
+	t.Run("Dedup/ReferenceCounting", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		_, first := upload(repo, "id_1", "a.png", pngContent)
+		_, second := upload(repo, "id_2", "b.png", pngContent)
+		assert.Equal(t, first.Sha256, second.Sha256)
+		assert.Equal(t, []string{first.Sha256}, blobFiles(t, repo))
+
+		body, _ := json.Marshal(&DeleteAttachmentRequest{NotebookName: "files_notebook", Id: "id_1", AttachmentId: first.Id})
+		assert.Equal(t, 200, request(repo, "DELETE", "/note/attachment", body).Code)
+		assert.Equal(t, []string{first.Sha256}, blobFiles(t, repo))
+
+		assert.Equal(t, 200, request(repo, "DELETE", "/note", []byte(`{"notebook_name": "files_notebook", "id": "id_2"}`)).Code)
+		assert.Empty(t, blobFiles(t, repo))
+	})
+	t.Run("List", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		upload(repo, "id_1", "a.png", pngContent)
+		upload(repo, "id_1", "b.json", []byte("{}"))
+		w := request(repo, "GET", "/note/attachments", []byte(`{"notebook_name": "files_notebook", "id": "id_1"}`))
+		assert.Equal(t, 200, w.Code)
+		result := &ListAttachmentsResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Len(t, result.Attachments, 2)
+		assert.Equal(t, "a.png", result.Attachments[0].Name)
+		assert.Equal(t, "b.json", result.Attachments[1].Name)
+	})
+	t.Run("BatchDelete/Collected", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		upload(repo, "id_1", "a.png", pngContent)
+		w := request(repo, "DELETE", "/note/batch", []byte(`{"notes": [{"notebook_name": "files_notebook", "id": "id_1"}]}`))
+
+		assert.Equal(t, 200, w.Code)
+		assert.Empty(t, blobFiles(t, repo))
+		assert.Empty(t, repo.notebooks["files_notebook"].attachments)
+	})
+	t.Run("TooLarge", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		repo.maxAttachmentBytes = 8
+		code, _ := upload(repo, "id_1", "a.png", pngContent)
+
+		assert.Equal(t, 413, code)
+		assert.Empty(t, blobFiles(t, repo))
+	})
+	t.Run("Quota", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		repo.quota.MaxAttachmentBytes = 100
+		code, _ := upload(repo, "id_1", "a.png", pngContent)
+		assert.Equal(t, 200, code)
+		code, _ = upload(repo, "id_2", "b.png", pngContent)
+
+		assert.Equal(t, 403, code)
+		assert.Len(t, blobFiles(t, repo), 1)
+	})
+	t.Run("UnknownNote", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		code, _ := upload(repo, "id_9", "a.png", pngContent)
+
+		assert.Equal(t, 400, code)
+		assert.Empty(t, blobFiles(t, repo))
+	})
+	t.Run("InvalidName", func(t *testing.T) {
+		code, _ := upload(newAttachmentsRepo(t), "id_1", "../a.png", pngContent)
+
+		assert.Equal(t, 400, code)
+	})
+	t.Run("Usage", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		repo.quota.MaxAttachmentBytes = 1000
+		upload(repo, "id_1", "a.png", pngContent)
+		w := request(repo, "GET", "/notebook/usage", []byte(`{"name": "files_notebook"}`))
+		assert.Equal(t, 200, w.Code)
+		result := &GetUsageResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Equal(t, int64(len(pngContent)), result.AttachmentBytes)
+		assert.Equal(t, int64(1000), result.Quota.MaxAttachmentBytes)
+	})
+	t.Run("Restore", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		_, kept := upload(repo, "id_1", "a.png", pngContent)
+		var archive bytes.Buffer
+		assert.NoError(t, writeBackup(&archive, repo.snapshot(), nil))
+		_, dropped := upload(repo, "id_2", "b.txt", []byte("not archived"))
+
+		// a restarted process shares the attachments directory only
+		restarted := NewNotebookRepo(nil)
+		restarted.blobs = newBlobStore(repo.blobs.dir)
+		w := httptest.NewRecorder()
+		restarted.Restore(w, httptest.NewRequest("POST", "/admin/restore", &archive))
+		assert.Equal(t, 200, w.Code)
+
+		assert.Equal(t, []string{kept.Sha256}, blobFiles(t, restarted))
+		query := url.Values{"notebook_name": {"files_notebook"}, "id": {"id_1"}, "attachment_id": {kept.Id}}
+		w = request(restarted, "GET", "/note/attachment?"+query.Encode(), nil)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, pngContent, w.Body.Bytes())
+		assert.NotEqual(t, kept.Sha256, dropped.Sha256)
+
+		// restoring the same archive again keeps the content it references
+		archive.Reset()
+		assert.NoError(t, writeBackup(&archive, restarted.snapshot(), nil))
+		w = httptest.NewRecorder()
+		restarted.Restore(w, httptest.NewRequest("POST", "/admin/restore", &archive))
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []string{kept.Sha256}, blobFiles(t, restarted))
+		assert.Equal(t, int64(1), restarted.blobs.refs[kept.Sha256])
+	})
+	t.Run("Restore/MissingContent", func(t *testing.T) {
+		repo := newAttachmentsRepo(t)
+		_, attachment := upload(repo, "id_1", "a.png", pngContent)
+		var archive bytes.Buffer
+		assert.NoError(t, writeBackup(&archive, repo.snapshot(), nil))
+
+		// a fresh host holds none of the archived content
+		fresh := NewNotebookRepo(nil)
+		fresh.blobs = newBlobStore(tempDir(t))
+		status, result := restore(fresh, "", archive.Bytes())
+		assert.Equal(t, 200, status)
+		if assert.Len(t, result.MissingAttachments, 1) {
+			assert.Equal(t, attachment.Id, result.MissingAttachments[0].AttachmentId)
+			assert.Equal(t, attachment.Sha256, result.MissingAttachments[0].Sha256)
+		}
+
+		query := url.Values{"notebook_name": {"files_notebook"}, "id": {"id_1"}, "attachment_id": {attachment.Id}}
+		w := request(fresh, "GET", "/note/attachment?"+query.Encode(), nil)
+		assert.Equal(t, 404, w.Code)
+		assert.NotContains(t, w.Body.String(), fresh.blobs.dir)
+	})
+}
+
+func TestBlobStoreRelease(t *testing.T) {
+	store := newBlobStore(tempDir(t))
+	digest, _, _, err := store.put(bytes.NewReader([]byte("content")), 100)
+	assert.NoError(t, err)
+	_, _, _, err = store.put(bytes.NewReader([]byte("content")), 100)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.release(digest))
+	f, err := store.open(digest)
+	assert.NoError(t, err)
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	assert.Equal(t, "content", string(data))
+
+	assert.NoError(t, store.release(digest))
+	_, err = store.open(digest)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBlobStoreSweep(t *testing.T) {
+	dir := tempDir(t)
+	store := newBlobStore(dir)
+	kept, _, _, err := store.put(bytes.NewReader([]byte("kept")), 100)
+	assert.NoError(t, err)
+	orphan, _, _, err := store.put(bytes.NewReader([]byte("orphan")), 100)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a blob"), 0600))
+
+	removed, err := store.sweep()
+	assert.NoError(t, err)
+	assert.Zero(t, removed)
+
+	// references are lost with the process, content is only kept once
+	// retained again
+	restarted := newBlobStore(dir)
+	restarted.retain(kept)
+	removed, err = restarted.sweep()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), removed)
+
+	_, err = restarted.open(kept)
+	assert.NoError(t, err)
+	_, err = restarted.open(orphan)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "README"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// backupMagic opens every backup archive so that arbitrary uploads are
+// refused before anything is decoded
+const backupMagic = "NTBKBKUP"
+
+// backupSchemaVersion is written to the BackupHeader of new archives,
+// bump it along with an entry in backupUpgrades whenever the layout of a
+// BackupNotebook changes
+const backupSchemaVersion = 1
+
+// maxBackupRecordSize caps a single record so that a corrupted length
+// prefix cannot exhaust memory
+const maxBackupRecordSize = 256 << 20
+
+// backupUpgrades migrates a BackupNotebook written with the schema version
+// used as key to the following version
+var backupUpgrades = map[uint32]func(notebook *BackupNotebook) error{}
+
+// restore modes accepted by the mode query parameter
+const (
+	restoreReplace = "replace"
+	restoreMerge   = "merge"
+)
+
+// snapshot copies every notebook so that a backup can be streamed
+// without holding n.mu
+func (n *NotebookRepo) snapshot() []*BackupNotebook {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	snapshot := make([]*BackupNotebook, 0, len(n.notebooks))
+	for name, notebook := range n.notebooks {
+		backup := &BackupNotebook{Name: name}
+		for _, note := range notebook.notes {
+			backup.Notes = append(backup.Notes, proto.Clone(note).(*Note))
+		}
+		for tagName, noteIDs := range notebook.tags {
+			backup.Tags = append(backup.Tags, &BackupTag{
+				Name:    tagName,
+				NoteIds: append([]string(nil), noteIDs...),
+			})
+		}
+		for _, tmpl := range notebook.templates {
+			backup.Templates = append(backup.Templates, proto.Clone(tmpl).(*NoteTemplate))
+		}
+		for _, definition := range notebook.sortedSchema() {
+			backup.Schema = append(backup.Schema, proto.Clone(definition).(*PropertyDefinition))
+		}
+		for id, principals := range notebook.stars {
+			star := &BackupStar{NoteId: id}
+			for principal := range principals {
+				star.Principals = append(star.Principals, principal)
+			}
+			sort.Strings(star.Principals)
+			backup.Stars = append(backup.Stars, star)
+		}
+		for id, attachments := range notebook.attachments {
+			archived := &BackupAttachments{NoteId: id}
+			for _, attachment := range attachments {
+				archived.Attachments = append(archived.Attachments, proto.Clone(attachment).(*Attachment))
+			}
+			backup.Attachments = append(backup.Attachments, archived)
+		}
+		sort.Slice(backup.Notes, func(i, j int) bool { return backup.Notes[i].Id < backup.Notes[j].Id })
+		sort.Slice(backup.Tags, func(i, j int) bool { return backup.Tags[i].Name < backup.Tags[j].Name })
+		sort.Slice(backup.Templates, func(i, j int) bool { return backup.Templates[i].Name < backup.Templates[j].Name })
+		sort.Slice(backup.Stars, func(i, j int) bool { return backup.Stars[i].NoteId < backup.Stars[j].NoteId })
+		sort.Slice(backup.Attachments, func(i, j int) bool { return backup.Attachments[i].NoteId < backup.Attachments[j].NoteId })
+		snapshot = append(snapshot, backup)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Name < snapshot[j].Name })
+	return snapshot
+}
+
+// writeBackupRecord writes msg prefixed by its varint encoded length
+func writeBackupRecord(w io.Writer, msg proto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, binary.MaxVarintLen64)
+	if _, err := w.Write(prefix[:binary.PutUvarint(prefix, uint64(len(data)))]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readBackupRecord reads a length prefixed record into msg, every byte read
+// is also written to h when it is not nil
+func readBackupRecord(r *bufio.Reader, h hash.Hash, msg proto.Message) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("unable to read record length: %v", err)
+	}
+	if size > maxBackupRecordSize {
+		return fmt.Errorf("record of %d bytes exceeds the limit of %d bytes", size, maxBackupRecordSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("unable to read record: %v", err)
+	}
+	if h != nil {
+		prefix := make([]byte, binary.MaxVarintLen64)
+		h.Write(prefix[:binary.PutUvarint(prefix, size)])
+		h.Write(data)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// writeBackup writes the magic, a BackupHeader, every notebook, every
+// idempotency record and a BackupTrailer holding the checksum of everything
+// before it
+func writeBackup(w io.Writer, notebooks []*BackupNotebook, records []*IdempotencyRecord) error {
+	h := sha256.New()
+	body := io.MultiWriter(w, h)
+
+	if _, err := io.WriteString(body, backupMagic); err != nil {
+		return err
+	}
+	header := &BackupHeader{
+		SchemaVersion:          backupSchemaVersion,
+		Created:                ptypes.TimestampNow(),
+		NotebookCount:          int64(len(notebooks)),
+		IdempotencyRecordCount: int64(len(records)),
+	}
+	if err := writeBackupRecord(body, header); err != nil {
+		return err
+	}
+	for _, notebook := range notebooks {
+		if err := writeBackupRecord(body, notebook); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		if err := writeBackupRecord(body, record); err != nil {
+			return err
+		}
+	}
+	return writeBackupRecord(w, &BackupTrailer{Sha256: h.Sum(nil)})
+}
+
+// readBackup decodes and verifies a whole archive, upgrading notebooks
+// written by older schema versions. Nothing is returned unless the
+// checksum matches
+func readBackup(r io.Reader) (*BackupHeader, []*BackupNotebook, []*IdempotencyRecord, error) {
+	reader := bufio.NewReader(r)
+	h := sha256.New()
+
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != backupMagic {
+		return nil, nil, nil, fmt.Errorf("not a notebook backup archive")
+	}
+	h.Write(magic)
+
+	header := &BackupHeader{}
+	if err := readBackupRecord(reader, h, header); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid backup header: %v", err)
+	}
+	if header.SchemaVersion > backupSchemaVersion {
+		return nil, nil, nil, fmt.Errorf("backup schema version %d is newer than the supported version %d",
+			header.SchemaVersion, backupSchemaVersion)
+	}
+
+	if header.NotebookCount < 0 {
+		return nil, nil, nil, fmt.Errorf("invalid backup header: negative notebook count %d", header.NotebookCount)
+	}
+	if header.IdempotencyRecordCount < 0 {
+		return nil, nil, nil, fmt.Errorf("invalid backup header: negative idempotency record count %d",
+			header.IdempotencyRecordCount)
+	}
+
+	// the counts are not trusted before the checksum is verified, records
+	// are appended as they are read
+	var notebooks []*BackupNotebook
+	for i := int64(0); i < header.NotebookCount; i++ {
+		notebook := &BackupNotebook{}
+		if err := readBackupRecord(reader, h, notebook); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid notebook record %d: %v", i, err)
+		}
+		notebooks = append(notebooks, notebook)
+	}
+	var records []*IdempotencyRecord
+	for i := int64(0); i < header.IdempotencyRecordCount; i++ {
+		record := &IdempotencyRecord{}
+		if err := readBackupRecord(reader, h, record); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid idempotency record %d: %v", i, err)
+		}
+		records = append(records, record)
+	}
+
+	trailer := &BackupTrailer{}
+	if err := readBackupRecord(reader, nil, trailer); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid backup trailer: %v", err)
+	}
+	if !bytes.Equal(trailer.Sha256, h.Sum(nil)) {
+		return nil, nil, nil, fmt.Errorf("backup checksum mismatch")
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		return nil, nil, nil, fmt.Errorf("unexpected data after backup trailer")
+	}
+
+	for version := header.SchemaVersion; version < backupSchemaVersion; version++ {
+		upgrade, ok := backupUpgrades[version]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("no upgrade from backup schema version %d", version)
+		}
+		for _, notebook := range notebooks {
+			if err := upgrade(notebook); err != nil {
+				return nil, nil, nil, fmt.Errorf("unable to upgrade notebook '%s' from schema version %d: %v",
+					notebook.Name, version, err)
+			}
+		}
+	}
+	return header, notebooks, records, nil
+}
+
+// restoreNotebook builds a Notebook from its backup, the tags index is
+// rebuilt from the notes when the archive holds none
+func restoreNotebook(backup *BackupNotebook, global *globalIndex) Notebook {
+	notebook := makeNotebook(backup.Name, global)
+	for _, note := range backup.Notes {
+		notebook.putNote(note)
+	}
+	for _, tag := range backup.Tags {
+		for _, id := range tag.NoteIds {
+			notebook.indexTag(tag.Name, id)
+		}
+	}
+	if len(backup.Tags) == 0 {
+		notebook.rebuildTags()
+	}
+	for _, tmpl := range backup.Templates {
+		notebook.templates[tmpl.Name] = tmpl
+	}
+	for _, definition := range backup.Schema {
+		notebook.schema[definition.Name] = definition
+	}
+	notebook.restoreStars(backup)
+	for _, archived := range backup.Attachments {
+		notebook.attachments[archived.NoteId] = archived.Attachments
+	}
+	return notebook
+}
+
+// restoreStars replaces the stars of the archived notes of backup with
+// the archived ones
+func (nb Notebook) restoreStars(backup *BackupNotebook) {
+	for _, note := range backup.Notes {
+		delete(nb.stars, note.Id)
+	}
+	for _, star := range backup.Stars {
+		for _, principal := range star.Principals {
+			nb.star(star.NoteId, principal, true)
+		}
+	}
+}
+
+// Backup streams a point in time copy of every notebook and idempotency
+// record as length delimited BackupHeader, BackupNotebook,
+// IdempotencyRecord and BackupTrailer records
+func (n *NotebookRepo) Backup(w http.ResponseWriter, r *http.Request) {
+	notebooks := n.snapshot()
+	records := n.idempotency.snapshot()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="notebooks.backup"`)
+	if err := writeBackup(w, notebooks, records); err != nil {
+		// headers are already sent, the missing trailer marks the archive as corrupted
+		n.log(r).Error("Unable to write backup", "error", err)
+	}
+}
+
+// Restore reads a backup archive written by Backup. With the default
+// replace mode every notebook and idempotency record is swapped for the
+// archived ones, merge mode keeps notebooks missing from the archive and
+// overwrites archived notes
+func (n *NotebookRepo) Restore(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = restoreReplace
+	}
+	if mode != restoreReplace && mode != restoreMerge {
+		errMsg := fmt.Sprintf("unknown restore mode '%s', expected %s or %s", mode, restoreReplace, restoreMerge)
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	header, backups, records, err := readBackup(r.Body)
+	if err != nil {
+		n.log(r).Error("Refusing to restore backup", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &RestoreResponse{
+		Mode:          mode,
+		SchemaVersion: header.SchemaVersion,
+		Notebooks:     int64(len(backups)),
+	}
+
+	n.mu.Lock()
+	// the content of restored attachments is referenced before that of
+	// replaced ones is released, so that content held by both is kept
+	for _, backup := range backups {
+		for _, archived := range backup.Attachments {
+			for _, attachment := range archived.Attachments {
+				n.blobs.retain(attachment.Sha256)
+				if !n.blobs.exists(attachment.Sha256) {
+					result.MissingAttachments = append(result.MissingAttachments, &MissingAttachment{
+						NotebookName: backup.Name,
+						NoteId:       archived.NoteId,
+						AttachmentId: attachment.Id,
+						Sha256:       attachment.Sha256,
+					})
+				}
+			}
+		}
+	}
+	if len(result.MissingAttachments) != 0 {
+		n.log(r).Warn("Restored attachments without content", "count", len(result.MissingAttachments))
+	}
+	if mode == restoreReplace {
+		for _, notebook := range n.notebooks {
+			for id := range notebook.attachments {
+				n.releaseAttachments(notebook, id)
+			}
+		}
+		n.notebooks = make(map[string]Notebook)
+		n.global.reset()
+	}
+	for _, backup := range backups {
+		result.Notes += int64(len(backup.Notes))
+		existing, ok := n.notebooks[backup.Name]
+		if !ok {
+			n.notebooks[backup.Name] = restoreNotebook(backup, n.global)
+			continue
+		}
+		for _, note := range backup.Notes {
+			existing.putNote(note)
+			n.releaseAttachments(existing, note.Id)
+		}
+		for _, archived := range backup.Attachments {
+			n.releaseAttachments(existing, archived.NoteId)
+			existing.attachments[archived.NoteId] = archived.Attachments
+		}
+		existing.rebuildTags()
+		for _, tmpl := range backup.Templates {
+			existing.templates[tmpl.Name] = tmpl
+		}
+		for _, definition := range backup.Schema {
+			existing.schema[definition.Name] = definition
+		}
+		existing.restoreStars(backup)
+	}
+	// the responses stored for retries follow the notebooks they were
+	// applied to
+	n.idempotency.restore(records, mode == restoreReplace)
+	// content left by a previous process that the backup did not
+	// reference is no longer reachable
+	if _, err := n.blobs.sweep(); err != nil {
+		n.log(r).Error("Unable to sweep attachments", "error", err)
+	}
+	n.mu.Unlock()
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
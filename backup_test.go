@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newBackupRepo() *NotebookRepo {
+	return newTestRepo("backup_notebook",
+		&Note{Id: "id_1", Title: "title_1", Body: "body_1", Tags: []string{"tag_1"}},
+		&Note{Id: "id_2", Title: "title_2", Body: "body_2", Tags: []string{"tag_1", "tag_2"}},
+	)
+}
+
+func backup(t *testing.T, repo *NotebookRepo) []byte {
+	req := httptest.NewRequest("GET", "/admin/backup", nil)
+	w := httptest.NewRecorder()
+	repo.Backup(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return body
+}
+
+func restore(repo *NotebookRepo, query string, archive []byte) (int, *RestoreResponse) {
+	req := httptest.NewRequest("POST", "/admin/restore?"+query, bytes.NewReader(archive))
+	w := httptest.NewRecorder()
+	repo.Restore(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	result := &RestoreResponse{}
+	json.Unmarshal(body, result)
+	return resp.StatusCode, result
+}
+
+// writeVersionedBackup mimics writeBackup for archives of another schema version
+func writeVersionedBackup(w io.Writer, version uint32, notebooks []*BackupNotebook) {
+	h := sha256.New()
+	body := io.MultiWriter(w, h)
+	io.WriteString(body, backupMagic)
+	writeBackupRecord(body, &BackupHeader{SchemaVersion: version, NotebookCount: int64(len(notebooks))})
+	for _, notebook := range notebooks {
+		writeBackupRecord(body, notebook)
+	}
+	writeBackupRecord(w, &BackupTrailer{Sha256: h.Sum(nil)})
+}
+
+func TestRestore(t *testing.T) {
+	t.Run("Replace/Success", func(t *testing.T) {
+		archive := backup(t, newBackupRepo())
+		repo := NewNotebookRepo(nil)
+		repo.notebooks["other_notebook"] = makeNotebook("other_notebook", repo.global)
+
+		status, result := restore(repo, "", archive)
+
+		assert.Equal(t, 200, status)
+		assert.Equal(t, restoreReplace, result.Mode)
+		assert.Equal(t, int64(1), result.Notebooks)
+		assert.Equal(t, int64(2), result.Notes)
+		assert.Len(t, repo.notebooks, 1)
+		notebook := repo.notebooks["backup_notebook"]
+		assert.Equal(t, "body_2", notebook.notes["id_2"].Body)
+		assert.ElementsMatch(t, []string{"id_1", "id_2"}, notebook.tags["tag_1"])
+	})
+	t.Run("Merge/Success", func(t *testing.T) {
+		archive := backup(t, newBackupRepo())
+		repo := newBackupRepo()
+		repo.notebooks["other_notebook"] = makeNotebook("other_notebook", repo.global)
+		repo.notebooks["backup_notebook"].addNote(&Note{Id: "id_3", Title: "title_3", Tags: []string{"tag_3"}})
+		repo.notebooks["backup_notebook"].notes["id_1"].Title = "changed"
+
+		status, _ := restore(repo, "mode=merge", archive)
+
+		assert.Equal(t, 200, status)
+		assert.Len(t, repo.notebooks, 2)
+		notebook := repo.notebooks["backup_notebook"]
+		assert.Len(t, notebook.notes, 3)
+		assert.Equal(t, "title_1", notebook.notes["id_1"].Title)
+		assert.Equal(t, []string{"id_3"}, notebook.tags["tag_3"])
+	})
+	t.Run("IdempotencyRecords/Restored", func(t *testing.T) {
+		repo := newBackupRepo()
+		repo.idempotency.begin("key-1", []byte("fingerprint"))
+		repo.idempotency.finish("key-1", 200, "application/json", []byte(`{"id": "id_1"}`))
+		repo.idempotency.begin("in-flight", []byte("fingerprint"))
+		archive := backup(t, repo)
+		restored := NewNotebookRepo(nil)
+		restored.idempotency.begin("key-2", []byte("fingerprint"))
+		restored.idempotency.finish("key-2", 200, "application/json", []byte(`{}`))
+
+		status, _ := restore(restored, "", archive)
+
+		assert.Equal(t, 200, status)
+		record, known := restored.idempotency.begin("key-1", []byte("fingerprint"))
+		assert.True(t, known)
+		assert.Equal(t, []byte(`{"id": "id_1"}`), record.Body)
+		assert.NotContains(t, restored.idempotency.records, "in-flight")
+		assert.NotContains(t, restored.idempotency.records, "key-2")
+	})
+	t.Run("Corrupted/Error", func(t *testing.T) {
+		archive := backup(t, newBackupRepo())
+		archive[len(backupMagic)+8] ^= 0xff
+		repo := newBackupRepo()
+
+		status, _ := restore(repo, "", archive)
+
+		assert.Equal(t, 400, status)
+		assert.Len(t, repo.notebooks["backup_notebook"].notes, 2)
+	})
+	t.Run("Truncated/Error", func(t *testing.T) {
+		archive := backup(t, newBackupRepo())
+
+		status, _ := restore(NewNotebookRepo(nil), "", archive[:len(archive)-4])
+
+		assert.Equal(t, 400, status)
+	})
+	t.Run("NotebookCount/Error", func(t *testing.T) {
+		for _, count := range []int64{-1, 1 << 40} {
+			var archive bytes.Buffer
+			io.WriteString(&archive, backupMagic)
+			writeBackupRecord(&archive, &BackupHeader{SchemaVersion: backupSchemaVersion, NotebookCount: count})
+
+			status, _ := restore(NewNotebookRepo(nil), "", archive.Bytes())
+
+			assert.Equal(t, 400, status, count)
+		}
+	})
+	t.Run("NewerSchemaVersion/Error", func(t *testing.T) {
+		var archive bytes.Buffer
+		writeVersionedBackup(&archive, backupSchemaVersion+1, nil)
+
+		status, _ := restore(NewNotebookRepo(nil), "", archive.Bytes())
+
+		assert.Equal(t, 400, status)
+	})
+	t.Run("OlderSchemaVersion/Upgraded", func(t *testing.T) {
+		backupUpgrades[backupSchemaVersion-1] = func(notebook *BackupNotebook) error {
+			for _, note := range notebook.Notes {
+				note.Title = "upgraded"
+			}
+			return nil
+		}
+		defer delete(backupUpgrades, backupSchemaVersion-1)
+
+		var archive bytes.Buffer
+		writeVersionedBackup(&archive, backupSchemaVersion-1, []*BackupNotebook{
+			{Name: "old_notebook", Notes: []*Note{{Id: "id_1", Title: "title_1", Tags: []string{"tag_1"}}}},
+		})
+		repo := NewNotebookRepo(nil)
+
+		status, result := restore(repo, "", archive.Bytes())
+
+		assert.Equal(t, 200, status)
+		assert.Equal(t, uint32(backupSchemaVersion-1), result.SchemaVersion)
+		notebook := repo.notebooks["old_notebook"]
+		assert.Equal(t, "upgraded", notebook.notes["id_1"].Title)
+		assert.Equal(t, []string{"id_1"}, notebook.tags["tag_1"])
+	})
+	t.Run("UnknownMode/Error", func(t *testing.T) {
+		status, _ := restore(NewNotebookRepo(nil), "mode=append", nil)
+
+		assert.Equal(t, 400, status)
+	})
+}
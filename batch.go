@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// defaultMaxBatchSize bounds the items of a batch when
+// limits.max_batch_size is not configured
+const defaultMaxBatchSize = 100
+
+// noteBatch remembers the notes of every notebook touched by a batch, so
+// that an atomic batch can be rolled back and the tags index of each
+// notebook is only rebuilt once
+type noteBatch struct {
+	repo    *NotebookRepo
+	saved   map[string]map[string]*Note
+	touched map[string]Notebook
+}
+
+func newNoteBatch(repo *NotebookRepo) *noteBatch {
+	return &noteBatch{
+		repo:    repo,
+		saved:   make(map[string]map[string]*Note),
+		touched: make(map[string]Notebook),
+	}
+}
+
+// touch saves the notes of the notebook named name before an item of the
+// batch changes it
+func (b *noteBatch) touch(name string) {
+	if _, ok := b.touched[name]; ok {
+		return
+	}
+	notebook, ok := b.repo.notebooks[name]
+	if !ok {
+		return
+	}
+	saved := make(map[string]*Note, len(notebook.notes))
+	for id, note := range notebook.notes {
+		saved[id] = note
+	}
+	b.saved[name] = saved
+	b.touched[name] = notebook
+}
+
+// rollback restores the notes of every touched notebook, their tags index
+// was left untouched by the items
+func (b *noteBatch) rollback() {
+	for name, notebook := range b.touched {
+		saved := b.saved[name]
+		for id := range notebook.notes {
+			if _, ok := saved[id]; !ok {
+				notebook.removeNote(id)
+			}
+		}
+		for id, note := range saved {
+			if notebook.notes[id] != note {
+				notebook.putNote(note)
+			}
+		}
+	}
+}
+
+// commit rebuilds the tags index of every touched notebook and releases
+// the attachments and stars of the notes the batch deleted
+func (b *noteBatch) commit() {
+	for _, notebook := range b.touched {
+		notebook.rebuildTags()
+		b.repo.collectAttachments(notebook)
+		notebook.collectStars()
+	}
+}
+
+// runBatch applies each of count items, every item is attempted so that all
+// errors are reported. An atomic batch with a failed item is rolled back
+// and responded to with the status of its first failure
+func (n *NotebookRepo) runBatch(atomic bool, count int, apply func(b *noteBatch, i int) (*Note, error)) (*BatchNotesResponse, int) {
+	b := newNoteBatch(n)
+	result := &BatchNotesResponse{Atomic: atomic, Applied: true}
+	status := http.StatusOK
+	for i := 0; i < count; i++ {
+		item := &BatchNoteResult{Index: int32(i), Status: http.StatusOK}
+		note, err := apply(b, i)
+		if err != nil {
+			item.Status = int32(errorStatus(err))
+			item.Error = err.Error()
+			if atomic && status == http.StatusOK {
+				status = errorStatus(err)
+			}
+		} else {
+			item.Note = note
+		}
+		result.Results = append(result.Results, item)
+	}
+
+	if status != http.StatusOK {
+		b.rollback()
+		result.Applied = false
+		for _, item := range result.Results {
+			item.Note = nil
+		}
+		return result, status
+	}
+	b.commit()
+	return result, status
+}
+
+// validBatch checks the size of a batch and that its items hold no
+// idempotency key, as only the batch itself can be retried
+func (n *NotebookRepo) validBatch(w http.ResponseWriter, r *http.Request, itemKeys []string) bool {
+	var violations []*FieldViolation
+	if int64(len(itemKeys)) > n.maxBatchSize {
+		violations = append(violations, &FieldViolation{
+			Field:       "notes",
+			Description: fmt.Sprintf("must hold at most %d items", n.maxBatchSize),
+		})
+	}
+	for i, key := range itemKeys {
+		if key != "" {
+			violations = append(violations, &FieldViolation{
+				Field:       fmt.Sprintf("notes[%d].idempotency_key", i),
+				Description: "is not supported within a batch, set it on the batch instead",
+			})
+		}
+	}
+	if len(violations) != 0 {
+		n.writeBadRequest(w, r, violations)
+		return false
+	}
+	return true
+}
+
+// writeBatch responds with the BatchNotesResponse of a batch
+func (n *NotebookRepo) writeBatch(w http.ResponseWriter, r *http.Request, result *BatchNotesResponse, status int) {
+	if !result.Applied {
+		n.log(r).Error("Atomic batch rolled back", "items", len(result.Results))
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// BatchCreateNotes takes a request body attempting to deserialise it to a
+// BatchCreateNotesRequest object
+func (n *NotebookRepo) BatchCreateNotes(w http.ResponseWriter, r *http.Request) {
+	body := &BatchCreateNotesRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	keys := make([]string, len(body.Notes))
+	for i, item := range body.Notes {
+		keys[i] = item.IdempotencyKey
+	}
+	if !n.validBatch(w, r, keys) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	result, status := n.runBatch(body.Atomic, len(body.Notes), func(b *noteBatch, i int) (*Note, error) {
+		b.touch(body.Notes[i].GetNotebookName())
+		notebook, note, err := n.newNote(body.Notes[i])
+		if err != nil {
+			return nil, err
+		}
+		notebook.putNote(note)
+		return note, nil
+	})
+	n.writeBatch(w, r, result, status)
+}
+
+// BatchUpdateNotes takes a request body attempting to deserialise it to a
+// BatchUpdateNotesRequest object
+func (n *NotebookRepo) BatchUpdateNotes(w http.ResponseWriter, r *http.Request) {
+	body := &BatchUpdateNotesRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	keys := make([]string, len(body.Notes))
+	for i, item := range body.Notes {
+		keys[i] = item.IdempotencyKey
+	}
+	if !n.validBatch(w, r, keys) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	result, status := n.runBatch(body.Atomic, len(body.Notes), func(b *noteBatch, i int) (*Note, error) {
+		b.touch(body.Notes[i].GetNotebookName())
+		_, _, note, err := n.updateNote(body.Notes[i])
+		return note, err
+	})
+	n.writeBatch(w, r, result, status)
+}
+
+// BatchDeleteNotes takes a request body attempting to deserialise it to a
+// BatchDeleteNotesRequest object
+func (n *NotebookRepo) BatchDeleteNotes(w http.ResponseWriter, r *http.Request) {
+	body := &BatchDeleteNotesRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	keys := make([]string, len(body.Notes))
+	for i, item := range body.Notes {
+		keys[i] = item.IdempotencyKey
+	}
+	if !n.validBatch(w, r, keys) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	result, status := n.runBatch(body.Atomic, len(body.Notes), func(b *noteBatch, i int) (*Note, error) {
+		b.touch(body.Notes[i].GetNotebookName())
+		_, note, err := n.deleteNote(body.Notes[i])
+		return note, err
+	})
+	n.writeBatch(w, r, result, status)
+}
+
+// BatchGetNotes takes a request body attempting to deserialise it to a
+// BatchGetNotesRequest object
+func (n *NotebookRepo) BatchGetNotes(w http.ResponseWriter, r *http.Request) {
+	body := &BatchGetNotesRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	if !n.validBatch(w, r, make([]string, len(body.Notes))) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	// nothing is touched so the batch never writes to the notebooks
+	result, status := n.runBatch(body.Atomic, len(body.Notes), func(b *noteBatch, i int) (*Note, error) {
+		_, note, err := n.lookupNote(body.Notes[i].GetNotebookName(), body.Notes[i].GetId())
+		return note, err
+	})
+	n.writeBatch(w, r, result, status)
+}
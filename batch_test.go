@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchNotes(t *testing.T) {
+	repo := NewNotebookRepo(nil)
+	repo.maxBatchSize = 3
+	router := newRouter(repo, newHealth(), defaultConfig())
+	request := func(method, body string) (int, *BatchNotesResponse) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/note/batch", bytes.NewBufferString(body)))
+		result := &BatchNotesResponse{}
+		json.Unmarshal(w.Body.Bytes(), result)
+		return w.Code, result
+	}
+	tagged := func(tag string) []string {
+		ids := append([]string(nil), repo.notebooks["batch_notebook"].tags[tag]...)
+		sort.Strings(ids)
+		return ids
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/notebook", bytes.NewBufferString(`{"name": "batch_notebook"}`)))
+	assert.Equal(t, 200, w.Code)
+
+	var ids []string
+	t.Run("Create/BestEffort", func(t *testing.T) {
+		code, result := request("POST", `{"notes": [
+			{"notebook_name": "batch_notebook", "title": "t1", "body": "b1", "tags": ["tag_1"]},
+			{"notebook_name": "missing", "title": "t2", "body": "b2"},
+			{"notebook_name": "batch_notebook", "title": "t3", "body": "b3", "tags": ["tag_1"]}
+		]}`)
+
+		assert.Equal(t, 200, code)
+		assert.True(t, result.Applied)
+		assert.Len(t, result.Results, 3)
+		assert.Equal(t, int32(200), result.Results[0].Status)
+		assert.Equal(t, int32(400), result.Results[1].Status)
+		assert.Equal(t, "Notebook with name 'missing' does not exist", result.Results[1].Error)
+		assert.Nil(t, result.Results[1].Note)
+		ids = []string{result.Results[0].Note.Id, result.Results[2].Note.Id}
+		sort.Strings(ids)
+		assert.Equal(t, ids, tagged("tag_1"))
+	})
+	t.Run("Create/Atomic/RolledBack", func(t *testing.T) {
+		code, result := request("POST", `{"atomic": true, "notes": [
+			{"notebook_name": "batch_notebook", "title": "t4", "body": "b4", "tags": ["tag_2"]},
+			{"notebook_name": "batch_notebook", "title": "t5", "body": "b5", "tags": ["tag_2"]},
+			{"notebook_name": "missing", "title": "t6", "body": "b6"}
+		]}`)
+
+		assert.Equal(t, 400, code)
+		assert.False(t, result.Applied)
+		assert.Nil(t, result.Results[0].Note)
+		assert.Equal(t, int32(400), result.Results[2].Status)
+		assert.Len(t, repo.notebooks["batch_notebook"].notes, 2)
+		assert.Empty(t, tagged("tag_2"))
+	})
+	t.Run("Update/Atomic", func(t *testing.T) {
+		code, result := request("UPDATE", `{"atomic": true, "notes": [
+			{"notebook_name": "batch_notebook", "id": "`+ids[0]+`", "title": "t1", "body": "b1", "tags": ["tag_2"]},
+			{"notebook_name": "batch_notebook", "id": "`+ids[1]+`", "title": "t3", "body": "b3", "tags": ["tag_2"]}
+		]}`)
+
+		assert.Equal(t, 200, code)
+		assert.True(t, result.Applied)
+		assert.Equal(t, []string{"tag_2"}, result.Results[0].Note.Tags)
+		assert.Empty(t, tagged("tag_1"))
+		assert.Equal(t, ids, tagged("tag_2"))
+	})
+	t.Run("Delete/Atomic/RolledBack", func(t *testing.T) {
+		code, result := request("DELETE", `{"atomic": true, "notes": [
+			{"notebook_name": "batch_notebook", "id": "`+ids[0]+`"},
+			{"notebook_name": "batch_notebook", "id": "missing"}
+		]}`)
+
+		assert.Equal(t, 400, code)
+		assert.False(t, result.Applied)
+		assert.Len(t, repo.notebooks["batch_notebook"].notes, 2)
+		assert.Equal(t, ids, tagged("tag_2"))
+	})
+	t.Run("Get", func(t *testing.T) {
+		body := `{"notes": [
+			{"notebook_name": "batch_notebook", "id": "` + ids[0] + `"},
+			{"notebook_name": "batch_notebook", "id": "missing"}
+		]}`
+		code, result := request("GET", body)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, ids[0], result.Results[0].Note.Id)
+		assert.Equal(t, int32(400), result.Results[1].Status)
+
+		code, result = request("GET", `{"atomic": true, `+body[1:])
+		assert.Equal(t, 400, code)
+		assert.Nil(t, result.Results[0].Note)
+	})
+	t.Run("Delete/BestEffort", func(t *testing.T) {
+		code, result := request("DELETE", `{"notes": [
+			{"notebook_name": "batch_notebook", "id": "`+ids[0]+`"},
+			{"notebook_name": "batch_notebook", "id": "missing"}
+		]}`)
+
+		assert.Equal(t, 200, code)
+		assert.Equal(t, ids[0], result.Results[0].Note.Id)
+		assert.Len(t, repo.notebooks["batch_notebook"].notes, 1)
+		assert.Equal(t, ids[1:], tagged("tag_2"))
+	})
+	t.Run("Quota/Atomic", func(t *testing.T) {
+		repo.quota = QuotaConfig{MaxNotes: 2}
+		defer func() { repo.quota = QuotaConfig{} }()
+		code, result := request("POST", `{"atomic": true, "notes": [
+			{"notebook_name": "batch_notebook", "title": "t7", "body": "b7"},
+			{"notebook_name": "batch_notebook", "title": "t8", "body": "b8"}
+		]}`)
+
+		assert.Equal(t, 403, code)
+		assert.Equal(t, int32(200), result.Results[0].Status)
+		assert.Equal(t, int32(403), result.Results[1].Status)
+		assert.Len(t, repo.notebooks["batch_notebook"].notes, 1)
+	})
+	t.Run("Invalid/BadRequest", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/note/batch", bytes.NewBufferString(`{"notes": [
+			{"notebook_name": "batch_notebook", "title": "t", "body": "b", "idempotency_key": "k"},
+			{"notebook_name": "batch_notebook", "title": "t", "body": "b"},
+			{"notebook_name": "batch_notebook", "title": "t", "body": "b"},
+			{"notebook_name": "batch_notebook", "title": "", "body": "b"}
+		]}`)))
+
+		assert.Equal(t, 400, w.Code)
+		badRequest := &BadRequest{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), badRequest))
+		assert.Equal(t, []*FieldViolation{
+			{Field: "notes[3].title", Description: "must not be empty"},
+		}, badRequest.Violations)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/note/batch", bytes.NewBufferString(`{"notes": [
+			{"notebook_name": "batch_notebook", "title": "t", "body": "b", "idempotency_key": "k"},
+			{"notebook_name": "batch_notebook", "title": "t", "body": "b"},
+			{"notebook_name": "batch_notebook", "title": "t", "body": "b"},
+			{"notebook_name": "batch_notebook", "title": "t", "body": "b"}
+		]}`)))
+		assert.Equal(t, 400, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), badRequest))
+		assert.Equal(t, []*FieldViolation{
+			{Field: "notes", Description: "must hold at most 3 items"},
+			{Field: "notes[0].idempotency_key", Description: "is not supported within a batch, set it on the batch instead"},
+		}, badRequest.Violations)
+	})
+}
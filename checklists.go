@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+)
+
+// checklistPattern matches a checklist item, capturing its indentation,
+// its mark and its text
+var checklistPattern = regexp.MustCompile(`^([ \t]*)(?:[-*+]|\d{1,9}[.)]) +\[([ xX])\](?:[ \t]+(.*))?$`)
+
+// checklistItem is a ChecklistItem along with the offset of its mark in
+// the body of its note
+type checklistItem struct {
+	*ChecklistItem
+	mark int
+}
+
+// checklistItemID derives the id of an item from its text, the n-th item
+// holding a text held by a previous item getting a -n suffix
+func checklistItemID(text string, n int) string {
+	sum := sha256.Sum256([]byte(text))
+	id := hex.EncodeToString(sum[:6])
+	if n > 1 {
+		id += "-" + strconv.Itoa(n)
+	}
+	return id
+}
+
+// parseChecklist returns the checklist items of body, lines of fenced code
+// blocks being skipped
+func parseChecklist(body string) []checklistItem {
+	var items []checklistItem
+	var indents []int
+	seen := make(map[string]int)
+	fenced := ""
+	offset := 0
+	for i, line := range strings.SplitAfter(body, "\n") {
+		start := offset
+		offset += len(line)
+		line = strings.TrimRight(line, "\r\n")
+
+		if marker, _, ok := fence(line); ok && (fenced == "" || strings.HasPrefix(marker, fenced)) {
+			if fenced == "" {
+				fenced = marker
+			} else {
+				fenced = ""
+			}
+			continue
+		}
+		m := checklistPattern.FindStringSubmatchIndex(line)
+		if fenced != "" || m == nil {
+			continue
+		}
+		indent := len(expandTabs(line[:m[3]]))
+		for len(indents) != 0 && indents[len(indents)-1] >= indent {
+			indents = indents[:len(indents)-1]
+		}
+		var text string
+		if m[6] != -1 {
+			text = strings.TrimSpace(line[m[6]:m[7]])
+		}
+		seen[text]++
+		items = append(items, checklistItem{
+			ChecklistItem: &ChecklistItem{
+				Id:      checklistItemID(text, seen[text]),
+				Text:    text,
+				Checked: line[m[4]] != ' ',
+				Line:    int64(i + 1),
+				Depth:   int64(len(indents)),
+			},
+			mark: start + m[4],
+		})
+		indents = append(indents, indent)
+	}
+	return items
+}
+
+// checklistProgress counts the checked items of items
+func checklistProgress(items []checklistItem) *ChecklistProgress {
+	progress := &ChecklistProgress{Total: int64(len(items))}
+	for _, item := range items {
+		if item.Checked {
+			progress.Completed++
+		}
+	}
+	return progress
+}
+
+// checklistIndex holds the checklist progress of the notes of a notebook
+// holding checklist items, it is kept up to date by Notebook.putNote and
+// Notebook.removeNote so that bodies are parsed once per write
+type checklistIndex struct {
+	progress map[string]*ChecklistProgress
+}
+
+func newChecklistIndex() *checklistIndex {
+	return &checklistIndex{progress: make(map[string]*ChecklistProgress)}
+}
+
+// put records the progress of note, replacing any previous version
+func (x *checklistIndex) put(note *Note) {
+	if x == nil {
+		return
+	}
+	x.remove(note.Id)
+	if progress := checklistProgress(parseChecklist(note.GetBody())); progress.Total != 0 {
+		x.progress[note.Id] = progress
+	}
+}
+
+// remove drops the progress of the note with id
+func (x *checklistIndex) remove(id string) {
+	if x == nil {
+		return
+	}
+	delete(x.progress, id)
+}
+
+// checklistProgress returns the checklist progress of the note with id,
+// notebooks built without a checklist index parse its body
+func (nb Notebook) checklistProgress(id string) (*ChecklistProgress, bool) {
+	if nb.checklists != nil {
+		progress, ok := nb.checklists.progress[id]
+		return progress, ok
+	}
+	progress := checklistProgress(parseChecklist(nb.notes[id].GetBody()))
+	return progress, progress.Total != 0
+}
+
+// GetChecklist takes a request body attempting to deserialise it to a
+// GetChecklistRequest object
+func (n *NotebookRepo) GetChecklist(w http.ResponseWriter, r *http.Request) {
+	body := &GetChecklistRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	_, note, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := parseChecklist(note.Body)
+	result := &GetChecklistResponse{
+		NotebookName: body.GetNotebookName(),
+		Id:           note.Id,
+		Progress:     checklistProgress(items),
+	}
+	for _, item := range items {
+		result.Items = append(result.Items, item.ChecklistItem)
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// ToggleChecklistItem takes a request body attempting to deserialise it to
+// a ToggleChecklistItemRequest object. Only the mark of the item is edited,
+// the note being stored as UpdateNote stores it
+func (n *NotebookRepo) ToggleChecklistItem(w http.ResponseWriter, r *http.Request) {
+	body := &ToggleChecklistItemRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	if body.GetLastModified() == nil && body.GetLine() <= 0 {
+		n.writeBadRequest(w, r, []*FieldViolation{{Field: "line", Description: "must be set when last_modified is not"}})
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.log(r).Debug("ToggleChecklistItem", "request", body)
+
+	_, note, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.GetLastModified() != nil && timestampNanos(body.GetLastModified()) != modifiedNanos(note) {
+		modified := note.GetLastModified()
+		if modified == nil {
+			modified = note.GetCreated()
+		}
+		t, _ := ptypes.Timestamp(modified)
+		errMsg := fmt.Sprintf("Note with id '%s' was last modified at %s", note.Id, t.Format(time.RFC3339Nano))
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusConflict)
+		return
+	}
+
+	items := parseChecklist(note.Body)
+	var item *checklistItem
+	for i := range items {
+		if items[i].Id == body.GetItemId() {
+			item = &items[i]
+			break
+		}
+	}
+	if item == nil {
+		errMsg := fmt.Sprintf("Checklist item '%s' does not exist in note '%s'", body.GetItemId(), note.Id)
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+	if body.GetLine() > 0 && item.Line != body.GetLine() {
+		errMsg := fmt.Sprintf("Checklist item '%s' of note '%s' moved to line %d", item.Id, note.Id, item.Line)
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusConflict)
+		return
+	}
+
+	if item.Checked != body.GetChecked() {
+		mark := " "
+		if body.GetChecked() {
+			mark = "x"
+		}
+		_, _, note, err = n.updateNote(&UpdateNoteRequest{
+			NotebookName: body.GetNotebookName(),
+			Id:           note.Id,
+			Title:        note.Title,
+			Body:         note.Body[:item.mark] + mark + note.Body[item.mark+1:],
+			Tags:         note.Tags,
+			Properties:   note.Properties,
+			RemindAt:     note.RemindAt,
+			Recurrence:   note.Recurrence,
+		})
+		if err != nil {
+			n.log(r).Error(err.Error())
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		item.Checked = body.GetChecked()
+	}
+
+	result := &ToggleChecklistItemResponse{Note: note, Item: item.ChecklistItem, Progress: checklistProgress(items)}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
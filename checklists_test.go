@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/stretchr/testify/assert"
+)
+
+const checklistBody = "# Release\r\n" +
+	"- [ ] write notes\r\n" +
+	"  - [X] draft\r\n" +
+	"  - [ ]\tproofread \r\n" +
+	"1. [x] tag\r\n" +
+	"```\r\n" +
+	"- [ ] not an item\r\n" +
+	"```\r\n" +
+	"* [ ] write notes\r\n" +
+	"- [] nor this\r\n" +
+	"- [ ]"
+
+func TestParseChecklist(t *testing.T) {
+	items := parseChecklist(checklistBody)
+
+	var got []*ChecklistItem
+	for _, item := range items {
+		got = append(got, item.ChecklistItem)
+		assert.Contains(t, " xX", checklistBody[item.mark:item.mark+1])
+	}
+	assert.Equal(t, []*ChecklistItem{
+		{Id: checklistItemID("write notes", 1), Text: "write notes", Line: 2},
+		{Id: checklistItemID("draft", 1), Text: "draft", Checked: true, Line: 3, Depth: 1},
+		{Id: checklistItemID("proofread", 1), Text: "proofread", Line: 4, Depth: 1},
+		{Id: checklistItemID("tag", 1), Text: "tag", Checked: true, Line: 5},
+		{Id: checklistItemID("write notes", 2), Text: "write notes", Line: 9},
+		{Id: checklistItemID("", 1), Line: 11},
+	}, got)
+	assert.NotEqual(t, got[0].Id, got[4].Id)
+	assert.Equal(t, &ChecklistProgress{Completed: 2, Total: 6}, checklistProgress(items))
+
+	t.Run("StableIDs", func(t *testing.T) {
+		edited := parseChecklist("intro\n\n" + checklistBody[:len(checklistBody)-5] + "- [x]")
+		for i, item := range edited {
+			assert.Equal(t, items[i].Id, item.Id)
+		}
+	})
+}
+
+func TestChecklists(t *testing.T) {
+	newRepo := func() (*NotebookRepo, string) {
+		repo := newTestRepo("check_notebook")
+		note, err := repo.createNote(&CreateNoteRequest{NotebookName: "check_notebook", Title: "Release", Body: checklistBody})
+		assert.NoError(t, err)
+		_, err = repo.createNote(&CreateNoteRequest{NotebookName: "check_notebook", Title: "Plain", Body: "no items"})
+		assert.NoError(t, err)
+		return repo, note.Id
+	}
+	request := func(repo *NotebookRepo, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		newRouter(repo, newHealth(), defaultConfig()).ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	toggle := func(repo *NotebookRepo, req *ToggleChecklistItemRequest) *httptest.ResponseRecorder {
+		req.NotebookName = "check_notebook"
+		body, _ := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(req)
+		return request(repo, "UPDATE", "/note/checklist", body)
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		repo, id := newRepo()
+		w := request(repo, "GET", "/note/checklist", `{"notebook_name": "check_notebook", "id": "`+id+`"}`)
+		assert.Equal(t, 200, w.Code)
+		result := &GetChecklistResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Len(t, result.Items, 6)
+		assert.Equal(t, "draft", result.Items[1].Text)
+		assert.Equal(t, int64(2), result.Progress.Completed)
+	})
+	t.Run("Toggle", func(t *testing.T) {
+		repo, id := newRepo()
+		w := toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("proofread", 1), Checked: true, Line: 4})
+		assert.Equal(t, 200, w.Code)
+		result := &ToggleChecklistItemResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		expected := "# Release\r\n- [ ] write notes\r\n  - [X] draft\r\n  - [x]\tproofread \r\n" + checklistBody[len("# Release\r\n- [ ] write notes\r\n  - [X] draft\r\n  - [ ]\tproofread \r\n"):]
+		assert.Equal(t, expected, result.Note.Body)
+		assert.True(t, result.Item.Checked)
+		assert.Equal(t, &ChecklistProgress{Completed: 3, Total: 6}, result.Progress)
+		stored := repo.notebooks["check_notebook"].notes[id]
+		assert.Equal(t, expected, stored.Body)
+		assert.NotNil(t, stored.LastModified)
+
+		w = toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("draft", 1), Line: 3})
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, repo.notebooks["check_notebook"].notes[id].Body, "  - [ ] draft\r\n")
+	})
+	t.Run("Toggle/Unchanged", func(t *testing.T) {
+		repo, id := newRepo()
+		w := toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("tag", 1), Checked: true, Line: 5})
+		assert.Equal(t, 200, w.Code)
+
+		stored := repo.notebooks["check_notebook"].notes[id]
+		assert.Equal(t, checklistBody, stored.Body)
+		assert.Nil(t, stored.LastModified)
+	})
+	t.Run("Toggle/LastModified", func(t *testing.T) {
+		repo, id := newRepo()
+		created := repo.notebooks["check_notebook"].notes[id].Created
+		stale := &timestamp.Timestamp{Seconds: created.Seconds - 1, Nanos: created.Nanos}
+		w := toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("write notes", 1), Checked: true, LastModified: stale})
+		assert.Equal(t, 409, w.Code)
+		assert.Contains(t, w.Body.String(), "was last modified at")
+		assert.Equal(t, checklistBody, repo.notebooks["check_notebook"].notes[id].Body)
+
+		w = toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("write notes", 1), Checked: true, LastModified: created})
+		assert.Equal(t, 200, w.Code)
+		result := &ToggleChecklistItemResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		// the next toggle must be based on the note it returned
+		w = toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("write notes", 2), Checked: true, LastModified: created})
+		assert.Equal(t, 409, w.Code)
+		w = toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("write notes", 2), Checked: true, LastModified: result.Note.LastModified})
+		assert.Equal(t, 200, w.Code)
+	})
+	t.Run("Toggle/Line", func(t *testing.T) {
+		repo, id := newRepo()
+		w := toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("write notes", 2), Checked: true, Line: 2})
+		assert.Equal(t, 409, w.Code)
+		assert.Contains(t, w.Body.String(), "moved to line 9")
+		assert.Equal(t, checklistBody, repo.notebooks["check_notebook"].notes[id].Body)
+
+		w = toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("write notes", 2), Checked: true, Line: 9})
+		assert.Equal(t, 200, w.Code)
+	})
+	t.Run("Toggle/Unguarded", func(t *testing.T) {
+		repo, id := newRepo()
+		w := toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("tag", 1), Checked: true})
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "must be set when last_modified is not")
+	})
+	t.Run("Toggle/UnknownItem", func(t *testing.T) {
+		repo, id := newRepo()
+		w := toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: "0123456789ab", Checked: true, Line: 1})
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "Checklist item '0123456789ab' does not exist")
+	})
+	t.Run("Toggle/Quota", func(t *testing.T) {
+		repo, id := newRepo()
+		repo.quota.MaxBodyBytes = int64(len(checklistBody)) + int64(len("no items")) - 1
+		w := toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("tag", 1), Line: 5})
+
+		assert.Equal(t, 403, w.Code)
+	})
+	t.Run("GetNotebook", func(t *testing.T) {
+		repo, id := newRepo()
+		toggle(repo, &ToggleChecklistItemRequest{Id: id, ItemId: checklistItemID("", 1), Checked: true, Line: 11})
+		w := request(repo, "GET", "/notebook", `{"name": "check_notebook"}`)
+		assert.Equal(t, 200, w.Code)
+		result := &GetNotebookResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Len(t, result.Notes, 2)
+		assert.Len(t, result.Checklists, 1)
+		assert.Equal(t, int64(3), result.Checklists[id].Completed)
+		assert.Equal(t, int64(6), result.Checklists[id].Total)
+	})
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets when the effective config is printed
+const redacted = "<redacted>"
+
+// storageMemory is the only storage backend, notebooks live in memory
+const storageMemory = "memory"
+
+// Config is the effective configuration of the server, built from the
+// defaults, a YAML file, environment variables and flags, each overriding
+// the previous one
+type Config struct {
+	API       APIConfig       `yaml:"api"`
+	Admin     AdminConfig     `yaml:"admin"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Limits    LimitsConfig    `yaml:"limits"`
+	Reminders RemindersConfig `yaml:"reminders"`
+	Log       LogConfig       `yaml:"log"`
+}
+
+// APIConfig configures the public listener
+type APIConfig struct {
+	Addr            string        `yaml:"addr"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	GracefulTimeout time.Duration `yaml:"graceful_timeout"`
+	IdempotencyTTL  time.Duration `yaml:"idempotency_ttl"`
+	TLS             TLSConfig     `yaml:"tls"`
+}
+
+// TLSConfig switches the public listener to HTTPS once a certificate and key
+// are set, client certificates are verified against the client CA bundle
+type TLSConfig struct {
+	CertFile          string   `yaml:"cert_file"`
+	KeyFile           string   `yaml:"key_file"`
+	ClientCAFile      string   `yaml:"client_ca_file"`
+	ClientAuth        string   `yaml:"client_auth"`
+	AllowedPrincipals []string `yaml:"allowed_principals"`
+}
+
+// enabled reports whether the public listener serves HTTPS
+func (t TLSConfig) enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// AdminConfig configures the admin listener, an empty addr disables it
+type AdminConfig struct {
+	Addr  string `yaml:"addr"`
+	Token string `yaml:"token"`
+	Pprof bool   `yaml:"pprof"`
+}
+
+// StorageConfig selects where notebooks are stored, attachments are stored
+// on disk under AttachmentsDir whatever the backend
+type StorageConfig struct {
+	Backend        string `yaml:"backend"`
+	AttachmentsDir string `yaml:"attachments_dir"`
+}
+
+// LimitsConfig bounds what a single request may cost the server
+type LimitsConfig struct {
+	MaxRequestBytes int64 `yaml:"max_request_bytes"`
+	MaxBatchSize    int64 `yaml:"max_batch_size"`
+	// MaxAttachmentBytes bounds a single attachment, uploads are also
+	// bounded by MaxRequestBytes
+	MaxAttachmentBytes int64           `yaml:"max_attachment_bytes"`
+	RateLimit          RateLimitConfig `yaml:"rate_limit"`
+	Quota              QuotaConfig     `yaml:"quota"`
+}
+
+// RateLimit is a token bucket refilled with RequestsPerSecond tokens and
+// holding at most Burst of them, a zero rate disables it
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
+// RateLimitConfig limits requests per client, routes are keyed by a method
+// and a route template - e.g. "POST /note" - and override the default
+type RateLimitConfig struct {
+	Default RateLimit            `yaml:"default"`
+	Routes  map[string]RateLimit `yaml:"routes"`
+}
+
+// QuotaConfig bounds the size of every notebook, zero means unlimited
+type QuotaConfig struct {
+	MaxNotes       int64 `yaml:"max_notes"`
+	MaxBodyBytes   int64 `yaml:"max_body_bytes"`
+	MaxTagsPerNote int64 `yaml:"max_tags_per_note"`
+	// MaxAttachmentBytes bounds the total size of the attachments of a
+	// notebook, attachments shared by several notes count once per note
+	MaxAttachmentBytes int64 `yaml:"max_attachment_bytes"`
+}
+
+// RemindersConfig configures the scheduler firing the reminders of notes,
+// every firing is posted to WebhookURL when it is set
+type RemindersConfig struct {
+	Interval   time.Duration `yaml:"interval"`
+	WebhookURL string        `yaml:"webhook_url"`
+}
+
+// LogConfig configures the Logger
+type LogConfig struct {
+	Level string `yaml:"level"`
+}
+
+// defaultConfig holds the values used when nothing else is configured
+func defaultConfig() *Config {
+	return &Config{
+		API: APIConfig{
+			Addr:            "0.0.0.0:8080",
+			ReadTimeout:     2 * time.Second,
+			WriteTimeout:    2 * time.Second,
+			GracefulTimeout: 15 * time.Second,
+			IdempotencyTTL:  defaultIdempotencyTTL,
+			TLS: TLSConfig{
+				ClientAuth: clientAuthNone,
+			},
+		},
+		Admin: AdminConfig{
+			Addr: "127.0.0.1:8081",
+		},
+		Storage: StorageConfig{
+			Backend:        storageMemory,
+			AttachmentsDir: defaultAttachmentsDir,
+		},
+		Limits: LimitsConfig{
+			MaxRequestBytes:    32 << 20,
+			MaxBatchSize:       defaultMaxBatchSize,
+			MaxAttachmentBytes: defaultMaxAttachmentBytes,
+		},
+		Reminders: RemindersConfig{
+			Interval: defaultReminderInterval,
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+	}
+}
+
+// setting is a single config value that can be set from a string by an
+// environment variable or a flag
+type setting struct {
+	flag   string
+	env    string
+	usage  string
+	isBool bool
+	apply  func(c *Config, value string) error
+}
+
+func durationSetting(target func(c *Config) *time.Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*target(c) = d
+		return nil
+	}
+}
+
+// settings lists every value configurable through the environment or flags,
+// secrets such as the admin token are deliberately not exposed as flags
+var settings = []setting{
+	// NTBK_PORT predates NTBK_ADDR, which wins when both are set, and keeps listening on every interface
+	{env: "NTBK_PORT",
+		apply: func(c *Config, v string) error { c.API.Addr = "0.0.0.0:" + v; return nil }},
+	{flag: "addr", env: "NTBK_ADDR", usage: "the address of the public listener",
+		apply: func(c *Config, v string) error { c.API.Addr = v; return nil }},
+	{flag: "read-timeout", env: "NTBK_READ_TIMEOUT", usage: "the maximum duration for reading a request - e.g. 2s",
+		apply: durationSetting(func(c *Config) *time.Duration { return &c.API.ReadTimeout })},
+	{flag: "write-timeout", env: "NTBK_WRITE_TIMEOUT", usage: "the maximum duration for writing a response - e.g. 2s",
+		apply: durationSetting(func(c *Config) *time.Duration { return &c.API.WriteTimeout })},
+	{flag: "graceful-timeout", env: "NTBK_GRACEFUL_TIMEOUT",
+		usage: "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m",
+		apply: durationSetting(func(c *Config) *time.Duration { return &c.API.GracefulTimeout })},
+	{flag: "idempotency-ttl", env: "NTBK_IDEMPOTENCY_TTL", usage: "how long responses are replayed to retries holding the same Idempotency-Key - e.g. 24h",
+		apply: durationSetting(func(c *Config) *time.Duration { return &c.API.IdempotencyTTL })},
+	{flag: "tls-cert-file", env: "NTBK_TLS_CERT_FILE", usage: "the certificate served by the public listener, enables HTTPS",
+		apply: func(c *Config, v string) error { c.API.TLS.CertFile = v; return nil }},
+	{flag: "tls-key-file", env: "NTBK_TLS_KEY_FILE", usage: "the private key of -tls-cert-file",
+		apply: func(c *Config, v string) error { c.API.TLS.KeyFile = v; return nil }},
+	{flag: "tls-client-ca-file", env: "NTBK_TLS_CLIENT_CA_FILE", usage: "the CA bundle client certificates are verified against",
+		apply: func(c *Config, v string) error { c.API.TLS.ClientCAFile = v; return nil }},
+	{flag: "tls-client-auth", env: "NTBK_TLS_CLIENT_AUTH", usage: "whether client certificates are required - none, optional or require",
+		apply: func(c *Config, v string) error { c.API.TLS.ClientAuth = v; return nil }},
+	{flag: "admin-addr", env: "NTBK_ADMIN_ADDR", usage: "the address of the admin listener, empty to disable it",
+		apply: func(c *Config, v string) error { c.Admin.Addr = v; return nil }},
+	{env: "NTBK_ADMIN_TOKEN",
+		apply: func(c *Config, v string) error { c.Admin.Token = v; return nil }},
+	{flag: "pprof", env: "NTBK_PPROF", usage: "serve pprof handlers under /admin/debug/pprof/ on the admin listener", isBool: true,
+		apply: func(c *Config, v string) (err error) { c.Admin.Pprof, err = strconv.ParseBool(v); return err }},
+	{flag: "storage-backend", env: "NTBK_STORAGE_BACKEND", usage: "where notebooks are stored - memory",
+		apply: func(c *Config, v string) error { c.Storage.Backend = v; return nil }},
+	{flag: "attachments-dir", env: "NTBK_ATTACHMENTS_DIR", usage: "the directory attachments are stored in",
+		apply: func(c *Config, v string) error { c.Storage.AttachmentsDir = v; return nil }},
+	{flag: "max-request-bytes", env: "NTBK_MAX_REQUEST_BYTES", usage: "the maximum size of a request body in bytes",
+		apply: func(c *Config, v string) (err error) {
+			c.Limits.MaxRequestBytes, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+	{flag: "max-batch-size", env: "NTBK_MAX_BATCH_SIZE", usage: "the maximum number of notes in a batch request",
+		apply: func(c *Config, v string) (err error) {
+			c.Limits.MaxBatchSize, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+	{flag: "max-attachment-bytes", env: "NTBK_MAX_ATTACHMENT_BYTES", usage: "the maximum size of a single attachment in bytes",
+		apply: func(c *Config, v string) (err error) {
+			c.Limits.MaxAttachmentBytes, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+	{flag: "rate-limit", env: "NTBK_RATE_LIMIT", usage: "the requests per second allowed to each client on every route, 0 to disable",
+		apply: func(c *Config, v string) (err error) {
+			c.Limits.RateLimit.Default.RequestsPerSecond, err = strconv.ParseFloat(v, 64)
+			return err
+		}},
+	{flag: "rate-burst", env: "NTBK_RATE_BURST", usage: "the requests a client may send at once before -rate-limit applies",
+		apply: func(c *Config, v string) (err error) {
+			c.Limits.RateLimit.Default.Burst, err = strconv.Atoi(v)
+			return err
+		}},
+	{flag: "max-notes", env: "NTBK_MAX_NOTES", usage: "the maximum number of notes in a notebook, 0 for unlimited",
+		apply: func(c *Config, v string) (err error) {
+			c.Limits.Quota.MaxNotes, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+	{flag: "max-notebook-bytes", env: "NTBK_MAX_NOTEBOOK_BYTES", usage: "the maximum total size of the note bodies of a notebook, 0 for unlimited",
+		apply: func(c *Config, v string) (err error) {
+			c.Limits.Quota.MaxBodyBytes, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+	{flag: "max-tags-per-note", env: "NTBK_MAX_TAGS_PER_NOTE", usage: "the maximum number of tags on a note, 0 for unlimited",
+		apply: func(c *Config, v string) (err error) {
+			c.Limits.Quota.MaxTagsPerNote, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+	{flag: "max-notebook-attachment-bytes", env: "NTBK_MAX_NOTEBOOK_ATTACHMENT_BYTES",
+		usage: "the maximum total size of the attachments of a notebook, 0 for unlimited",
+		apply: func(c *Config, v string) (err error) {
+			c.Limits.Quota.MaxAttachmentBytes, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+	{flag: "reminder-interval", env: "NTBK_REMINDER_INTERVAL", usage: "how often due reminders are fired - e.g. 10s",
+		apply: durationSetting(func(c *Config) *time.Duration { return &c.Reminders.Interval })},
+	{flag: "reminder-webhook-url", env: "NTBK_REMINDER_WEBHOOK_URL", usage: "the URL every reminder firing is posted to, empty to disable it",
+		apply: func(c *Config, v string) error { c.Reminders.WebhookURL = v; return nil }},
+	{flag: "log-level", env: "NTBK_LOG_LEVEL", usage: "the minimum level of logged entries - debug, info, warn or error",
+		apply: func(c *Config, v string) error { c.Log.Level = v; return nil }},
+}
+
+// settingFlag collects a flag value so that it is only applied when the
+// flag is actually passed
+type settingFlag struct {
+	setting setting
+	value   string
+}
+
+func (f *settingFlag) String() string     { return f.value }
+func (f *settingFlag) Set(v string) error { f.value = v; return nil }
+func (f *settingFlag) IsBoolFlag() bool   { return f.setting.isBool }
+
+// loadConfig builds the effective Config from args and the environment
+// returned by getenv, printConfig reports whether -print-config was passed
+func loadConfig(args []string, getenv func(string) string) (cfg *Config, printConfig bool, err error) {
+	fs := flag.NewFlagSet("notebook", flag.ContinueOnError)
+	configPath := fs.String("config", "", "the path of a YAML config file, defaults to $NTBK_CONFIG")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective config and exit")
+	flags := make(map[string]*settingFlag)
+	for _, s := range settings {
+		if s.flag == "" {
+			continue
+		}
+		flags[s.flag] = &settingFlag{setting: s}
+		fs.Var(flags[s.flag], s.flag, s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	cfg = defaultConfig()
+	if *configPath == "" {
+		*configPath = getenv("NTBK_CONFIG")
+	}
+	if *configPath != "" {
+		data, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to read config file: %v", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			return nil, false, fmt.Errorf("invalid config file %s: %v", *configPath, err)
+		}
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.apply(cfg, value); err != nil {
+				return nil, false, fmt.Errorf("invalid %s: %v", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		setFlag, ok := flags[f.Name]
+		if !ok || flagErr != nil {
+			return
+		}
+		if err := setFlag.setting.apply(cfg, setFlag.value); err != nil {
+			flagErr = fmt.Errorf("invalid -%s: %v", f.Name, err)
+		}
+	})
+	if flagErr != nil {
+		return nil, false, flagErr
+	}
+
+	return cfg, printConfig, cfg.validate()
+}
+
+// validate reports every invalid value at once
+func (c *Config) validate() error {
+	var problems []string
+	checkAddr := func(name, addr string) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	checkAddr("api.addr", c.API.Addr)
+	if c.API.ReadTimeout <= 0 {
+		problems = append(problems, "api.read_timeout: must be positive")
+	}
+	if c.API.WriteTimeout <= 0 {
+		problems = append(problems, "api.write_timeout: must be positive")
+	}
+	if c.API.GracefulTimeout < 0 {
+		problems = append(problems, "api.graceful_timeout: must not be negative")
+	}
+	if c.API.IdempotencyTTL <= 0 {
+		problems = append(problems, "api.idempotency_ttl: must be positive")
+	}
+	tlsConfig := c.API.TLS
+	if tlsConfig.enabled() && (tlsConfig.CertFile == "" || tlsConfig.KeyFile == "") {
+		problems = append(problems, "api.tls: cert_file and key_file must be set together")
+	}
+	if _, ok := clientAuthTypes[tlsConfig.ClientAuth]; !ok {
+		problems = append(problems, fmt.Sprintf("api.tls.client_auth: unknown value '%s', expected %s, %s or %s",
+			tlsConfig.ClientAuth, clientAuthNone, clientAuthOptional, clientAuthRequire))
+	}
+	if tlsConfig.ClientAuth != clientAuthNone && tlsConfig.ClientAuth != "" && tlsConfig.ClientCAFile == "" {
+		problems = append(problems, "api.tls.client_auth: requires client_ca_file")
+	}
+	if tlsConfig.ClientCAFile != "" && !tlsConfig.enabled() {
+		problems = append(problems, "api.tls.client_ca_file: requires cert_file and key_file")
+	}
+	if len(tlsConfig.AllowedPrincipals) != 0 && tlsConfig.ClientAuth == clientAuthNone {
+		problems = append(problems, "api.tls.allowed_principals: requires client_auth optional or require")
+	}
+	if c.Admin.Addr != "" {
+		checkAddr("admin.addr", c.Admin.Addr)
+		if c.Admin.Addr == c.API.Addr {
+			problems = append(problems, "admin.addr: must differ from api.addr")
+		}
+	}
+	if c.Storage.Backend != storageMemory {
+		problems = append(problems, fmt.Sprintf("storage.backend: unsupported backend '%s', expected %s",
+			c.Storage.Backend, storageMemory))
+	}
+	if c.Storage.AttachmentsDir == "" {
+		problems = append(problems, "storage.attachments_dir: must not be empty")
+	}
+	if c.Limits.MaxRequestBytes <= 0 {
+		problems = append(problems, "limits.max_request_bytes: must be positive")
+	}
+	if c.Limits.MaxBatchSize <= 0 {
+		problems = append(problems, "limits.max_batch_size: must be positive")
+	}
+	if c.Limits.MaxAttachmentBytes <= 0 {
+		problems = append(problems, "limits.max_attachment_bytes: must be positive")
+	}
+	checkRateLimit := func(name string, limit RateLimit) {
+		if limit.RequestsPerSecond < 0 {
+			problems = append(problems, name+".requests_per_second: must not be negative")
+		}
+		if limit.RequestsPerSecond > 0 && limit.Burst < 1 {
+			problems = append(problems, name+".burst: must be at least 1")
+		}
+	}
+	checkRateLimit("limits.rate_limit.default", c.Limits.RateLimit.Default)
+	for route, limit := range c.Limits.RateLimit.Routes {
+		if fields := strings.Fields(route); len(fields) != 2 || !strings.HasPrefix(fields[1], "/") {
+			problems = append(problems, fmt.Sprintf("limits.rate_limit.routes: invalid route '%s', expected a method and a path", route))
+		}
+		checkRateLimit(fmt.Sprintf("limits.rate_limit.routes[%s]", route), limit)
+	}
+	quota := c.Limits.Quota
+	if quota.MaxNotes < 0 || quota.MaxBodyBytes < 0 || quota.MaxTagsPerNote < 0 || quota.MaxAttachmentBytes < 0 {
+		problems = append(problems, "limits.quota: limits must not be negative")
+	}
+	if c.Reminders.Interval <= 0 {
+		problems = append(problems, "reminders.interval: must be positive")
+	}
+	if webhook := c.Reminders.WebhookURL; webhook != "" {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("reminders.webhook_url: invalid URL '%s', expected an http or https URL", webhook))
+		}
+	}
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level: %v", err))
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// redactedYAML renders the config with secrets replaced
+func (c *Config) redactedYAML() ([]byte, error) {
+	printed := *c
+	if printed.Admin.Token != "" {
+		printed.Admin.Token = redacted
+	}
+	return yaml.Marshal(&printed)
+}
+
+// maxBytesMiddleware caps the size of every request body
+func maxBytesMiddleware(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// env returns a getenv func reading from vars
+func env(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "notebook-config")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		cfg, printConfig, err := loadConfig(nil, env(nil))
+
+		assert.NoError(t, err)
+		assert.False(t, printConfig)
+		assert.Equal(t, defaultConfig(), cfg)
+	})
+	t.Run("Precedence", func(t *testing.T) {
+		path := writeConfigFile(t, `
+api:
+  addr: 127.0.0.1:7000
+  read_timeout: 5s
+  write_timeout: 6s
+admin:
+  token: file-token
+log:
+  level: warn
+`)
+		cfg, _, err := loadConfig(
+			[]string{"-config", path, "-write-timeout", "9s", "-pprof"},
+			env(map[string]string{"NTBK_READ_TIMEOUT": "7s", "NTBK_WRITE_TIMEOUT": "8s", "NTBK_ADMIN_TOKEN": "env-token"}),
+		)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "127.0.0.1:7000", cfg.API.Addr)
+		assert.Equal(t, 7*time.Second, cfg.API.ReadTimeout)
+		assert.Equal(t, 9*time.Second, cfg.API.WriteTimeout)
+		assert.Equal(t, 15*time.Second, cfg.API.GracefulTimeout)
+		assert.Equal(t, "env-token", cfg.Admin.Token)
+		assert.True(t, cfg.Admin.Pprof)
+		assert.Equal(t, "warn", cfg.Log.Level)
+	})
+	t.Run("ConfigFromEnv", func(t *testing.T) {
+		path := writeConfigFile(t, "log:\n  level: debug\n")
+		cfg, _, err := loadConfig(nil, env(map[string]string{"NTBK_CONFIG": path, "NTBK_PORT": "9001"}))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "debug", cfg.Log.Level)
+		assert.Equal(t, "0.0.0.0:9001", cfg.API.Addr)
+	})
+	t.Run("PrintConfig/Redacted", func(t *testing.T) {
+		cfg, printConfig, err := loadConfig([]string{"-print-config"}, env(map[string]string{"NTBK_ADMIN_TOKEN": "secret"}))
+		assert.NoError(t, err)
+		assert.True(t, printConfig)
+
+		out, err := cfg.redactedYAML()
+		assert.NoError(t, err)
+		assert.Contains(t, string(out), "token: "+redacted)
+		assert.NotContains(t, string(out), "secret")
+		assert.Equal(t, "secret", cfg.Admin.Token)
+	})
+	t.Run("UnknownField/Error", func(t *testing.T) {
+		path := writeConfigFile(t, "api:\n  port: 8080\n")
+		_, _, err := loadConfig([]string{"-config", path}, env(nil))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "port")
+	})
+	t.Run("InvalidFlag/Error", func(t *testing.T) {
+		_, _, err := loadConfig([]string{"-read-timeout", "soon"}, env(nil))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid -read-timeout")
+	})
+	t.Run("Validation/Error", func(t *testing.T) {
+		_, _, err := loadConfig(
+			[]string{"-addr", "nowhere", "-admin-addr", "", "-storage-backend", "disk"},
+			env(map[string]string{"NTBK_MAX_REQUEST_BYTES": "0", "NTBK_LOG_LEVEL": "loud"}),
+		)
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "api.addr")
+		assert.Contains(t, err.Error(), "storage.backend: unsupported backend 'disk'")
+		assert.Contains(t, err.Error(), "limits.max_request_bytes: must be positive")
+		assert.Contains(t, err.Error(), "log.level")
+		assert.NotContains(t, err.Error(), "admin.addr")
+	})
+	t.Run("Reminders/Error", func(t *testing.T) {
+		_, _, err := loadConfig(
+			[]string{"-reminder-interval", "0s", "-reminder-webhook-url", "ftp://example.com/hook"},
+			env(nil),
+		)
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "reminders.interval: must be positive")
+		assert.Contains(t, err.Error(), "reminders.webhook_url: invalid URL 'ftp://example.com/hook'")
+	})
+}
+
+func TestMaxBytesMiddleware(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Limits.MaxRequestBytes = 16
+	router := newRouter(NewNotebookRepo(nil), newHealth(), cfg)
+
+	req := httptest.NewRequest("POST", "/notebook", bytes.NewBufferString(`{"name": "a_rather_long_notebook_name"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 413, w.Result().StatusCode)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// enexTimeLayout is the layout of the created and updated dates of an
+// Evernote export
+const enexTimeLayout = "20060102T150405Z"
+
+// enexNote is a single <note> element of an Evernote export
+type enexNote struct {
+	Title   string   `xml:"title"`
+	Content string   `xml:"content"`
+	Created string   `xml:"created"`
+	Updated string   `xml:"updated"`
+	Tags    []string `xml:"tag"`
+}
+
+// enexImporter reads the <note> elements of an Evernote ENEX export,
+// converting their ENML content to markdown
+type enexImporter struct{}
+
+// Import decodes one <note> element at a time so that only a single note
+// is ever held in memory
+func (enexImporter) Import(r io.Reader, emit func(item *importItem)) error {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "note" {
+			continue
+		}
+
+		note := enexNote{}
+		if err := decoder.DecodeElement(&note, &start); err != nil {
+			return err
+		}
+		emit(note.importItem())
+	}
+}
+
+// importItem converts an enexNote to the CreateNoteRequest it is stored as
+func (e enexNote) importItem() *importItem {
+	item := &importItem{ref: e.Title}
+	body, err := enmlToMarkdown(e.Content)
+	if err != nil {
+		item.err = fmt.Errorf("invalid note content: %v", err)
+		return item
+	}
+	if item.created, err = parseEnexTime(e.Created); err != nil {
+		item.err = err
+		return item
+	}
+	if item.updated, err = parseEnexTime(e.Updated); err != nil {
+		item.err = err
+		return item
+	}
+	item.request = &CreateNoteRequest{
+		Title: strings.TrimSpace(e.Title),
+		Body:  body,
+		Tags:  e.Tags,
+	}
+	return item
+}
+
+// parseEnexTime returns a nil timestamp for missing dates
+func parseEnexTime(value string) (*timestamp.Timestamp, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(enexTimeLayout, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date '%s': %v", value, err)
+	}
+	return ptypes.TimestampProto(t)
+}
+
+// enmlList tracks the numbering of an open <ul> or <ol> element
+type enmlList struct {
+	ordered bool
+	count   int
+}
+
+// enmlConverter renders ENML, Evernote's restricted XHTML, as markdown
+type enmlConverter struct {
+	out strings.Builder
+	// spaces counts the trailing spaces held back from out until something
+	// follows them, so that ending a line drops them without copying out
+	spaces int
+	lists  []*enmlList
+	links  []string
+	quotes int
+	pre    bool
+}
+
+// enmlToMarkdown converts the content of an Evernote note to markdown,
+// elements without a markdown equivalent only keep their text
+func enmlToMarkdown(enml string) (string, error) {
+	decoder := xml.NewDecoder(strings.NewReader(enml))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	c := &enmlConverter{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			c.start(t)
+		case xml.EndElement:
+			c.end(t)
+		case xml.CharData:
+			c.text(string(t))
+		}
+	}
+	return c.String(), nil
+}
+
+// put appends s to the output, holding back its trailing spaces
+func (c *enmlConverter) put(s string) {
+	trimmed := strings.TrimRight(s, " ")
+	if trimmed == "" {
+		c.spaces += len(s)
+		return
+	}
+	c.out.WriteString(strings.Repeat(" ", c.spaces))
+	c.out.WriteString(trimmed)
+	c.spaces = len(s) - len(trimmed)
+}
+
+// atLineStart reports whether the next write begins a new line
+func (c *enmlConverter) atLineStart() bool {
+	s := c.out.String()
+	return c.spaces == 0 && (s == "" || strings.HasSuffix(s, "\n"))
+}
+
+// write appends s, prefixing new lines inside a <blockquote>
+func (c *enmlConverter) write(s string) {
+	if c.quotes > 0 && c.atLineStart() {
+		c.put(strings.Repeat("> ", c.quotes))
+	}
+	c.put(s)
+}
+
+// newline ends the current line if anything was written on it, dropping
+// trailing spaces left by collapsed whitespace
+func (c *enmlConverter) newline() {
+	if c.atLineStart() {
+		return
+	}
+	c.spaces = 0
+	c.put("\n")
+}
+
+// blankLine separates block elements by an empty line
+func (c *enmlConverter) blankLine() {
+	c.newline()
+	s := c.out.String()
+	if s != "" && !strings.HasSuffix(s, "\n\n") {
+		c.put("\n")
+	}
+}
+
+func (c *enmlConverter) start(e xml.StartElement) {
+	switch e.Name.Local {
+	case "div", "tr":
+		c.newline()
+	case "p":
+		c.blankLine()
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		c.blankLine()
+		c.write(strings.Repeat("#", int(e.Name.Local[1]-'0')) + " ")
+	case "br":
+		c.put("\n")
+	case "b", "strong":
+		c.write("**")
+	case "i", "em":
+		c.write("_")
+	case "s", "strike", "del":
+		c.write("~~")
+	case "code":
+		if !c.pre {
+			c.write("`")
+		}
+	case "pre":
+		c.blankLine()
+		c.write("```\n")
+		c.pre = true
+	case "a":
+		c.links = append(c.links, attr(e, "href"))
+		c.write("[")
+	case "img":
+		c.write(fmt.Sprintf("![%s](%s)", attr(e, "alt"), attr(e, "src")))
+	case "ul", "ol":
+		c.newline()
+		c.lists = append(c.lists, &enmlList{ordered: e.Name.Local == "ol"})
+	case "li":
+		c.newline()
+		if len(c.lists) == 0 {
+			c.write("- ")
+			break
+		}
+		list := c.lists[len(c.lists)-1]
+		list.count++
+		c.write(strings.Repeat("  ", len(c.lists)-1))
+		if list.ordered {
+			c.write(fmt.Sprintf("%d. ", list.count))
+		} else {
+			c.write("- ")
+		}
+	case "en-todo":
+		if c.atLineStart() {
+			c.write("- ")
+		}
+		if attr(e, "checked") == "true" {
+			c.write("[x] ")
+		} else {
+			c.write("[ ] ")
+		}
+	case "hr":
+		c.blankLine()
+		c.write("---")
+		c.blankLine()
+	case "blockquote":
+		c.blankLine()
+		c.quotes++
+	case "td", "th":
+		if !c.atLineStart() {
+			c.write(" | ")
+		}
+	}
+}
+
+func (c *enmlConverter) end(e xml.EndElement) {
+	switch e.Name.Local {
+	case "div", "li", "tr":
+		c.newline()
+	case "p", "h1", "h2", "h3", "h4", "h5", "h6":
+		c.blankLine()
+	case "b", "strong":
+		c.write("**")
+	case "i", "em":
+		c.write("_")
+	case "s", "strike", "del":
+		c.write("~~")
+	case "code":
+		if !c.pre {
+			c.write("`")
+		}
+	case "pre":
+		c.pre = false
+		c.newline()
+		c.write("```")
+		c.blankLine()
+	case "a":
+		href := ""
+		if len(c.links) != 0 {
+			href = c.links[len(c.links)-1]
+			c.links = c.links[:len(c.links)-1]
+		}
+		c.write("](" + href + ")")
+	case "ul", "ol":
+		if len(c.lists) != 0 {
+			c.lists = c.lists[:len(c.lists)-1]
+		}
+		if len(c.lists) == 0 {
+			c.blankLine()
+		}
+	case "blockquote":
+		if c.quotes > 0 {
+			c.quotes--
+		}
+		c.blankLine()
+	}
+}
+
+// text writes character data, collapsing whitespace outside of <pre>
+func (c *enmlConverter) text(s string) {
+	if c.pre {
+		c.put(s)
+		return
+	}
+	words := strings.Join(strings.Fields(s), " ")
+	if words == "" || unicode.IsSpace(rune(s[0])) {
+		if !c.atLineStart() && c.spaces == 0 {
+			c.write(" ")
+		}
+	}
+	if words == "" {
+		return
+	}
+	c.write(words)
+	if unicode.IsSpace(rune(s[len(s)-1])) {
+		c.write(" ")
+	}
+}
+
+// String returns the converted markdown without surrounding whitespace
+func (c *enmlConverter) String() string {
+	return strings.TrimSpace(c.out.String())
+}
+
+// attr returns the value of an attribute of e, or an empty string
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
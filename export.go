@@ -0,0 +1,610 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+const frontMatterDelimiter = "---"
+
+// conflictPolicy decides what an import does with a markdown file holding
+// the ID of a note already present in the notebook
+type conflictPolicy string
+
+const (
+	// conflictSkip leaves the existing note untouched
+	conflictSkip conflictPolicy = "skip"
+	// conflictOverwrite replaces the existing note with the imported one
+	conflictOverwrite conflictPolicy = "overwrite"
+	// conflictDuplicate stores the imported note under a fresh ID
+	conflictDuplicate conflictPolicy = "duplicate"
+)
+
+// parseConflictPolicy defaults to conflictSkip when no policy is provided
+func parseConflictPolicy(policy string) (conflictPolicy, error) {
+	switch conflictPolicy(policy) {
+	case "":
+		return conflictSkip, nil
+	case conflictSkip, conflictOverwrite, conflictDuplicate:
+		return conflictPolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown conflict policy '%s', expected one of %s, %s or %s",
+		policy, conflictSkip, conflictOverwrite, conflictDuplicate)
+}
+
+// import actions reported in an ImportNoteResult
+const (
+	importCreated    = "created"
+	importUpdated    = "updated"
+	importSkipped    = "skipped"
+	importDuplicated = "duplicated"
+	importFailed     = "failed"
+)
+
+// noteFrontMatter is the YAML header written above the body of every
+// exported markdown file
+type noteFrontMatter struct {
+	ID           string     `yaml:"id,omitempty"`
+	Title        string     `yaml:"title,omitempty"`
+	Tags         []string   `yaml:"tags,omitempty"`
+	Created      *time.Time `yaml:"created,omitempty"`
+	LastModified *time.Time `yaml:"last_modified,omitempty"`
+
+	Properties map[string]frontMatterProperty `yaml:"properties,omitempty"`
+
+	RemindAt   *time.Time `yaml:"remind_at,omitempty"`
+	Recurrence string     `yaml:"recurrence,omitempty"`
+	RemindedAt *time.Time `yaml:"reminded_at,omitempty"`
+
+	Pinned   *bool `yaml:"pinned,omitempty"`
+	Archived *bool `yaml:"archived,omitempty"`
+}
+
+// frontMatterProperty writes a PropertyValue as a plain YAML scalar, the
+// kind of the value is read back from the tag of the scalar
+type frontMatterProperty struct {
+	value *PropertyValue
+}
+
+func (p frontMatterProperty) MarshalYAML() (interface{}, error) {
+	switch kind := p.value.GetKind().(type) {
+	case *PropertyValue_StringValue:
+		return kind.StringValue, nil
+	case *PropertyValue_NumberValue:
+		return kind.NumberValue, nil
+	case *PropertyValue_BoolValue:
+		return kind.BoolValue, nil
+	case *PropertyValue_TimeValue:
+		return ptypes.Timestamp(kind.TimeValue)
+	}
+	return nil, fmt.Errorf("property has no value")
+}
+
+func (p *frontMatterProperty) UnmarshalYAML(node *yaml.Node) error {
+	p.value = &PropertyValue{}
+	switch node.ShortTag() {
+	case "!!str":
+		p.value.Kind = &PropertyValue_StringValue{StringValue: node.Value}
+	case "!!int", "!!float":
+		var number float64
+		if err := node.Decode(&number); err != nil {
+			return err
+		}
+		p.value.Kind = &PropertyValue_NumberValue{NumberValue: number}
+	case "!!bool":
+		var b bool
+		if err := node.Decode(&b); err != nil {
+			return err
+		}
+		p.value.Kind = &PropertyValue_BoolValue{BoolValue: b}
+	case "!!timestamp":
+		var t time.Time
+		if err := node.Decode(&t); err != nil {
+			return err
+		}
+		ts, err := ptypes.TimestampProto(t)
+		if err != nil {
+			return err
+		}
+		p.value.Kind = &PropertyValue_TimeValue{TimeValue: ts}
+	default:
+		return fmt.Errorf("line %d: a property must be a string, number, bool or time", node.Line)
+	}
+	return nil
+}
+
+// marshalMarkdown renders a note as a markdown document with YAML front matter
+func marshalMarkdown(note *Note) ([]byte, error) {
+	meta := noteFrontMatter{
+		ID:    note.Id,
+		Title: note.Title,
+		Tags:  note.Tags,
+	}
+	if note.Created != nil {
+		created, err := ptypes.Timestamp(note.Created)
+		if err != nil {
+			return nil, err
+		}
+		meta.Created = &created
+	}
+	if note.LastModified != nil {
+		lastModified, err := ptypes.Timestamp(note.LastModified)
+		if err != nil {
+			return nil, err
+		}
+		meta.LastModified = &lastModified
+	}
+	if len(note.Properties) != 0 {
+		meta.Properties = make(map[string]frontMatterProperty, len(note.Properties))
+		for name, value := range note.Properties {
+			meta.Properties[name] = frontMatterProperty{value}
+		}
+	}
+	meta.Recurrence = note.Recurrence
+	if note.RemindAt != nil {
+		remindAt, err := ptypes.Timestamp(note.RemindAt)
+		if err != nil {
+			return nil, err
+		}
+		meta.RemindAt = &remindAt
+	}
+	if note.RemindedAt != nil {
+		remindedAt, err := ptypes.Timestamp(note.RemindedAt)
+		if err != nil {
+			return nil, err
+		}
+		meta.RemindedAt = &remindedAt
+	}
+	if note.Pinned {
+		meta.Pinned = &note.Pinned
+	}
+	if note.Archived {
+		meta.Archived = &note.Archived
+	}
+
+	header, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(frontMatterDelimiter + "\n")
+	buf.Write(header)
+	buf.WriteString(frontMatterDelimiter + "\n")
+	buf.WriteString(note.Body)
+	return buf.Bytes(), nil
+}
+
+// unmarshalMarkdown parses a markdown document written by marshalMarkdown,
+// documents without front matter are treated as a bare body
+func unmarshalMarkdown(data []byte) (*Note, error) {
+	note, _, err := parseMarkdown(data)
+	return note, err
+}
+
+// parseMarkdown is unmarshalMarkdown also returning the front matter, so
+// that callers can tell the fields it holds from those left empty
+func parseMarkdown(data []byte) (*Note, noteFrontMatter, error) {
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	note := &Note{}
+	meta := noteFrontMatter{}
+
+	if !strings.HasPrefix(text, frontMatterDelimiter+"\n") {
+		note.Body = text
+		return note, meta, nil
+	}
+	rest := text[len(frontMatterDelimiter)+1:]
+	end := strings.Index(rest, "\n"+frontMatterDelimiter+"\n")
+	if end == -1 {
+		if !strings.HasSuffix(rest, "\n"+frontMatterDelimiter) {
+			return nil, meta, fmt.Errorf("front matter is not terminated by '%s'", frontMatterDelimiter)
+		}
+		end = len(rest) - len(frontMatterDelimiter) - 1
+	}
+
+	if err := yaml.Unmarshal([]byte(rest[:end]), &meta); err != nil {
+		return nil, meta, fmt.Errorf("invalid front matter: %v", err)
+	}
+	note.Id = meta.ID
+	note.Title = meta.Title
+	note.Tags = meta.Tags
+	if meta.Created != nil {
+		created, err := ptypes.TimestampProto(*meta.Created)
+		if err != nil {
+			return nil, meta, err
+		}
+		note.Created = created
+	}
+	if meta.LastModified != nil {
+		lastModified, err := ptypes.TimestampProto(*meta.LastModified)
+		if err != nil {
+			return nil, meta, err
+		}
+		note.LastModified = lastModified
+	}
+	if meta.Properties != nil {
+		note.Properties = make(map[string]*PropertyValue, len(meta.Properties))
+		for name, property := range meta.Properties {
+			note.Properties[name] = property.value
+		}
+	}
+	note.Recurrence = meta.Recurrence
+	if meta.RemindAt != nil {
+		remindAt, err := ptypes.TimestampProto(*meta.RemindAt)
+		if err != nil {
+			return nil, meta, err
+		}
+		note.RemindAt = remindAt
+	}
+	if meta.RemindedAt != nil {
+		remindedAt, err := ptypes.TimestampProto(*meta.RemindedAt)
+		if err != nil {
+			return nil, meta, err
+		}
+		note.RemindedAt = remindedAt
+	}
+	note.Pinned = meta.Pinned != nil && *meta.Pinned
+	note.Archived = meta.Archived != nil && *meta.Archived
+
+	bodyStart := end + len(frontMatterDelimiter) + 2
+	if bodyStart < len(rest) {
+		note.Body = rest[bodyStart:]
+	}
+	return note, meta, nil
+}
+
+// markdownFileName derives a file name from a note title, falling back to
+// the note ID for titles holding nothing printable
+func markdownFileName(note *Note, taken map[string]bool) string {
+	slug := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		case r == ' ':
+			return '-'
+		}
+		return -1
+	}, note.Title)
+	if slug == "" {
+		slug = note.Id
+	}
+
+	name := slug + ".md"
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s-%d.md", slug, i)
+	}
+	taken[name] = true
+	return name
+}
+
+// ExportNotebook takes a request body attempting to deserialise it to a
+// ExportNotebookRequest object, responding with a zip archive holding one
+// markdown file per note
+func (n *NotebookRepo) ExportNotebook(w http.ResponseWriter, r *http.Request) {
+	body := &ExportNotebookRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, ok := n.notebooks[body.GetName()]
+	if !ok {
+		errMsg := fmt.Sprintf("Notebook with name '%s' does not exist", body.GetName())
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	// sort by creation so that exports of an unchanged notebook are identical
+	notes := make([]*Note, 0, len(notebook.notes))
+	for _, note := range notebook.notes {
+		notes = append(notes, note)
+	}
+	sort.Slice(notes, func(i, j int) bool {
+		ci, cj := notes[i].GetCreated(), notes[j].GetCreated()
+		if ci.GetSeconds() != cj.GetSeconds() {
+			return ci.GetSeconds() < cj.GetSeconds()
+		}
+		if ci.GetNanos() != cj.GetNanos() {
+			return ci.GetNanos() < cj.GetNanos()
+		}
+		return notes[i].Id < notes[j].Id
+	})
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	taken := make(map[string]bool)
+	for _, note := range notes {
+		data, err := marshalMarkdown(note)
+		if err != nil {
+			n.log(r).Error("Unable to export note", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f, err := archive.Create(markdownFileName(note, taken))
+		if err != nil {
+			n.log(r).Error("Unable to create archive entry", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.Write(data)
+	}
+	if err := archive.Close(); err != nil {
+		n.log(r).Error("Unable to close archive", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", body.GetName()+".zip"))
+	w.Write(buf.Bytes())
+}
+
+// ImportNotebook takes a zip archive of markdown files laid out as written by
+// ExportNotebook, creating or updating a note per file. The notebook name,
+// conflict policy and dry run mode are read from the query string
+func (n *NotebookRepo) ImportNotebook(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	if !n.validRequest(w, r, &CreateNotebookRequest{Name: name}) {
+		return
+	}
+	policy, err := parseConflictPolicy(query.Get("conflict"))
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun := query.Get("dry_run") == "true"
+
+	data, ok := n.readBody(w, r)
+	if !ok {
+		return
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		n.log(r).Error("Unable to open archive", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the archive is decompressed before taking the lock, the declared
+	// sizes of its entries are not trusted
+	files, err := readMarkdownFiles(archive)
+	if err == errImportTooLarge {
+		errMsg := fmt.Sprintf("Archive must decompress to at most %d bytes", maxImportBytes)
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, ok := n.notebooks[name]
+	if !ok {
+		notebook = makeNotebook(name, n.global)
+		if !dryRun {
+			n.notebooks[name] = notebook
+		}
+	}
+
+	result := &ImportNotebookResponse{
+		Name:     name,
+		Conflict: string(policy),
+		DryRun:   dryRun,
+	}
+	imp := &markdownImport{
+		nb:     notebook,
+		name:   name,
+		policy: policy,
+		quota:  n.quota,
+		dryRun: dryRun,
+		usage:  notebook.usage(),
+		staged: make(map[string]*Note),
+	}
+	for _, f := range files {
+		result.Results = append(result.Results, imp.apply(f))
+	}
+	if !dryRun {
+		notebook.rebuildTags()
+	}
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// limits on the decompressed size of an imported archive, a file may hold
+// a note body of up to 1MiB as well as its front matter
+const (
+	maxImportFileBytes = 2 << 20
+	maxImportBytes     = 64 << 20
+)
+
+var errImportTooLarge = errors.New("archive is too large")
+
+// markdownFile is a markdown file read from an imported archive, err is
+// set when the file could not be read
+type markdownFile struct {
+	name string
+	data []byte
+	err  error
+}
+
+// readMarkdownFiles reads every markdown file of archive, returning
+// errImportTooLarge once more than maxImportBytes have been decompressed.
+// A file larger than maxImportFileBytes is reported as failed on its own
+func readMarkdownFiles(archive *zip.Reader) ([]markdownFile, error) {
+	var files []markdownFile
+	var total int64
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() || path.Ext(f.Name) != ".md" {
+			continue
+		}
+		file := markdownFile{name: f.Name}
+		rc, err := f.Open()
+		if err != nil {
+			file.err = err
+			files = append(files, file)
+			continue
+		}
+		file.data, file.err = ioutil.ReadAll(io.LimitReader(rc, maxImportFileBytes+1))
+		rc.Close()
+
+		total += int64(len(file.data))
+		if total > maxImportBytes {
+			return nil, errImportTooLarge
+		}
+		if len(file.data) > maxImportFileBytes {
+			file.data = nil
+			file.err = fmt.Errorf("file must decompress to at most %d bytes", maxImportFileBytes)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// markdownImport applies the files of an archive to a notebook one at a
+// time. Usage and the notes already imported are tracked as it goes so a
+// dry run is checked as if every earlier file had been stored
+type markdownImport struct {
+	nb     Notebook
+	name   string
+	policy conflictPolicy
+	quota  QuotaConfig
+	dryRun bool
+	usage  notebookUsage
+	staged map[string]*Note
+}
+
+// lookup returns the note stored or already imported under id
+func (imp *markdownImport) lookup(id string) *Note {
+	if note, ok := imp.staged[id]; ok {
+		return note
+	}
+	return imp.nb.notes[id]
+}
+
+// apply imports a single markdown file, leaving the tags index to be
+// rebuilt once every file has been imported
+func (imp *markdownImport) apply(f markdownFile) *ImportNoteResult {
+	result := &ImportNoteResult{File: f.name}
+	fail := func(err error) *ImportNoteResult {
+		result.Action = importFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	if f.err != nil {
+		return fail(f.err)
+	}
+	note, meta, err := parseMarkdown(f.data)
+	if err != nil {
+		return fail(err)
+	}
+	if note.Title == "" {
+		note.Title = strings.TrimSuffix(path.Base(f.name), ".md")
+	}
+	if violations := validateMessage(&CreateNoteRequest{
+		NotebookName: imp.name,
+		Title:        note.Title,
+		Body:         note.Body,
+		Tags:         note.Tags,
+		Properties:   note.Properties,
+		Recurrence:   note.Recurrence,
+	}); len(violations) != 0 {
+		return fail(violationsError(violations))
+	}
+	if note.Id != "" {
+		if id, err := uuid.Parse(note.Id); err != nil || id.String() != note.Id {
+			return fail(fmt.Errorf("id '%s' is not a UUID", note.Id))
+		}
+	}
+	if note.Created == nil {
+		note.Created = ptypes.TimestampNow()
+	}
+
+	result.Action = importCreated
+	var existing *Note
+	if note.Id == "" {
+		note.Id = uuid.New().String()
+	} else if existing = imp.lookup(note.Id); existing != nil {
+		switch imp.policy {
+		case conflictSkip:
+			result.Id = note.Id
+			result.Action = importSkipped
+			return result
+		case conflictOverwrite:
+			result.Action = importUpdated
+			note = mergeMarkdown(existing, note, meta)
+		case conflictDuplicate:
+			result.Action = importDuplicated
+			note.Id = uuid.New().String()
+			existing = nil
+		}
+	}
+	result.Id = note.Id
+	if err := imp.nb.checkProperties(note.GetProperties()); err != nil {
+		return fail(err)
+	}
+	if err := checkReminder(note.GetRemindAt(), note.GetRecurrence()); err != nil {
+		return fail(err)
+	}
+	if err := imp.quota.checkUsage(imp.name, imp.usage, existing, note); err != nil {
+		return fail(err)
+	}
+
+	imp.usage = imp.usage.with(existing, note)
+	imp.staged[note.Id] = note
+	if !imp.dryRun {
+		imp.nb.putNote(note)
+	}
+	return result
+}
+
+// mergeMarkdown returns existing updated by a note imported over it. The
+// title, body and tags are replaced while the fields missing from the
+// front matter of the file are kept from existing
+func mergeMarkdown(existing, imported *Note, meta noteFrontMatter) *Note {
+	note := proto.Clone(existing).(*Note)
+	note.Title = imported.Title
+	note.Body = imported.Body
+	note.Tags = imported.Tags
+	note.LastModified = ptypes.TimestampNow()
+	if meta.Properties != nil {
+		note.Properties = imported.Properties
+	}
+	if meta.RemindAt != nil || meta.Recurrence != "" {
+		note.RemindAt = imported.RemindAt
+		note.Recurrence = imported.Recurrence
+		note.RemindedAt = imported.RemindedAt
+	}
+	if meta.Pinned != nil {
+		note.Pinned = imported.Pinned
+	}
+	if meta.Archived != nil {
+		note.Archived = imported.Archived
+	}
+	return note
+}
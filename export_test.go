@@ -0,0 +1,381 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+)
+
+const exportNoteID = "0b9d2c4e-6f1a-4c3e-9d8b-2a7f5e1c0d93"
+
+func newExportRepo() *NotebookRepo {
+	return newTestRepo("export_notebook", &Note{
+		Id:      exportNoteID,
+		Title:   "Title 1",
+		Body:    "body_1\n",
+		Tags:    []string{"tag_1", "tag_2"},
+		Created: ptypes.TimestampNow(),
+	})
+}
+
+func exportNotebook(t *testing.T, repo *NotebookRepo, name string) []byte {
+	req := httptest.NewRequest(
+		"GET",
+		"/notebook/export",
+		bytes.NewBufferString(`{"name": "`+name+`"}`),
+	)
+	w := httptest.NewRecorder()
+	repo.ExportNotebook(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return body
+}
+
+func importNotebook(t *testing.T, repo *NotebookRepo, query string, archive []byte) *ImportNotebookResponse {
+	req := httptest.NewRequest("POST", "/notebook/import?"+query, bytes.NewReader(archive))
+	w := httptest.NewRecorder()
+	repo.ImportNotebook(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	result := &ImportNotebookResponse{}
+	assert.NoError(t, json.Unmarshal(body, result))
+	return result
+}
+
+// markdownArchive zips files, keyed by name, in name order
+func markdownArchive(t *testing.T, files map[string]string) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := archive.Create(name)
+		assert.NoError(t, err)
+		f.Write([]byte(files[name]))
+	}
+	assert.NoError(t, archive.Close())
+	return buf.Bytes()
+}
+
+func TestMarkdownRoundTrip(t *testing.T) {
+	created := ptypes.TimestampNow()
+	note := &Note{
+		Id:      "id_1",
+		Title:   "title_1",
+		Body:    "# heading\n\n---\nbody_1",
+		Tags:    []string{"tag_1"},
+		Created: created,
+	}
+	data, err := marshalMarkdown(note)
+	assert.NoError(t, err)
+
+	parsed, err := unmarshalMarkdown(data)
+	assert.NoError(t, err)
+	assert.Equal(t, note.Id, parsed.Id)
+	assert.Equal(t, note.Title, parsed.Title)
+	assert.Equal(t, note.Body, parsed.Body)
+	assert.Equal(t, note.Tags, parsed.Tags)
+	assert.Equal(t, created.GetSeconds(), parsed.Created.GetSeconds())
+	assert.Nil(t, parsed.LastModified)
+}
+
+func TestMarkdownProperties(t *testing.T) {
+	due, _ := ptypes.TimestampProto(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	note := &Note{
+		Id:    exportNoteID,
+		Title: "title_1",
+		Body:  "body_1",
+		Properties: map[string]*PropertyValue{
+			"owner":    {Kind: &PropertyValue_StringValue{StringValue: "alice"}},
+			"code":     {Kind: &PropertyValue_StringValue{StringValue: "12"}},
+			"stamp":    {Kind: &PropertyValue_StringValue{StringValue: "2020-06-01T12:00:00Z"}},
+			"estimate": {Kind: &PropertyValue_NumberValue{NumberValue: 3}},
+			"ratio":    {Kind: &PropertyValue_NumberValue{NumberValue: 0.5}},
+			"done":     {Kind: &PropertyValue_BoolValue{BoolValue: true}},
+			"due":      {Kind: &PropertyValue_TimeValue{TimeValue: due}},
+		},
+	}
+	data, err := marshalMarkdown(note)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "owner: alice\n")
+
+	parsed, err := unmarshalMarkdown(data)
+	assert.NoError(t, err)
+	assert.Len(t, parsed.Properties, len(note.Properties))
+	for name, value := range note.Properties {
+		assert.True(t, proto.Equal(value, parsed.Properties[name]), name)
+	}
+
+	t.Run("Reminder", func(t *testing.T) {
+		remindAt, _ := ptypes.TimestampProto(time.Date(2020, 6, 2, 9, 0, 0, 0, time.UTC))
+		reminder := &Note{Id: exportNoteID, Title: "t", Body: "b", RemindAt: remindAt, Recurrence: "FREQ=DAILY", RemindedAt: due}
+		data, err := marshalMarkdown(reminder)
+		assert.NoError(t, err)
+
+		parsed, err := unmarshalMarkdown(data)
+		assert.NoError(t, err)
+		assert.True(t, proto.Equal(reminder, parsed))
+	})
+	t.Run("States", func(t *testing.T) {
+		pinned := &Note{Id: exportNoteID, Title: "t", Body: "b", Pinned: true}
+		data, err := marshalMarkdown(pinned)
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), "pinned: true\n")
+		assert.NotContains(t, string(data), "archived")
+
+		parsed, err := unmarshalMarkdown(data)
+		assert.NoError(t, err)
+		assert.True(t, proto.Equal(pinned, parsed))
+	})
+	t.Run("InvalidValue/Error", func(t *testing.T) {
+		_, err := unmarshalMarkdown([]byte("---\nproperties:\n    list: [1, 2]\n---\nbody"))
+		assert.Error(t, err)
+	})
+}
+
+func TestExportNotebook(t *testing.T) {
+	repo := newExportRepo()
+	t.Run("Success", func(t *testing.T) {
+		data := exportNotebook(t, repo, "export_notebook")
+
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		assert.NoError(t, err)
+		assert.Len(t, archive.File, 1)
+		assert.Equal(t, "title-1.md", archive.File[0].Name)
+	})
+	t.Run("MissingNotebook/Error", func(t *testing.T) {
+		req := httptest.NewRequest(
+			"GET",
+			"/notebook/export",
+			bytes.NewBufferString(`{"name": "missing_notebook"}`),
+		)
+		w := httptest.NewRecorder()
+		repo.ExportNotebook(w, req)
+
+		assert.Equal(t, 400, w.Result().StatusCode)
+	})
+}
+
+func TestImportNotebook(t *testing.T) {
+	t.Run("NewNotebook/Success", func(t *testing.T) {
+		repo := newExportRepo()
+		data := exportNotebook(t, repo, "export_notebook")
+
+		result := importNotebook(t, repo, "name=import_notebook", data)
+
+		assert.Len(t, result.Results, 1)
+		assert.Equal(t, importCreated, result.Results[0].Action)
+		notebook := repo.notebooks["import_notebook"]
+		assert.Equal(t, "Title 1", notebook.notes[exportNoteID].Title)
+		assert.Equal(t, []string{exportNoteID}, notebook.tags["tag_2"])
+	})
+	t.Run("Conflict/Skip", func(t *testing.T) {
+		repo := newExportRepo()
+		data := exportNotebook(t, repo, "export_notebook")
+		repo.notebooks["export_notebook"].notes[exportNoteID].Title = "changed"
+
+		result := importNotebook(t, repo, "name=export_notebook", data)
+
+		assert.Equal(t, importSkipped, result.Results[0].Action)
+		assert.Equal(t, "changed", repo.notebooks["export_notebook"].notes[exportNoteID].Title)
+	})
+	t.Run("Conflict/Overwrite", func(t *testing.T) {
+		repo := newExportRepo()
+		data := exportNotebook(t, repo, "export_notebook")
+		repo.notebooks["export_notebook"].notes[exportNoteID].Title = "changed"
+
+		result := importNotebook(t, repo, "name=export_notebook&conflict=overwrite", data)
+
+		assert.Equal(t, importUpdated, result.Results[0].Action)
+		note := repo.notebooks["export_notebook"].notes[exportNoteID]
+		assert.Equal(t, "Title 1", note.Title)
+		assert.NotNil(t, note.LastModified)
+	})
+	t.Run("Conflict/Overwrite/KeepsProperties", func(t *testing.T) {
+		repo := newExportRepo()
+		repo.notebooks["export_notebook"].notes[exportNoteID].Properties = map[string]*PropertyValue{
+			"owner": {Kind: &PropertyValue_StringValue{StringValue: "alice"}},
+		}
+		data := markdownArchive(t, map[string]string{"a.md": "---\nid: " + exportNoteID + "\ntitle: t\n---\nbody"})
+
+		result := importNotebook(t, repo, "name=export_notebook&conflict=overwrite", data)
+
+		assert.Equal(t, importUpdated, result.Results[0].Action)
+		note := repo.notebooks["export_notebook"].notes[exportNoteID]
+		assert.Equal(t, "body", note.Body)
+		assert.Equal(t, "alice", note.Properties["owner"].GetStringValue())
+	})
+	t.Run("Conflict/Overwrite/KeepsReminder", func(t *testing.T) {
+		repo := newExportRepo()
+		remindAt, _ := ptypes.TimestampProto(time.Date(2020, 6, 2, 9, 0, 0, 0, time.UTC))
+		repo.notebooks["export_notebook"].notes[exportNoteID].RemindAt = remindAt
+		data := markdownArchive(t, map[string]string{
+			"a.md": "---\nid: " + exportNoteID + "\ntitle: t\nrecurrence: FREQ=WEEKLY\n---\nbody",
+		})
+
+		result := importNotebook(t, repo, "name=export_notebook&conflict=overwrite", data)
+
+		assert.Equal(t, importFailed, result.Results[0].Action)
+		assert.Equal(t, "recurrence requires remind_at", result.Results[0].Error)
+
+		data = markdownArchive(t, map[string]string{"a.md": "---\nid: " + exportNoteID + "\ntitle: t\n---\nbody"})
+		result = importNotebook(t, repo, "name=export_notebook&conflict=overwrite", data)
+
+		assert.Equal(t, importUpdated, result.Results[0].Action)
+		assert.True(t, proto.Equal(remindAt, repo.notebooks["export_notebook"].notes[exportNoteID].RemindAt))
+	})
+	t.Run("Conflict/Overwrite/States", func(t *testing.T) {
+		repo := newExportRepo()
+		existing := repo.notebooks["export_notebook"].notes[exportNoteID]
+		existing.Pinned = true
+		existing.Archived = true
+		data := markdownArchive(t, map[string]string{
+			"a.md": "---\nid: " + exportNoteID + "\ntitle: t\narchived: false\n---\nbody",
+		})
+
+		result := importNotebook(t, repo, "name=export_notebook&conflict=overwrite", data)
+
+		assert.Equal(t, importUpdated, result.Results[0].Action)
+		note := repo.notebooks["export_notebook"].notes[exportNoteID]
+		assert.True(t, note.Pinned)
+		assert.False(t, note.Archived)
+	})
+	t.Run("Conflict/Duplicate", func(t *testing.T) {
+		repo := newExportRepo()
+		data := exportNotebook(t, repo, "export_notebook")
+
+		result := importNotebook(t, repo, "name=export_notebook&conflict=duplicate", data)
+
+		assert.Equal(t, importDuplicated, result.Results[0].Action)
+		assert.NotEqual(t, exportNoteID, result.Results[0].Id)
+		notebook := repo.notebooks["export_notebook"]
+		assert.Len(t, notebook.notes, 2)
+		assert.Len(t, notebook.tags["tag_1"], 2)
+	})
+	t.Run("DryRun", func(t *testing.T) {
+		repo := newExportRepo()
+		data := exportNotebook(t, repo, "export_notebook")
+
+		result := importNotebook(t, repo, "name=import_notebook&dry_run=true", data)
+
+		assert.True(t, result.DryRun)
+		assert.Equal(t, importCreated, result.Results[0].Action)
+		_, ok := repo.notebooks["import_notebook"]
+		assert.False(t, ok)
+	})
+	t.Run("DryRun/Quota", func(t *testing.T) {
+		repo := newExportRepo()
+		repo.quota = QuotaConfig{MaxNotes: 1}
+		data := markdownArchive(t, map[string]string{"a.md": "body_a", "b.md": "body_b"})
+
+		result := importNotebook(t, repo, "name=import_notebook&dry_run=true", data)
+
+		// the second file is refused as if the first had been stored
+		assert.Equal(t, importCreated, result.Results[0].Action)
+		assert.Equal(t, importFailed, result.Results[1].Action)
+		assert.Contains(t, result.Results[1].Error, "quota exceeded")
+	})
+	t.Run("DryRun/RepeatedId", func(t *testing.T) {
+		repo := newExportRepo()
+		note := "---\nid: " + exportNoteID + "\n---\nbody"
+		data := markdownArchive(t, map[string]string{"a.md": note, "b.md": note})
+
+		result := importNotebook(t, repo, "name=import_notebook&dry_run=true", data)
+
+		assert.Equal(t, importCreated, result.Results[0].Action)
+		assert.Equal(t, importSkipped, result.Results[1].Action)
+	})
+	t.Run("InvalidNote/Error", func(t *testing.T) {
+		repo := newExportRepo()
+		data := markdownArchive(t, map[string]string{
+			"empty.md":   "---\ntitle: empty\n---\n",
+			"bad_tag.md": "---\ntags:\n    - bad tag\n---\nbody",
+			"bad_id.md":  "---\nid: ../id_1\n---\nbody",
+		})
+
+		result := importNotebook(t, repo, "name=import_notebook", data)
+
+		assert.Len(t, result.Results, 3)
+		for _, item := range result.Results {
+			assert.Equal(t, importFailed, item.Action, item.File)
+		}
+		assert.Contains(t, result.Results[0].Error, "id '../id_1' is not a UUID")
+		assert.Contains(t, result.Results[1].Error, "tags[0] must match")
+		assert.Contains(t, result.Results[2].Error, "body must not be empty")
+		assert.Empty(t, repo.notebooks["import_notebook"].notes)
+	})
+	t.Run("PropertiesAndReminder/Error", func(t *testing.T) {
+		repo := newExportRepo()
+		repo.notebooks["export_notebook"].schema["owner"] = &PropertyDefinition{Name: "owner", Type: "string", Required: true}
+		data := markdownArchive(t, map[string]string{
+			"missing.md":  "body",
+			"number.md":   "---\nproperties:\n    owner: 3\n---\nbody",
+			"reminder.md": "---\nproperties:\n    owner: alice\nrecurrence: FREQ=MINUTELY\nremind_at: 2020-06-02T09:00:00Z\n---\nbody",
+			"valid.md":    "---\nproperties:\n    owner: alice\n---\nbody",
+		})
+
+		result := importNotebook(t, repo, "name=export_notebook", data)
+
+		assert.Equal(t, "Property 'owner' is required", result.Results[0].Error)
+		assert.Equal(t, "Property 'owner' must be a string", result.Results[1].Error)
+		assert.Contains(t, result.Results[2].Error, "unknown recurrence FREQ")
+		assert.Equal(t, importCreated, result.Results[3].Action)
+	})
+	t.Run("LargeFile/Error", func(t *testing.T) {
+		repo := newExportRepo()
+		data := markdownArchive(t, map[string]string{
+			"large.md": strings.Repeat("a", maxImportFileBytes+1),
+			"small.md": "body",
+		})
+
+		result := importNotebook(t, repo, "name=import_notebook", data)
+
+		assert.Equal(t, importFailed, result.Results[0].Action)
+		assert.Contains(t, result.Results[0].Error, "at most")
+		assert.Equal(t, importCreated, result.Results[1].Action)
+	})
+	t.Run("LargeArchive/Error", func(t *testing.T) {
+		repo := newExportRepo()
+		files := make(map[string]string)
+		for i := 0; i*maxImportFileBytes <= maxImportBytes; i++ {
+			files[fmt.Sprintf("%d.md", i)] = strings.Repeat("a", maxImportFileBytes)
+		}
+		req := httptest.NewRequest("POST", "/notebook/import?name=import_notebook", bytes.NewReader(markdownArchive(t, files)))
+		w := httptest.NewRecorder()
+		repo.ImportNotebook(w, req)
+
+		assert.Equal(t, 413, w.Result().StatusCode)
+		_, ok := repo.notebooks["import_notebook"]
+		assert.False(t, ok)
+	})
+	t.Run("UnknownConflictPolicy/Error", func(t *testing.T) {
+		repo := newExportRepo()
+		req := httptest.NewRequest("POST", "/notebook/import?name=n&conflict=merge", bytes.NewReader(nil))
+		w := httptest.NewRecorder()
+		repo.ImportNotebook(w, req)
+
+		assert.Equal(t, 400, w.Result().StatusCode)
+	})
+}
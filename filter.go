@@ -0,0 +1,241 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// sortedEntry is a note id indexed under a number or a string, entries
+// with equal values are ordered by id
+type sortedEntry struct {
+	num int64
+	str string
+	id  string
+}
+
+func (e sortedEntry) less(other sortedEntry) bool {
+	if e.num != other.num {
+		return e.num < other.num
+	}
+	if e.str != other.str {
+		return e.str < other.str
+	}
+	return e.id < other.id
+}
+
+// sortedIndex holds entries in ascending order so that ranges of values
+// are found by binary search
+type sortedIndex struct {
+	entries []sortedEntry
+}
+
+func (x *sortedIndex) insert(e sortedEntry) {
+	i := sort.Search(len(x.entries), func(i int) bool { return e.less(x.entries[i]) })
+	x.entries = append(x.entries, sortedEntry{})
+	copy(x.entries[i+1:], x.entries[i:])
+	x.entries[i] = e
+}
+
+func (x *sortedIndex) remove(e sortedEntry) {
+	i := sort.Search(len(x.entries), func(i int) bool { return !x.entries[i].less(e) })
+	if i < len(x.entries) && x.entries[i] == e {
+		x.entries = append(x.entries[:i], x.entries[i+1:]...)
+	}
+}
+
+// between returns the ids indexed under a number within [lo, hi)
+func (x *sortedIndex) between(lo, hi int64) []string {
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].num >= lo })
+	var ids []string
+	for ; i < len(x.entries) && x.entries[i].num < hi; i++ {
+		ids = append(ids, x.entries[i].id)
+	}
+	return ids
+}
+
+// prefixed returns the ids indexed under a string starting with prefix
+func (x *sortedIndex) prefixed(prefix string) []string {
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].str >= prefix })
+	var ids []string
+	for ; i < len(x.entries) && strings.HasPrefix(x.entries[i].str, prefix); i++ {
+		ids = append(ids, x.entries[i].id)
+	}
+	return ids
+}
+
+// noteIndexes are the secondary indexes of a notebook answering the range
+// filters of GetNotebookRequest
+type noteIndexes struct {
+	created  sortedIndex
+	modified sortedIndex
+	title    sortedIndex
+	bodyLen  sortedIndex
+	// indexed holds the entries each note was indexed with, notes may be
+	// modified in place after being stored
+	indexed map[string][4]sortedEntry
+}
+
+func newNoteIndexes() *noteIndexes {
+	return &noteIndexes{indexed: make(map[string][4]sortedEntry)}
+}
+
+// modifiedNanos returns when note was last modified, notes never modified
+// since their creation report their created time
+func modifiedNanos(note *Note) int64 {
+	if note.GetLastModified() == nil {
+		return timestampNanos(note.GetCreated())
+	}
+	return timestampNanos(note.GetLastModified())
+}
+
+func (x *noteIndexes) indexes() [4]*sortedIndex {
+	return [4]*sortedIndex{&x.created, &x.modified, &x.title, &x.bodyLen}
+}
+
+// put indexes note, replacing any previous version
+func (x *noteIndexes) put(note *Note) {
+	if x == nil {
+		return
+	}
+	x.remove(note.Id)
+	entries := [4]sortedEntry{
+		{num: timestampNanos(note.GetCreated()), id: note.Id},
+		{num: modifiedNanos(note), id: note.Id},
+		{str: note.GetTitle(), id: note.Id},
+		{num: int64(len(note.GetBody())), id: note.Id},
+	}
+	for i, index := range x.indexes() {
+		index.insert(entries[i])
+	}
+	x.indexed[note.Id] = entries
+}
+
+// remove drops the note with id from every index
+func (x *noteIndexes) remove(id string) {
+	if x == nil {
+		return
+	}
+	entries, ok := x.indexed[id]
+	if !ok {
+		return
+	}
+	for i, index := range x.indexes() {
+		index.remove(entries[i])
+	}
+	delete(x.indexed, id)
+}
+
+// timeRange returns the [after, before) range of a filter in nanoseconds,
+// open bounds being left unset
+func timeRange(after, before int64, hasAfter, hasBefore bool) (int64, int64) {
+	lo, hi := int64(math.MinInt64), int64(math.MaxInt64)
+	if hasAfter {
+		lo = after
+	}
+	if hasBefore {
+		hi = before
+	}
+	return lo, hi
+}
+
+// filterNotes returns the notes of the notebook matching every filter of
+// body and where, the filter parsed from body.where. Candidates are taken
+// from the most selective index and checked against the remaining filters,
+// title_contains being the only filter always checked note by note
+func (nb Notebook) filterNotes(body *GetNotebookRequest, where propertyFilter) []*Note {
+	createdLo, createdHi := timeRange(timestampNanos(body.GetCreatedAfter()), timestampNanos(body.GetCreatedBefore()),
+		body.GetCreatedAfter() != nil, body.GetCreatedBefore() != nil)
+	modifiedLo, modifiedHi := timeRange(timestampNanos(body.GetModifiedAfter()), timestampNanos(body.GetModifiedBefore()),
+		body.GetModifiedAfter() != nil, body.GetModifiedBefore() != nil)
+
+	var candidates []string
+	narrowed := false
+	narrow := func(ids []string) {
+		if !narrowed || len(ids) < len(candidates) {
+			candidates = ids
+			narrowed = true
+		}
+	}
+
+	tagged := make(map[string]bool)
+	if len(body.GetTags()) != 0 {
+		ids := make(map[string]bool)
+		for _, tag := range nb.expandTags(body.GetTags()) {
+			tagged[tag] = true
+			for _, id := range nb.tags[tag] {
+				ids[id] = true
+			}
+		}
+		list := make([]string, 0, len(ids))
+		for id := range ids {
+			list = append(list, id)
+		}
+		narrow(list)
+	}
+	var matched map[string]bool
+	if where != nil {
+		matched = where.match(nb, nb.propertyIndex())
+		list := make([]string, 0, len(matched))
+		for id := range matched {
+			list = append(list, id)
+		}
+		narrow(list)
+	}
+	if nb.sorted != nil {
+		if body.GetCreatedAfter() != nil || body.GetCreatedBefore() != nil {
+			narrow(nb.sorted.created.between(createdLo, createdHi))
+		}
+		if body.GetModifiedAfter() != nil || body.GetModifiedBefore() != nil {
+			narrow(nb.sorted.modified.between(modifiedLo, modifiedHi))
+		}
+		if body.GetTitlePrefix() != "" {
+			narrow(nb.sorted.title.prefixed(body.GetTitlePrefix()))
+		}
+		if body.GetBodyLongerThan() > 0 {
+			narrow(nb.sorted.bodyLen.between(body.GetBodyLongerThan()+1, math.MaxInt64))
+		}
+	}
+	if !narrowed {
+		for id := range nb.notes {
+			candidates = append(candidates, id)
+		}
+	}
+
+	var notes []*Note
+	for _, id := range candidates {
+		note, ok := nb.notes[id]
+		if !ok {
+			continue
+		}
+		if len(tagged) != 0 && !holdsAnyTag(note, tagged) {
+			continue
+		}
+		if where != nil && !matched[id] {
+			continue
+		}
+		if created := timestampNanos(note.GetCreated()); created < createdLo || created >= createdHi {
+			continue
+		}
+		if modified := modifiedNanos(note); modified < modifiedLo || modified >= modifiedHi {
+			continue
+		}
+		if !strings.HasPrefix(note.GetTitle(), body.GetTitlePrefix()) ||
+			!strings.Contains(note.GetTitle(), body.GetTitleContains()) ||
+			int64(len(note.GetBody())) <= body.GetBodyLongerThan() {
+			continue
+		}
+		notes = append(notes, note)
+	}
+	return notes
+}
+
+// holdsAnyTag reports whether note holds one of tags
+func holdsAnyTag(note *Note, tags map[string]bool) bool {
+	for _, tag := range note.GetTags() {
+		if tags[tag] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFilterRepo holds the notes id_0 to id_3 created a day apart, id_1 was
+// modified on the fifth day
+func newFilterRepo(start time.Time) *NotebookRepo {
+	var notes []*Note
+	day := func(i int) *Note {
+		created, _ := ptypes.TimestampProto(start.Add(time.Duration(i) * 24 * time.Hour))
+		return &Note{Created: created}
+	}
+	titles := []string{"Meeting notes", "Meeting agenda", "Recipe", "Design review"}
+	tags := [][]string{{"work"}, {"work/meetings"}, {"home"}, {"work"}}
+	for i, title := range titles {
+		note := day(i)
+		note.Id = "id_" + string(rune('0'+i))
+		note.Title = title
+		note.Body = strings.Repeat("b", 10*(i+1))
+		note.Tags = tags[i]
+		if i == 1 {
+			note.LastModified = day(5).Created
+		}
+		notes = append(notes, note)
+	}
+	return newTestRepo("filter_notebook", notes...)
+}
+
+func TestGetNotebookFilters(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	filter := func(repo *NotebookRepo, filters string) []string {
+		w := httptest.NewRecorder()
+		router := newRouter(repo, newHealth(), defaultConfig())
+		body := `{"name": "filter_notebook"` + filters + `}`
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/notebook", bytes.NewBufferString(body)))
+		assert.Equal(t, 200, w.Code)
+		result := &GetNotebookResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		var ids []string
+		for _, note := range result.Notes {
+			ids = append(ids, note.Id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	tests := []struct {
+		name    string
+		filters string
+		want    []string
+	}{
+		{"None", ``, []string{"id_0", "id_1", "id_2", "id_3"}},
+		{"CreatedAfter", `, "created_after": "2020-01-02T00:00:00Z"`, []string{"id_1", "id_2", "id_3"}},
+		{"CreatedRange", `, "created_after": "2020-01-02T00:00:00Z", "created_before": "2020-01-04T00:00:00Z"`, []string{"id_1", "id_2"}},
+		{"ModifiedAfter", `, "modified_after": "2020-01-04T00:00:00Z"`, []string{"id_1", "id_3"}},
+		{"ModifiedBefore", `, "modified_before": "2020-01-04T00:00:00Z"`, []string{"id_0", "id_2"}},
+		{"TitlePrefix", `, "title_prefix": "Meeting"`, []string{"id_0", "id_1"}},
+		{"TitleContains", `, "title_contains": "view"`, []string{"id_3"}},
+		{"BodyLongerThan", `, "body_longer_than": 20`, []string{"id_2", "id_3"}},
+		{"Combined/Tags", `, "tags": ["work"], "body_longer_than": 10, "created_before": "2020-01-04T00:00:00Z"`, []string{"id_1"}},
+		{"Combined/NoMatch", `, "title_prefix": "Recipe", "tags": ["work"]`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, filter(newFilterRepo(start), tt.filters))
+		})
+	}
+
+	t.Run("UpdatedNote/Reindexed", func(t *testing.T) {
+		repo := newFilterRepo(start)
+		w := httptest.NewRecorder()
+		newRouter(repo, newHealth(), defaultConfig()).ServeHTTP(w, httptest.NewRequest("UPDATE", "/note",
+			bytes.NewBufferString(`{"notebook_name": "filter_notebook", "id": "id_2", "title": "Meeting minutes", "body": "b", "tags": ["home"]}`)))
+		assert.Equal(t, 200, w.Code)
+
+		assert.Equal(t, []string{"id_0", "id_1", "id_2"}, filter(repo, `, "title_prefix": "Meeting"`))
+		assert.Equal(t, []string{"id_3"}, filter(repo, `, "body_longer_than": 20`))
+	})
+}
+
+func TestSortedIndex(t *testing.T) {
+	x := &sortedIndex{}
+	for _, e := range []sortedEntry{{num: 3, id: "c"}, {num: 1, id: "a"}, {num: 2, id: "b"}, {num: 2, id: "a"}} {
+		x.insert(e)
+	}
+
+	assert.Equal(t, []string{"a", "b"}, x.between(2, 3))
+	x.remove(sortedEntry{num: 2, id: "a"})
+	x.remove(sortedEntry{num: 7, id: "z"})
+	assert.Equal(t, []string{"a", "b", "c"}, x.between(0, 10))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// graph export formats accepted by ExportGraphRequest.format
+const (
+	graphJSON = "json"
+	graphDOT  = "dot"
+)
+
+// graph edge kinds reported in GraphEdge.kind
+const (
+	edgeLink = "link"
+	edgeTag  = "tag"
+)
+
+// graph node kinds reported in GraphNode.kind
+const (
+	nodeNote = "note"
+	nodeTag  = "tag"
+)
+
+// tagNodeID identifies the node of a tag, note ids never hold a colon
+func tagNodeID(tag string) string {
+	return "tag:" + tag
+}
+
+// components returns the notes of each connected component of nodes, edges
+// being followed in both directions, largest first
+func components(nodes []*GraphNode, edges []*GraphEdge) [][]string {
+	parent := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		parent[node.Id] = node.Id
+	}
+	var find func(id string) string
+	find = func(id string) string {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+		return parent[id]
+	}
+	for _, edge := range edges {
+		parent[find(edge.Source)] = find(edge.Target)
+	}
+
+	groups := make(map[string][]string)
+	for _, node := range nodes {
+		if node.Kind != nodeNote {
+			continue
+		}
+		root := find(node.Id)
+		groups[root] = append(groups[root], node.Id)
+	}
+	result := make([][]string, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if len(result[i]) != len(result[j]) {
+			return len(result[i]) > len(result[j])
+		}
+		return result[i][0] < result[j][0]
+	})
+	return result
+}
+
+// graph returns the notes of the notebook holding one of tags, or every
+// note when tags is empty, as a NotebookGraph named name
+func (nb Notebook) graph(name string, tags []string) *NotebookGraph {
+	filter := make(map[string]bool)
+	for _, tag := range nb.expandTags(tags) {
+		filter[tag] = true
+	}
+	included := make(map[string]bool)
+	result := &NotebookGraph{Name: name}
+	for id, note := range nb.notes {
+		if len(filter) == 0 || holdsAnyTag(note, filter) {
+			included[id] = true
+			result.Nodes = append(result.Nodes, &GraphNode{Id: id, Title: note.Title, Tags: note.Tags, Kind: nodeNote})
+		}
+	}
+	sort.Slice(result.Nodes, func(i, j int) bool { return result.Nodes[i].Id < result.Nodes[j].Id })
+	notes := len(result.Nodes)
+
+	links := nb.linkGraph()
+	for _, node := range result.Nodes {
+		seen := make(map[string]bool)
+		for _, link := range links.outgoing[node.Id] {
+			for _, target := range links.resolve(link) {
+				if target != node.Id && included[target] && !seen[target] {
+					seen[target] = true
+					result.Edges = append(result.Edges, &GraphEdge{Source: node.Id, Target: target, Kind: edgeLink})
+				}
+			}
+		}
+	}
+
+	// notes sharing a tag are joined through a node of the tag rather than
+	// pairwise, so that edges grow with the tags held and not with their
+	// square. Tags held by a single note would only add leaves
+	var tagNodes []*GraphNode
+	for tag, ids := range nb.tags {
+		var holders []string
+		for _, id := range ids {
+			if included[id] {
+				holders = append(holders, id)
+			}
+		}
+		if len(holders) < 2 {
+			continue
+		}
+		tagNodes = append(tagNodes, &GraphNode{Id: tagNodeID(tag), Title: tag, Kind: nodeTag})
+		for _, id := range holders {
+			result.Edges = append(result.Edges, &GraphEdge{Source: id, Target: tagNodeID(tag), Kind: edgeTag, Tags: []string{tag}})
+		}
+	}
+	sort.Slice(tagNodes, func(i, j int) bool { return tagNodes[i].Id < tagNodes[j].Id })
+	result.Nodes = append(result.Nodes, tagNodes...)
+	sort.Slice(result.Edges, func(i, j int) bool {
+		a, b := result.Edges[i], result.Edges[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Target < b.Target
+	})
+
+	connected := make(map[string]bool)
+	for _, edge := range result.Edges {
+		connected[edge.Source] = true
+		connected[edge.Target] = true
+	}
+	groups := components(result.Nodes, result.Edges)
+	result.Stats = &GraphStats{
+		Nodes:      int64(len(result.Nodes)),
+		Edges:      int64(len(result.Edges)),
+		Components: int64(len(groups)),
+	}
+	if len(groups) != 0 {
+		result.Stats.LargestComponent = int64(len(groups[0]))
+	}
+	for _, node := range result.Nodes[:notes] {
+		if !connected[node.Id] {
+			result.Stats.Orphans = append(result.Stats.Orphans, node.Id)
+		}
+	}
+	return result
+}
+
+// dotQuote quotes s as a Graphviz ID
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// marshalDOT writes graph in the Graphviz DOT language, tag nodes are drawn
+// as boxes and tag edges dashed and without arrow
+func marshalDOT(graph *NotebookGraph) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph %s {\n", dotQuote(graph.Name))
+	stats := graph.GetStats()
+	fmt.Fprintf(&buf, "  // nodes: %d, edges: %d, components: %d, largest component: %d, orphans: %d\n",
+		stats.GetNodes(), stats.GetEdges(), stats.GetComponents(), stats.GetLargestComponent(), len(stats.GetOrphans()))
+	for _, node := range graph.Nodes {
+		if node.Kind == nodeTag {
+			fmt.Fprintf(&buf, "  %s [label=%s, shape=box];\n", dotQuote(node.Id), dotQuote(node.Title))
+			continue
+		}
+		fmt.Fprintf(&buf, "  %s [label=%s];\n", dotQuote(node.Id), dotQuote(node.Title))
+	}
+	for _, edge := range graph.Edges {
+		if edge.Kind == edgeTag {
+			fmt.Fprintf(&buf, "  %s -> %s [dir=none, style=dashed];\n", dotQuote(edge.Source), dotQuote(edge.Target))
+			continue
+		}
+		fmt.Fprintf(&buf, "  %s -> %s;\n", dotQuote(edge.Source), dotQuote(edge.Target))
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// ExportGraph takes a request body attempting to deserialise it to an
+// ExportGraphRequest object, responding with the graph of the notebook
+func (n *NotebookRepo) ExportGraph(w http.ResponseWriter, r *http.Request) {
+	body := &ExportGraphRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, err := n.lookupNotebook(body.GetName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	graph := notebook.graph(body.GetName(), body.GetTags())
+
+	if body.GetFormat() == graphDOT {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.Write(marshalDOT(graph))
+		return
+	}
+	response, err := json.Marshal(graph)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
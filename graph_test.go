@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newGraphRepo() *NotebookRepo {
+	return newTestRepo("graph_notebook",
+		&Note{Id: "id_1", Title: "Design", Body: "see [[Roadmap]]", Tags: []string{"work", "go"}},
+		&Note{Id: "id_2", Title: "Roadmap", Body: "note://id_1 and [[Missing]]", Tags: []string{"work", "go"}},
+		&Note{Id: "id_3", Title: "Standup", Body: "b", Tags: []string{"work/meetings"}},
+		&Note{Id: "id_4", Title: "Recipe", Body: "b \"quoted\"", Tags: []string{"home"}},
+	)
+}
+
+func TestExportGraph(t *testing.T) {
+	request := func(repo *NotebookRepo, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router := newRouter(repo, newHealth(), defaultConfig())
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/notebook/graph", bytes.NewBufferString(body)))
+		return w
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		w := request(newGraphRepo(), `{"name": "graph_notebook"}`)
+		assert.Equal(t, 200, w.Code)
+		graph := &NotebookGraph{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), graph))
+
+		assert.Len(t, graph.Nodes, 6)
+		assert.Equal(t, &GraphNode{Id: "tag:go", Title: "go", Kind: nodeTag}, graph.Nodes[4])
+		assert.Equal(t, &GraphNode{Id: "tag:work", Title: "work", Kind: nodeTag}, graph.Nodes[5])
+		assert.Equal(t, []*GraphEdge{
+			{Source: "id_1", Target: "id_2", Kind: edgeLink},
+			{Source: "id_2", Target: "id_1", Kind: edgeLink},
+			{Source: "id_1", Target: "tag:go", Kind: edgeTag, Tags: []string{"go"}},
+			{Source: "id_1", Target: "tag:work", Kind: edgeTag, Tags: []string{"work"}},
+			{Source: "id_2", Target: "tag:go", Kind: edgeTag, Tags: []string{"go"}},
+			{Source: "id_2", Target: "tag:work", Kind: edgeTag, Tags: []string{"work"}},
+		}, graph.Edges)
+		assert.Equal(t, &GraphStats{
+			Nodes:            6,
+			Edges:            6,
+			Components:       3,
+			LargestComponent: 2,
+			Orphans:          []string{"id_3", "id_4"},
+		}, graph.Stats)
+	})
+	t.Run("TagFilter", func(t *testing.T) {
+		w := request(newGraphRepo(), `{"name": "graph_notebook", "tags": ["work"]}`)
+		graph := &NotebookGraph{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), graph))
+
+		var ids []string
+		for _, node := range graph.Nodes {
+			ids = append(ids, node.Id)
+		}
+		assert.Equal(t, []string{"id_1", "id_2", "id_3", "tag:go", "tag:work"}, ids)
+		assert.Equal(t, []string{"id_3"}, graph.Stats.Orphans)
+	})
+	t.Run("DOT", func(t *testing.T) {
+		repo := newGraphRepo()
+		repo.notebooks["graph_notebook"].addNote(&Note{Id: "id_5", Title: `Say "hi"`, Body: "[[Recipe]]"})
+		w := request(repo, `{"name": "graph_notebook", "format": "dot", "tags": ["home"]}`)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "text/vnd.graphviz", w.Header().Get("Content-Type"))
+
+		assert.Equal(t, `digraph "graph_notebook" {
+  // nodes: 1, edges: 0, components: 1, largest component: 1, orphans: 1
+  "id_4" [label="Recipe"];
+}
+`, w.Body.String())
+
+		w = request(repo, `{"name": "graph_notebook", "format": "dot"}`)
+		assert.Contains(t, w.Body.String(), `  "id_5" [label="Say \"hi\""];`)
+		assert.Contains(t, w.Body.String(), `  "id_5" -> "id_4";`)
+		assert.Contains(t, w.Body.String(), `  "tag:work" [label="work", shape=box];`)
+		assert.Contains(t, w.Body.String(), `  "id_1" -> "tag:work" [dir=none, style=dashed];`)
+	})
+	t.Run("SharedTag", func(t *testing.T) {
+		var notes []*Note
+		for i := 0; i < 1000; i++ {
+			notes = append(notes, &Note{Id: fmt.Sprintf("id_%04d", i), Title: "t", Body: "b", Tags: []string{"all"}})
+		}
+		notebook := newTestRepo("graph_notebook", notes...).notebooks["graph_notebook"]
+		graph := notebook.graph("graph_notebook", nil)
+
+		// one edge per note rather than one per pair of notes
+		assert.Equal(t, int64(1001), graph.Stats.Nodes)
+		assert.Equal(t, int64(1000), graph.Stats.Edges)
+		assert.Equal(t, int64(1), graph.Stats.Components)
+		assert.Equal(t, int64(1000), graph.Stats.LargestComponent)
+		assert.Empty(t, graph.Stats.Orphans)
+	})
+	t.Run("InvalidFormat", func(t *testing.T) {
+		assert.Equal(t, 400, request(newGraphRepo(), `{"name": "graph_notebook", "format": "svg"}`).Code)
+	})
+}
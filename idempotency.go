@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// idempotencyKeyHeader makes a mutation safe to retry, the
+// idempotency_key request field is accepted as well
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayedHeader is set on responses replayed for a retry
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength matches the rules of the idempotency_key fields
+const maxIdempotencyKeyLength = 255
+
+// defaultIdempotencyTTL is how long responses are kept for retries when
+// api.idempotency_ttl is not configured
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyKeys holds the response of every request sent with an
+// Idempotency-Key. A record without a status is still in flight
+type idempotencyKeys struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	records   map[string]*IdempotencyRecord
+	lastSweep time.Time
+}
+
+func newIdempotencyKeys(ttl time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{
+		ttl:     ttl,
+		now:     time.Now,
+		records: make(map[string]*IdempotencyRecord),
+	}
+}
+
+// begin claims key for a request with fingerprint. It returns the stored
+// record when the key is known, which is either a completed response, a
+// request still in flight or a different payload
+func (k *idempotencyKeys) begin(key string, fingerprint []byte) (*IdempotencyRecord, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	if now.Sub(k.lastSweep) >= sweepInterval {
+		k.sweep(now)
+	}
+
+	if record, ok := k.records[key]; ok && !k.expired(record, now) {
+		return record, true
+	}
+	expires, _ := ptypes.TimestampProto(now.Add(k.ttl))
+	k.records[key] = &IdempotencyRecord{Key: key, Fingerprint: fingerprint, Expires: expires}
+	return nil, false
+}
+
+// finish stores the response of a claimed key, server errors release the
+// key so that the request can be retried
+func (k *idempotencyKeys) finish(key string, status int, contentType string, body []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	record, ok := k.records[key]
+	if !ok {
+		return
+	}
+	if status >= http.StatusInternalServerError {
+		delete(k.records, key)
+		return
+	}
+	record.Status = int32(status)
+	record.ContentType = contentType
+	record.Body = body
+}
+
+func (k *idempotencyKeys) expired(record *IdempotencyRecord, now time.Time) bool {
+	expires, err := ptypes.Timestamp(record.Expires)
+	return err != nil || !now.Before(expires)
+}
+
+// sweep drops every expired record, callers must hold k.mu
+func (k *idempotencyKeys) sweep(now time.Time) {
+	for key, record := range k.records {
+		if k.expired(record, now) {
+			delete(k.records, key)
+		}
+	}
+	k.lastSweep = now
+}
+
+// snapshot copies every completed record that has not expired, records
+// still in flight are left out
+func (k *idempotencyKeys) snapshot() []*IdempotencyRecord {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	var records []*IdempotencyRecord
+	for _, record := range k.records {
+		if record.Status != 0 && !k.expired(record, now) {
+			records = append(records, proto.Clone(record).(*IdempotencyRecord))
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+// restore adds every unexpired record, dropping the held ones first when
+// replace is set. Otherwise held records win over restored ones
+func (k *idempotencyKeys) restore(records []*IdempotencyRecord, replace bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	if replace {
+		k.records = make(map[string]*IdempotencyRecord)
+	}
+	for _, record := range records {
+		if _, ok := k.records[record.Key]; ok || record.Status == 0 || k.expired(record, now) {
+			continue
+		}
+		k.records[record.Key] = record
+	}
+}
+
+// requestFingerprint identifies the payload of a mutation, the JSON body is
+// re-encoded so that retries differing only in whitespace or key order
+// still match
+func requestFingerprint(r *http.Request, body []byte) []byte {
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err == nil {
+		if canonical, err := json.Marshal(decoded); err == nil {
+			body = canonical
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + routeTemplate(r) + "\n"))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// requestIdempotencyKey returns the Idempotency-Key header or else the
+// idempotency_key field of a JSON body
+func requestIdempotencyKey(r *http.Request, body []byte) (string, []*FieldViolation) {
+	var fields struct {
+		Key      string `json:"idempotency_key"`
+		KeyCamel string `json:"idempotencyKey"`
+	}
+	json.Unmarshal(body, &fields)
+	field := fields.Key
+	if field == "" {
+		field = fields.KeyCamel
+	}
+
+	key := r.Header.Get(idempotencyKeyHeader)
+	switch {
+	case key != "" && field != "" && key != field:
+		return "", []*FieldViolation{{
+			Field:       "idempotency_key",
+			Description: "must match the " + idempotencyKeyHeader + " header",
+		}}
+	case key == "":
+		key = field
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return "", []*FieldViolation{{
+			Field:       "idempotency_key",
+			Description: "must be at most 255 characters long",
+		}}
+	}
+	return key, nil
+}
+
+// capturedResponse copies a response as it is written
+type capturedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturedResponse) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *capturedResponse) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// idempotent makes next safe to retry. Requests holding a known key replay
+// the stored response, or are refused when the payload differs or the
+// first request is still being served. Keys are scoped to the principal
+func (n *NotebookRepo) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, ok := n.readBody(w, r)
+		if !ok {
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		key, violations := requestIdempotencyKey(r, body)
+		if len(violations) != 0 {
+			n.writeBadRequest(w, r, violations)
+			return
+		}
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		scoped := principal(r) + "\x00" + key
+		fingerprint := requestFingerprint(r, body)
+		record, known := n.idempotency.begin(scoped, fingerprint)
+		switch {
+		case known && !bytes.Equal(record.Fingerprint, fingerprint):
+			http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			return
+		case known && record.Status == 0:
+			http.Error(w, "A request with this Idempotency-Key is still being served", http.StatusConflict)
+			return
+		case known:
+			n.log(r).Info("Replaying idempotent response", "idempotency_key", key)
+			if record.ContentType != "" {
+				w.Header().Set("Content-Type", record.ContentType)
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(int(record.Status))
+			w.Write(record.Body)
+			return
+		}
+
+		captured := &capturedResponse{ResponseWriter: w}
+		defer func() {
+			// a panicking handler must not leave the key claimed until it
+			// expires
+			status := captured.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			p := recover()
+			if p != nil {
+				status = http.StatusInternalServerError
+			}
+			n.idempotency.finish(scoped, status, w.Header().Get("Content-Type"), captured.body.Bytes())
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next(captured, r)
+	}
+}
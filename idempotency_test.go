@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotent(t *testing.T) {
+	repo := NewNotebookRepo(nil)
+	now := time.Unix(1591012800, 0)
+	repo.idempotency.now = func() time.Time { return now }
+	router := newRouter(repo, newHealth(), defaultConfig())
+	request := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	createdID := func(w *httptest.ResponseRecorder) string {
+		created := &CreateNoteResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), created))
+		return created.Id
+	}
+	assert.Equal(t, 200, request("POST", "/notebook", "notebook-1", `{"name": "idempotent_notebook"}`).Code)
+
+	t.Run("Header/Replayed", func(t *testing.T) {
+		first := request("POST", "/note", "key-1", `{"notebook_name": "idempotent_notebook", "title": "t", "body": "b"}`)
+		retry := request("POST", "/note", "key-1", `{"body": "b", "title": "t",   "notebook_name": "idempotent_notebook"}`)
+
+		assert.Equal(t, 200, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get(idempotentReplayedHeader))
+		assert.Empty(t, first.Header().Get(idempotentReplayedHeader))
+		assert.Equal(t, createdID(first), createdID(retry))
+		assert.Len(t, repo.notebooks["idempotent_notebook"].notes, 1)
+	})
+	t.Run("Field/Replayed", func(t *testing.T) {
+		body := `{"notebook_name": "idempotent_notebook", "title": "t", "body": "b", "idempotency_key": "key-2"}`
+		first := request("POST", "/note", "", body)
+		retry := request("POST", "/note", "", body)
+
+		assert.Equal(t, createdID(first), createdID(retry))
+		assert.Len(t, repo.notebooks["idempotent_notebook"].notes, 2)
+	})
+	t.Run("ErrorsReplayed", func(t *testing.T) {
+		assert.Equal(t, 409, request("POST", "/notebook", "notebook-2", `{"name": "idempotent_notebook"}`).Code)
+		retry := request("POST", "/notebook", "notebook-2", `{"name": "idempotent_notebook"}`)
+
+		assert.Equal(t, 409, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get(idempotentReplayedHeader))
+	})
+	t.Run("DifferentPayload/Unprocessable", func(t *testing.T) {
+		w := request("POST", "/note", "key-1", `{"notebook_name": "idempotent_notebook", "title": "t", "body": "other"}`)
+
+		assert.Equal(t, 422, w.Code)
+		assert.Equal(t, 422, request("DELETE", "/note", "key-1", `{"notebook_name": "idempotent_notebook", "id": "id_1"}`).Code)
+	})
+	t.Run("HeaderAndFieldDiffer/BadRequest", func(t *testing.T) {
+		w := request("POST", "/note", "key-3", `{"notebook_name": "idempotent_notebook", "title": "t", "body": "b", "idempotency_key": "key-4"}`)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "must match the Idempotency-Key header")
+	})
+	t.Run("Expired", func(t *testing.T) {
+		now = now.Add(defaultIdempotencyTTL)
+		w := request("POST", "/note", "key-1", `{"notebook_name": "idempotent_notebook", "title": "t", "body": "b"}`)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Empty(t, w.Header().Get(idempotentReplayedHeader))
+		assert.Len(t, repo.notebooks["idempotent_notebook"].notes, 3)
+	})
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	keys := newIdempotencyKeys(time.Hour)
+	fingerprint := []byte("fingerprint")
+
+	t.Run("InFlight", func(t *testing.T) {
+		_, known := keys.begin("key-1", fingerprint)
+		assert.False(t, known)
+
+		record, known := keys.begin("key-1", fingerprint)
+		assert.True(t, known)
+		assert.Zero(t, record.Status)
+	})
+	t.Run("ServerError/Released", func(t *testing.T) {
+		keys.finish("key-1", 500, "", nil)
+
+		_, known := keys.begin("key-1", fingerprint)
+		assert.False(t, known)
+	})
+	t.Run("Stored", func(t *testing.T) {
+		keys.finish("key-1", 201, "application/json", []byte(`{}`))
+
+		record, known := keys.begin("key-1", fingerprint)
+		assert.True(t, known)
+		assert.Equal(t, int32(201), record.Status)
+		assert.Equal(t, []byte(`{}`), record.Body)
+	})
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/google/uuid"
+)
+
+// import job states reported in ImportJob.State
+const (
+	importJobRunning   = "running"
+	importJobSucceeded = "succeeded"
+	importJobFailed    = "failed"
+)
+
+// importItem is a single note read by an Importer. err is set for items that
+// could be read but not parsed so that the rest of the file is still imported
+type importItem struct {
+	ref     string
+	request *CreateNoteRequest
+	created *timestamp.Timestamp
+	updated *timestamp.Timestamp
+	err     error
+}
+
+// Importer streams notes out of an uploaded file
+type Importer interface {
+	// Import calls emit for every item read from r, a returned error
+	// means the rest of the file could not be read
+	Import(r io.Reader, emit func(item *importItem)) error
+}
+
+// importers holds every supported import format keyed by the name
+// expected in the format query parameter
+var importers = map[string]Importer{
+	"enex":  enexImporter{},
+	"jsonl": jsonlImporter{},
+}
+
+// jsonlImporter reads one CreateNoteRequest per line
+type jsonlImporter struct{}
+
+// Import reads r line by line so that arbitrarily large files are never
+// held in memory at once
+func (jsonlImporter) Import(r io.Reader, emit func(item *importItem)) error {
+	reader := bufio.NewReader(r)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if strings.TrimSpace(line) != "" {
+			item := &importItem{
+				ref:     fmt.Sprintf("line %d", lineNumber),
+				request: &CreateNoteRequest{},
+			}
+			item.err = jsonpb.UnmarshalString(line, item.request)
+			emit(item)
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// importJob pairs the ImportJob reported to clients with a channel closed
+// once the job has finished
+type importJob struct {
+	job  *ImportJob
+	done chan struct{}
+}
+
+// finished import jobs are kept for importJobTTL, and only the
+// maxFinishedImportJobs most recently finished of them
+const (
+	importJobTTL          = time.Hour
+	maxFinishedImportJobs = 100
+)
+
+// maxImportJobResults bounds the results kept by a job, the outcome of the
+// first maxImportJobResults items and of the first maxImportJobResults
+// failed items is kept
+const maxImportJobResults = 1000
+
+// importJobs holds the running import jobs and those that finished lately
+type importJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*importJob
+	// now is time.Now when nil
+	now func() time.Time
+}
+
+// add registers a running job
+func (j *importJobs) add(job *importJob) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.jobs == nil {
+		j.jobs = make(map[string]*importJob)
+	}
+	j.sweep()
+	j.jobs[job.job.Id] = job
+}
+
+// sweep drops the finished jobs that expired along with the oldest of
+// those beyond maxFinishedImportJobs, callers must hold j.mu
+func (j *importJobs) sweep() {
+	now := time.Now()
+	if j.now != nil {
+		now = j.now()
+	}
+	var finished []*importJob
+	for id, job := range j.jobs {
+		if job.job.Finished == nil {
+			continue
+		}
+		finishedAt, err := ptypes.Timestamp(job.job.Finished)
+		if err != nil || now.Sub(finishedAt) >= importJobTTL {
+			delete(j.jobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(finished) <= maxFinishedImportJobs {
+		return
+	}
+	sort.Slice(finished, func(a, b int) bool {
+		return timestampNanos(finished[a].job.Finished) < timestampNanos(finished[b].job.Finished)
+	})
+	for _, job := range finished[:len(finished)-maxFinishedImportJobs] {
+		delete(j.jobs, job.job.Id)
+	}
+}
+
+// get returns a copy of the ImportJob that is safe to read while the job runs
+func (j *importJobs) get(id string) (*ImportJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.sweep()
+	job, ok := j.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(job.job).(*ImportJob), true
+}
+
+// update applies fn to an ImportJob while holding the jobs lock
+func (j *importJobs) update(job *importJob, fn func(job *ImportJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(job.job)
+}
+
+// CreateImportJob spools the request body to disk and starts importing it
+// in the background. The format and the default notebook_name are read from
+// the query string, the created ImportJob is returned straight away
+func (n *NotebookRepo) CreateImportJob(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	importer, ok := importers[format]
+	if !ok {
+		errMsg := fmt.Sprintf("Unknown import format '%s'", format)
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+	notebookName := query.Get("notebook_name")
+	if notebookName != "" && !n.validRequest(w, r, &CreateNotebookRequest{Name: notebookName}) {
+		return
+	}
+
+	spool, err := ioutil.TempFile("", "notebook-import-")
+	if err != nil {
+		n.log(r).Error("Unable to create import spool", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(spool, r.Body); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		n.log(r).Error("Unable to read request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		n.log(r).Error("Unable to rewind import spool", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if notebookName != "" {
+		n.mu.Lock()
+		if _, ok := n.notebooks[notebookName]; !ok {
+			n.notebooks[notebookName] = makeNotebook(notebookName, n.global)
+		}
+		n.mu.Unlock()
+	}
+
+	job := &importJob{
+		job: &ImportJob{
+			Id:           uuid.New().String(),
+			Format:       format,
+			NotebookName: notebookName,
+			State:        importJobRunning,
+			Started:      ptypes.TimestampNow(),
+		},
+		done: make(chan struct{}),
+	}
+	n.imports.add(job)
+	result, _ := n.imports.get(job.job.Id)
+
+	go n.runImportJob(job, importer, spool, n.log(r).With("job_id", job.job.Id))
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(response)
+}
+
+// runImportJob feeds every item read from the spooled file through the same
+// path as CreateNote, removing the spool once done
+func (n *NotebookRepo) runImportJob(job *importJob, importer Importer, spool *os.File, logger *Logger) {
+	defer close(job.done)
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	var index int64
+	err := importer.Import(spool, func(item *importItem) {
+		result := n.storeImportItem(job.job.NotebookName, item)
+		result.Index = index
+		index++
+		n.imports.update(job, func(job *ImportJob) {
+			if result.Error == "" {
+				job.Succeeded++
+			} else {
+				job.Failed++
+			}
+			if result.Index < maxImportJobResults || (result.Error != "" && job.Failed <= maxImportJobResults) {
+				job.Results = append(job.Results, result)
+			} else {
+				job.OmittedResults++
+			}
+		})
+	})
+
+	n.imports.update(job, func(job *ImportJob) {
+		job.Finished = ptypes.TimestampNow()
+		job.State = importJobSucceeded
+		if err != nil {
+			job.State = importJobFailed
+			job.Error = err.Error()
+			logger.Error("Import job failed", "error", err, "succeeded", job.Succeeded, "failed", job.Failed)
+			return
+		}
+		logger.Info("Import job finished", "succeeded", job.Succeeded, "failed", job.Failed)
+	})
+}
+
+// storeImportItem creates a note from an importItem, defaulting to the
+// notebook the job was started for
+func (n *NotebookRepo) storeImportItem(notebookName string, item *importItem) *ImportItemResult {
+	result := &ImportItemResult{Ref: item.ref}
+	if item.err != nil {
+		result.Error = item.err.Error()
+		return result
+	}
+	if item.request.GetNotebookName() == "" {
+		item.request.NotebookName = notebookName
+	}
+	if violations := validateMessage(item.request); len(violations) != 0 {
+		result.Error = violationsError(violations).Error()
+		return result
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	notebook, note, err := n.newNote(item.request)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if item.created != nil {
+		note.Created = item.created
+	}
+	note.LastModified = item.updated
+	notebook.addNote(note)
+	result.Id = note.Id
+	return result
+}
+
+// GetImportJob takes a request body attempting to deserialise it to a
+// GetImportJobRequest object
+func (n *NotebookRepo) GetImportJob(w http.ResponseWriter, r *http.Request) {
+	body := &GetImportJobRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+
+	job, ok := n.imports.get(body.GetId())
+	if !ok {
+		errMsg := fmt.Sprintf("Import job with id '%s' does not exist", body.GetId())
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusNotFound)
+		return
+	}
+
+	response, err := json.Marshal(job)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
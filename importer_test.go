@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+)
+
+const enexExport = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE en-export SYSTEM "http://xml.evernote.com/pub/evernote-export3.dtd">
+<en-export export-date="20200601T120000Z" application="Evernote" version="10">
+  <note>
+    <title>Groceries</title>
+    <content><![CDATA[<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE en-note SYSTEM "http://xml.evernote.com/pub/enml2.dtd">
+<en-note><h1>Shopping</h1><div><en-todo checked="true"/>milk</div><div><en-todo/>eggs&nbsp;and <b>bread</b></div><ul><li>one</li><li><a href="https://example.com">two</a></li></ul></en-note>]]></content>
+    <created>20200601T120000Z</created>
+    <updated>20200602T120000Z</updated>
+    <tag>home</tag>
+    <tag>errands</tag>
+  </note>
+  <note>
+    <title>Empty</title>
+    <content><![CDATA[<en-note></en-note>]]></content>
+  </note>
+</en-export>`
+
+func runImportJob(t *testing.T, repo *NotebookRepo, query string, data string) *ImportJob {
+	req := httptest.NewRequest("POST", "/import?"+query, bytes.NewBufferString(data))
+	w := httptest.NewRecorder()
+	repo.CreateImportJob(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, 202, resp.StatusCode)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	started := &ImportJob{}
+	assert.NoError(t, json.Unmarshal(body, started))
+	assert.Equal(t, importJobRunning, started.State)
+	<-repo.imports.jobs[started.Id].done
+
+	req = httptest.NewRequest("GET", "/import", bytes.NewBufferString(`{"id": "`+started.Id+`"}`))
+	w = httptest.NewRecorder()
+	repo.GetImportJob(w, req)
+
+	resp = w.Result()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	body, _ = ioutil.ReadAll(resp.Body)
+	job := &ImportJob{}
+	assert.NoError(t, json.Unmarshal(body, job))
+	return job
+}
+
+func TestEnmlToMarkdown(t *testing.T) {
+	markdown, err := enmlToMarkdown(`<en-note><p>Some <i>styled</i> text</p><pre>  keep
+  this</pre><blockquote>quoted</blockquote><ol><li>first</li><li>second</li></ol></en-note>`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Some _styled_ text\n\n```\n  keep\n  this\n```\n\n> quoted\n\n1. first\n2. second", markdown)
+}
+
+func TestEnmlToMarkdownManyLines(t *testing.T) {
+	const lines = 200000
+	var enml strings.Builder
+	enml.WriteString("<en-note>")
+	for i := 0; i < lines; i++ {
+		enml.WriteString("<div>line </div>")
+	}
+	enml.WriteString("</en-note>")
+
+	// each line ends in a space that is trimmed without copying the output
+	markdown, err := enmlToMarkdown(enml.String())
+
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimSuffix(strings.Repeat("line\n", lines), "\n"), markdown)
+}
+
+func TestCreateImportJob(t *testing.T) {
+	t.Run("Enex/Success", func(t *testing.T) {
+		repo := NewNotebookRepo(nil)
+
+		job := runImportJob(t, repo, "format=enex&notebook_name=evernote", enexExport)
+
+		assert.Equal(t, importJobSucceeded, job.State)
+		assert.Equal(t, int64(1), job.Succeeded)
+		assert.Equal(t, int64(1), job.Failed)
+		assert.Equal(t, "body must not be empty", job.Results[1].Error)
+
+		notebook := repo.notebooks["evernote"]
+		note := notebook.notes[job.Results[0].Id]
+		assert.Equal(t, "Groceries", note.Title)
+		assert.Equal(t, "# Shopping\n\n- [x] milk\n- [ ] eggs and **bread**\n- one\n- [two](https://example.com)", note.Body)
+		assert.Equal(t, []string{"home", "errands"}, note.Tags)
+		assert.Equal(t, int64(1591012800), note.Created.GetSeconds())
+		assert.Equal(t, int64(1591099200), note.LastModified.GetSeconds())
+		assert.Equal(t, []string{note.Id}, notebook.tags["errands"])
+	})
+	t.Run("Jsonl/Success", func(t *testing.T) {
+		repo := NewNotebookRepo(nil)
+		lines := strings.Join([]string{
+			`{"title": "title_1", "body": "body_1", "tags": ["tag_1"]}`,
+			``,
+			`{"title": "title_2"}`,
+			`not json`,
+			`{"notebook_name": "missing", "title": "title_3", "body": "body_3"}`,
+			`{"title": "title_4", "body": "body_4", "tags": ["bad tag"]}`,
+		}, "\n")
+
+		job := runImportJob(t, repo, "format=jsonl&notebook_name=jsonl", lines)
+
+		assert.Equal(t, importJobSucceeded, job.State)
+		assert.Equal(t, int64(1), job.Succeeded)
+		assert.Equal(t, int64(4), job.Failed)
+		assert.Equal(t, "line 1", job.Results[0].Ref)
+		assert.Equal(t, "line 3", job.Results[1].Ref)
+		assert.Equal(t, "line 4", job.Results[2].Ref)
+		assert.Equal(t, "body must not be empty", job.Results[1].Error)
+		assert.Equal(t, "Notebook with name 'missing' does not exist", job.Results[3].Error)
+		assert.Contains(t, job.Results[4].Error, "tags[0] must match")
+		assert.Equal(t, []string{job.Results[0].Id}, repo.notebooks["jsonl"].tags["tag_1"])
+	})
+	t.Run("Jsonl/ResultsCapped", func(t *testing.T) {
+		repo := NewNotebookRepo(nil)
+		var lines []string
+		for i := 0; i < maxImportJobResults+500; i++ {
+			lines = append(lines, fmt.Sprintf(`{"title": "title_%d", "body": "body"}`, i))
+		}
+		for i := 0; i < maxImportJobResults+500; i++ {
+			lines = append(lines, `not json`)
+		}
+
+		job := runImportJob(t, repo, "format=jsonl&notebook_name=jsonl", strings.Join(lines, "\n"))
+
+		assert.Equal(t, int64(maxImportJobResults+500), job.Succeeded)
+		assert.Equal(t, int64(maxImportJobResults+500), job.Failed)
+		assert.Equal(t, int64(maxImportJobResults), job.OmittedResults)
+		if assert.Len(t, job.Results, 2*maxImportJobResults) {
+			assert.Equal(t, int64(maxImportJobResults-1), job.Results[maxImportJobResults-1].Index)
+			assert.NotEmpty(t, job.Results[maxImportJobResults].Error)
+			assert.Equal(t, int64(2*maxImportJobResults+499), job.Results[2*maxImportJobResults-1].Index)
+		}
+	})
+	t.Run("MalformedFile/Failed", func(t *testing.T) {
+		repo := NewNotebookRepo(nil)
+
+		job := runImportJob(t, repo, "format=enex&notebook_name=evernote", "<en-export><note><title>")
+
+		assert.Equal(t, importJobFailed, job.State)
+		assert.NotEmpty(t, job.Error)
+	})
+	t.Run("UnknownFormat/Error", func(t *testing.T) {
+		repo := NewNotebookRepo(nil)
+		req := httptest.NewRequest("POST", "/import?format=docx", bytes.NewBufferString(""))
+		w := httptest.NewRecorder()
+		repo.CreateImportJob(w, req)
+
+		assert.Equal(t, 400, w.Result().StatusCode)
+	})
+}
+
+func TestImportJobsSweep(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	jobs := &importJobs{now: func() time.Time { return now }}
+	finish := func(id string, ago time.Duration) {
+		finished, _ := ptypes.TimestampProto(now.Add(-ago))
+		jobs.add(&importJob{job: &ImportJob{Id: id, Finished: finished}})
+	}
+	jobs.add(&importJob{job: &ImportJob{Id: "running"}})
+	finish("expired", importJobTTL)
+	for i := 0; i < maxFinishedImportJobs+1; i++ {
+		finish(fmt.Sprintf("finished_%d", i), time.Duration(maxFinishedImportJobs+1-i)*time.Second)
+	}
+
+	_, ok := jobs.get("running")
+	assert.True(t, ok)
+	_, ok = jobs.get("expired")
+	assert.False(t, ok)
+	// only the oldest finished job is beyond the cap
+	_, ok = jobs.get("finished_0")
+	assert.False(t, ok)
+	_, ok = jobs.get("finished_1")
+	assert.True(t, ok)
+	assert.Len(t, jobs.jobs, maxFinishedImportJobs+1)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// link kinds reported in NoteLink.kind
+const (
+	linkTitle = "title"
+	linkID    = "id"
+)
+
+// titleLinkPattern matches [[Note Title]] and [[Note Title|label]] links,
+// idLinkPattern matches note://<id> links
+var (
+	titleLinkPattern = regexp.MustCompile(`\[\[([^\[\]|\n]+)(\|[^\[\]\n]*)?\]\]`)
+	idLinkPattern    = regexp.MustCompile(`note://([A-Za-z0-9_-]+)`)
+)
+
+// noteLink is a link parsed out of a note body
+type noteLink struct {
+	kind   string
+	target string
+}
+
+// key returns what the link resolves on, titles are matched regardless of
+// case and surrounding spaces
+func (l noteLink) key() string {
+	if l.kind == linkTitle {
+		return titleKey(l.target)
+	}
+	return l.target
+}
+
+func titleKey(title string) string {
+	return strings.ToLower(strings.TrimSpace(title))
+}
+
+// parseLinks returns the distinct links of body in order of appearance
+func parseLinks(body string) []noteLink {
+	type match struct {
+		at   int
+		link noteLink
+	}
+	var matches []match
+	for _, m := range titleLinkPattern.FindAllStringSubmatchIndex(body, -1) {
+		target := strings.TrimSpace(body[m[2]:m[3]])
+		if target != "" {
+			matches = append(matches, match{m[0], noteLink{kind: linkTitle, target: target}})
+		}
+	}
+	for _, m := range idLinkPattern.FindAllStringSubmatchIndex(body, -1) {
+		matches = append(matches, match{m[0], noteLink{kind: linkID, target: body[m[2]:m[3]]}})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].at < matches[j].at })
+
+	seen := make(map[noteLink]bool)
+	var links []noteLink
+	for _, m := range matches {
+		key := noteLink{kind: m.link.kind, target: m.link.key()}
+		if !seen[key] {
+			seen[key] = true
+			links = append(links, m.link)
+		}
+	}
+	return links
+}
+
+// idSet is a set of note ids
+type idSet map[string]map[string]bool
+
+func (s idSet) add(key, id string) {
+	if s[key] == nil {
+		s[key] = make(map[string]bool)
+	}
+	s[key][id] = true
+}
+
+func (s idSet) remove(key, id string) {
+	delete(s[key], id)
+	if len(s[key]) == 0 {
+		delete(s, key)
+	}
+}
+
+// sorted returns the ids held under key in ascending order
+func (s idSet) sorted(key string) []string {
+	ids := make([]string, 0, len(s[key]))
+	for id := range s[key] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// linkGraph holds the links between the notes of a notebook, it is kept up
+// to date by Notebook.putNote and Notebook.removeNote
+type linkGraph struct {
+	outgoing map[string][]noteLink
+	// titles holds the title key of every note, byTitle the notes holding
+	// each title key
+	titles  map[string]string
+	byTitle idSet
+	// titleRefs and idRefs hold the notes linking to each title key and id
+	titleRefs idSet
+	idRefs    idSet
+}
+
+func newLinkGraph() *linkGraph {
+	return &linkGraph{
+		outgoing:  make(map[string][]noteLink),
+		titles:    make(map[string]string),
+		byTitle:   make(idSet),
+		titleRefs: make(idSet),
+		idRefs:    make(idSet),
+	}
+}
+
+// refs returns the set holding the referrers of links of kind
+func (g *linkGraph) refs(kind string) idSet {
+	if kind == linkTitle {
+		return g.titleRefs
+	}
+	return g.idRefs
+}
+
+// put records the title and links of note, replacing any previous version
+func (g *linkGraph) put(note *Note) {
+	if g == nil {
+		return
+	}
+	g.remove(note.Id)
+	links := parseLinks(note.GetBody())
+	for _, link := range links {
+		g.refs(link.kind).add(link.key(), note.Id)
+	}
+	g.outgoing[note.Id] = links
+	g.titles[note.Id] = titleKey(note.GetTitle())
+	g.byTitle.add(titleKey(note.GetTitle()), note.Id)
+}
+
+// remove drops the title and links of the note with id
+func (g *linkGraph) remove(id string) {
+	if g == nil {
+		return
+	}
+	title, ok := g.titles[id]
+	if !ok {
+		return
+	}
+	for _, link := range g.outgoing[id] {
+		g.refs(link.kind).remove(link.key(), id)
+	}
+	g.byTitle.remove(title, id)
+	delete(g.outgoing, id)
+	delete(g.titles, id)
+}
+
+// resolve returns the ids of the notes link points to
+func (g *linkGraph) resolve(link noteLink) []string {
+	if link.kind == linkTitle {
+		return g.byTitle.sorted(link.key())
+	}
+	if _, ok := g.titles[link.target]; ok {
+		return []string{link.target}
+	}
+	return nil
+}
+
+// linksOf returns the links of the note with id along with their targets
+func (g *linkGraph) linksOf(id string) []*NoteLink {
+	var links []*NoteLink
+	for _, link := range g.outgoing[id] {
+		ids := g.resolve(link)
+		links = append(links, &NoteLink{Kind: link.kind, Target: link.target, NoteIds: ids, Dangling: len(ids) == 0})
+	}
+	return links
+}
+
+// backlinks returns the ids of the notes linking to the note with id by
+// its id or title, sorted
+func (g *linkGraph) backlinks(id string) []string {
+	ids := make(map[string]bool)
+	for source := range g.idRefs[id] {
+		ids[source] = true
+	}
+	if title, ok := g.titles[id]; ok {
+		for source := range g.titleRefs[title] {
+			ids[source] = true
+		}
+	}
+	sorted := make([]string, 0, len(ids))
+	for source := range ids {
+		sorted = append(sorted, source)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// linkGraph returns the link graph of the notebook, notebooks built
+// without one get a graph computed from their notes
+func (nb Notebook) linkGraph() *linkGraph {
+	if nb.links != nil {
+		return nb.links
+	}
+	graph := newLinkGraph()
+	for _, note := range nb.notes {
+		graph.put(note)
+	}
+	return graph
+}
+
+// referrers returns the notes other than note linking to it, by its id
+// when byID is set, and by title when title is not empty
+func (nb Notebook) referrers(note *Note, title string, byID bool) []string {
+	graph := nb.linkGraph()
+	ids := make(map[string]bool)
+	if byID {
+		for source := range graph.idRefs[note.Id] {
+			ids[source] = true
+		}
+	}
+	if title != "" {
+		for source := range graph.titleRefs[titleKey(title)] {
+			ids[source] = true
+		}
+	}
+	delete(ids, note.Id)
+	sorted := make([]string, 0, len(ids))
+	for source := range ids {
+		sorted = append(sorted, source)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// orphanedTitle returns title when no note of the notebook holds it, links
+// to it being dangling, or an empty string
+func (nb Notebook) orphanedTitle(title string) string {
+	if len(nb.linkGraph().byTitle[titleKey(title)]) != 0 {
+		return ""
+	}
+	return title
+}
+
+// wikiLink formats a link to title displayed as label, or as the title
+// when label is empty
+func wikiLink(title, label string) string {
+	if label != "" {
+		return "[[" + title + "|" + label + "]]"
+	}
+	return "[[" + title + "]]"
+}
+
+// rewriteLinks replaces the links to note held by the notes with ids, title
+// links to title and, when byID is set, id links to note. Each link is
+// replaced by the result of replace, called with the target of the link as
+// written and its label, empty when it has none
+func (nb Notebook) rewriteLinks(ids []string, note *Note, title string, byID bool, replace func(target, label string) string) {
+	now := ptypes.TimestampNow()
+	for _, id := range ids {
+		source, ok := nb.notes[id]
+		if !ok {
+			continue
+		}
+		body := titleLinkPattern.ReplaceAllStringFunc(source.Body, func(link string) string {
+			m := titleLinkPattern.FindStringSubmatch(link)
+			if title == "" || titleKey(m[1]) != titleKey(title) {
+				return link
+			}
+			return replace(strings.TrimSpace(m[1]), strings.TrimPrefix(m[2], "|"))
+		})
+		if byID {
+			body = idLinkPattern.ReplaceAllStringFunc(body, func(link string) string {
+				if idLinkPattern.FindStringSubmatch(link)[1] != note.Id {
+					return link
+				}
+				return replace(note.Title, "")
+			})
+		}
+		if body == source.Body {
+			continue
+		}
+		rewritten := proto.Clone(source).(*Note)
+		rewritten.Body = body
+		rewritten.LastModified = now
+		nb.putNote(rewritten)
+	}
+}
+
+// GetOutgoingLinks takes a request body attempting to deserialise it to a
+// GetOutgoingLinksRequest object
+func (n *NotebookRepo) GetOutgoingLinks(w http.ResponseWriter, r *http.Request) {
+	body := &GetOutgoingLinksRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, note, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &GetOutgoingLinksResponse{
+		NotebookName: body.GetNotebookName(),
+		Id:           note.Id,
+		Links:        notebook.linkGraph().linksOf(note.Id),
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// GetBacklinks takes a request body attempting to deserialise it to a
+// GetBacklinksRequest object
+func (n *NotebookRepo) GetBacklinks(w http.ResponseWriter, r *http.Request) {
+	body := &GetBacklinksRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, note, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &GetBacklinksResponse{NotebookName: body.GetNotebookName(), Id: note.Id}
+	for _, id := range notebook.linkGraph().backlinks(note.Id) {
+		result.Backlinks = append(result.Backlinks, &Backlink{Id: id, Title: notebook.notes[id].GetTitle()})
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// ListDanglingLinks takes a request body attempting to deserialise it to a
+// ListDanglingLinksRequest object
+func (n *NotebookRepo) ListDanglingLinks(w http.ResponseWriter, r *http.Request) {
+	body := &ListDanglingLinksRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	graph := notebook.linkGraph()
+	ids := make([]string, 0, len(graph.outgoing))
+	for id := range graph.outgoing {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	result := &ListDanglingLinksResponse{NotebookName: body.GetNotebookName()}
+	for _, id := range ids {
+		for _, link := range graph.linksOf(id) {
+			if link.Dangling {
+				result.Links = append(result.Links, &DanglingLink{Id: id, Link: link})
+			}
+		}
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLinksRepo() *NotebookRepo {
+	return newTestRepo("links_notebook",
+		&Note{Id: "id_1", Title: "Design", Body: "see [[Roadmap]] and note://id_3"},
+		&Note{Id: "id_2", Title: "Roadmap", Body: "follows [[design|the design]], [[Missing]] and note://id_9"},
+		&Note{Id: "id_3", Title: "Notes", Body: "back to [[Roadmap]]"},
+	)
+}
+
+func TestParseLinks(t *testing.T) {
+	links := parseLinks("[[A]] note://id_1. [[ b | label ]] [[a]] [[]] note://id_1 [[C\n]]")
+
+	assert.Equal(t, []noteLink{
+		{kind: linkTitle, target: "A"},
+		{kind: linkID, target: "id_1"},
+		{kind: linkTitle, target: "b"},
+	}, links)
+}
+
+func TestLinks(t *testing.T) {
+	request := func(repo *NotebookRepo, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router := newRouter(repo, newHealth(), defaultConfig())
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	backlinks := func(repo *NotebookRepo, id string) []string {
+		w := request(repo, "GET", "/note/backlinks", `{"notebook_name": "links_notebook", "id": "`+id+`"}`)
+		assert.Equal(t, 200, w.Code)
+		result := &GetBacklinksResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		var ids []string
+		for _, backlink := range result.Backlinks {
+			ids = append(ids, backlink.Id)
+		}
+		return ids
+	}
+
+	t.Run("Outgoing", func(t *testing.T) {
+		w := request(newLinksRepo(), "GET", "/note/links", `{"notebook_name": "links_notebook", "id": "id_2"}`)
+		assert.Equal(t, 200, w.Code)
+		result := &GetOutgoingLinksResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Equal(t, []*NoteLink{
+			{Kind: linkTitle, Target: "design", NoteIds: []string{"id_1"}},
+			{Kind: linkTitle, Target: "Missing", Dangling: true},
+			{Kind: linkID, Target: "id_9", Dangling: true},
+		}, result.Links)
+	})
+	t.Run("Backlinks", func(t *testing.T) {
+		repo := newLinksRepo()
+
+		assert.Equal(t, []string{"id_1", "id_3"}, backlinks(repo, "id_2"))
+		assert.Equal(t, []string{"id_1"}, backlinks(repo, "id_3"))
+	})
+	t.Run("Backlinks/UnknownNote", func(t *testing.T) {
+		w := request(newLinksRepo(), "GET", "/note/backlinks", `{"notebook_name": "links_notebook", "id": "id_9"}`)
+		assert.Equal(t, 400, w.Code)
+	})
+	t.Run("Dangling", func(t *testing.T) {
+		w := request(newLinksRepo(), "GET", "/notebook/links/dangling", `{"notebook_name": "links_notebook"}`)
+		assert.Equal(t, 200, w.Code)
+		result := &ListDanglingLinksResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Len(t, result.Links, 2)
+		assert.Equal(t, "id_2", result.Links[0].Id)
+		assert.Equal(t, "Missing", result.Links[0].Link.Target)
+	})
+	t.Run("Create/Resolves", func(t *testing.T) {
+		repo := newLinksRepo()
+		w := request(repo, "POST", "/note", `{"notebook_name": "links_notebook", "title": "Missing", "body": "b"}`)
+		assert.Equal(t, 200, w.Code)
+
+		w = request(repo, "GET", "/notebook/links/dangling", `{"notebook_name": "links_notebook"}`)
+		result := &ListDanglingLinksResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		assert.Len(t, result.Links, 1)
+	})
+	t.Run("Rename/Reported", func(t *testing.T) {
+		repo := newLinksRepo()
+		w := request(repo, "UPDATE", "/note", `{"notebook_name": "links_notebook", "id": "id_2", "title": "Plan", "body": "b"}`)
+		assert.Equal(t, 200, w.Code)
+		result := &UpdateNoteResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Equal(t, []string{"id_1", "id_3"}, result.Referrers)
+		assert.Equal(t, "back to [[Roadmap]]", repo.notebooks["links_notebook"].notes["id_3"].Body)
+		assert.Empty(t, backlinks(repo, "id_2"))
+	})
+	t.Run("Rename/Rewritten", func(t *testing.T) {
+		repo := newLinksRepo()
+		w := request(repo, "UPDATE", "/note", `{"notebook_name": "links_notebook", "id": "id_1", "title": "Architecture", "body": "b", "rewrite_links": true}`)
+		assert.Equal(t, 200, w.Code)
+
+		note := repo.notebooks["links_notebook"].notes["id_2"]
+		assert.Equal(t, "follows [[Architecture|the design]], [[Missing]] and note://id_9", note.Body)
+		assert.NotNil(t, note.LastModified)
+		assert.Equal(t, []string{"id_2"}, backlinks(repo, "id_1"))
+	})
+	t.Run("Rename/SameTitle", func(t *testing.T) {
+		w := request(newLinksRepo(), "UPDATE", "/note", `{"notebook_name": "links_notebook", "id": "id_2", "title": "ROADMAP", "body": "b"}`)
+		result := &UpdateNoteResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Empty(t, result.Referrers)
+	})
+	t.Run("Delete/Rewritten", func(t *testing.T) {
+		repo := newLinksRepo()
+		w := request(repo, "DELETE", "/note", `{"notebook_name": "links_notebook", "id": "id_3", "rewrite_links": true}`)
+		assert.Equal(t, 200, w.Code)
+		result := &DeleteNoteResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Equal(t, []string{"id_1"}, result.Referrers)
+		assert.Equal(t, "see [[Roadmap]] and Notes", repo.notebooks["links_notebook"].notes["id_1"].Body)
+		assert.Equal(t, []string{"id_1"}, backlinks(repo, "id_2"))
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// requestIDHeader is read from incoming requests and echoed on every response
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps client provided request IDs, longer ones are replaced
+const maxRequestIDLength = 128
+
+// logLevel orders log entries by severity
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+// parseLogLevel accepts the names written in the level field of every entry
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level '%s', expected one of debug, info, warn or error", name)
+}
+
+// Logger writes leveled entries as single line JSON objects
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  logLevel
+	fields []interface{}
+	now    func() time.Time
+}
+
+// NewLogger returns a Logger writing every entry at or above level to out
+func NewLogger(out io.Writer, level logLevel) *Logger {
+	return &Logger{
+		mu:    &sync.Mutex{},
+		out:   out,
+		level: level,
+		now:   time.Now,
+	}
+}
+
+// discardLogger is used by NotebookRepo objects built without a Logger
+var discardLogger = NewLogger(ioutil.Discard, levelError)
+
+// With returns a Logger adding keyvals, alternating keys and values, to
+// every entry it writes
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}(nil), l.fields...), keyvals...)
+	return &child
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.write(levelDebug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.write(levelInfo, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.write(levelWarn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.write(levelError, msg, keyvals) }
+
+// write renders an entry with the time, level and msg keys first followed
+// by the fields of the Logger and keyvals in order
+func (l *Logger) write(level logLevel, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	writeLogField(&buf, "time", l.now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(",")
+	writeLogField(&buf, "level", level.String())
+	buf.WriteString(",")
+	writeLogField(&buf, "msg", msg)
+
+	fields := append(append([]interface{}(nil), l.fields...), keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, nil)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteString(",")
+		writeLogField(&buf, fmt.Sprint(fields[i]), fields[i+1])
+	}
+	buf.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// writeLogField writes a JSON key/value pair, errors are written as their
+// message and values that cannot be marshalled fall back to fmt
+func writeLogField(buf *bytes.Buffer, key string, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	keyJSON, _ := json.Marshal(key)
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		valueJSON, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(keyJSON)
+	buf.WriteString(":")
+	buf.Write(valueJSON)
+}
+
+// contextKey namespaces the values stored in a request context
+type contextKey int
+
+const requestInfoKey contextKey = iota
+
+// requestInfo is shared by every middleware and handler serving a request,
+// inner middlewares such as authentication fill in the principal
+type requestInfo struct {
+	id        string
+	principal string
+	logger    *Logger
+}
+
+// getRequestInfo returns the requestInfo stored by the logging middleware
+func getRequestInfo(r *http.Request) (*requestInfo, bool) {
+	info, ok := r.Context().Value(requestInfoKey).(*requestInfo)
+	return info, ok
+}
+
+// setPrincipal records who a request was authenticated as
+func setPrincipal(r *http.Request, principal string) {
+	if info, ok := getRequestInfo(r); ok {
+		info.principal = principal
+	}
+}
+
+// anonymousPrincipal is recorded for requests that were not authenticated
+const anonymousPrincipal = "anonymous"
+
+// principal returns who a request was authenticated as, or anonymous
+func principal(r *http.Request) string {
+	if info, ok := getRequestInfo(r); ok && info.principal != "" {
+		return info.principal
+	}
+	return anonymousPrincipal
+}
+
+// log returns the Logger of the request being served, tagged with its
+// request ID, falling back to the Logger of the NotebookRepo
+func (n *NotebookRepo) log(r *http.Request) *Logger {
+	if info, ok := getRequestInfo(r); ok {
+		return info.logger
+	}
+	if n.logger == nil {
+		return discardLogger
+	}
+	return n.logger
+}
+
+// validRequestID rejects client provided IDs that would pollute the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// loggingMiddleware assigns every request an ID, taken from X-Request-ID
+// when the client provides a valid one, and writes an access log entry once
+// the request has been served
+func loggingMiddleware(logger *Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			id := r.Header.Get(requestIDHeader)
+			if !validRequestID(id) {
+				id = uuid.New().String()
+			}
+			info := &requestInfo{id: id, logger: logger.With("request_id", id)}
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+			w.Header().Set(requestIDHeader, id)
+
+			recorder := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			info.logger.Info("request served",
+				"method", r.Method,
+				"route", routeTemplate(r),
+				"status", recorder.status,
+				"latency_ms", float64(time.Since(start).Microseconds())/1000,
+				"bytes", recorder.size,
+				"principal", principal(r),
+				"remote_addr", r.RemoteAddr,
+			)
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// logEntries decodes every line written by a Logger
+func logEntries(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, levelInfo)
+	logger.now = func() time.Time { return time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+	logger.Debug("hidden")
+	logger.With("request_id", "id_1").Error("failed", "error", assert.AnError, "status", 400)
+
+	assert.Equal(t,
+		`{"time":"2020-06-01T12:00:00Z","level":"error","msg":"failed","request_id":"id_1","error":"`+assert.AnError.Error()+`","status":400}`+"\n",
+		out.String(),
+	)
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := parseLogLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, levelWarn, level)
+
+	_, err = parseLogLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	repo := NewNotebookRepo(NewLogger(&out, levelInfo))
+	router := newRouter(repo, newHealth(), defaultConfig())
+
+	t.Run("PropagatedRequestID", func(t *testing.T) {
+		out.Reset()
+		req := httptest.NewRequest("POST", "/notebook", bytes.NewBufferString(`{"name": "log_notebook"}`))
+		req.Header.Set(requestIDHeader, "client-id-1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, "client-id-1", w.Result().Header.Get(requestIDHeader))
+		entries := logEntries(t, &out)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, "request served", entries[0]["msg"])
+		assert.Equal(t, "client-id-1", entries[0]["request_id"])
+		assert.Equal(t, "/notebook", entries[0]["route"])
+		assert.Equal(t, float64(200), entries[0]["status"])
+		assert.Equal(t, "anonymous", entries[0]["principal"])
+		assert.Contains(t, entries[0], "latency_ms")
+	})
+	t.Run("GeneratedRequestID", func(t *testing.T) {
+		out.Reset()
+		req := httptest.NewRequest("GET", "/note", bytes.NewBufferString(`{"notebook_name": "missing", "id": "id_1"}`))
+		req.Header.Set(requestIDHeader, "not valid\n")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		// handler failures are logged without exiting the process
+		assert.Equal(t, 400, w.Result().StatusCode)
+		id := w.Result().Header.Get(requestIDHeader)
+		assert.Len(t, id, 36)
+		entries := logEntries(t, &out)
+		assert.Len(t, entries, 2)
+		assert.Equal(t, "error", entries[0]["level"])
+		assert.Equal(t, "Notebook with name 'missing' does not exist", entries[0]["msg"])
+		assert.Equal(t, id, entries[0]["request_id"])
+		assert.Equal(t, "info", entries[1]["level"])
+		assert.Equal(t, float64(400), entries[1]["status"])
+	})
+}
@@ -4,50 +4,176 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"time"
+	"syscall"
 
 	"github.com/gorilla/mux"
 )
 
+// newRouter registers every public route served by repo, logging each
+// request and recording it in the metrics exposed on /metrics
+func newRouter(repo *NotebookRepo, h *health, cfg *Config) *mux.Router {
+	r := mux.NewRouter()
+	m := newMetrics(repo)
+	r.Use(loggingMiddleware(repo.logger))
+	r.Use(clientCertMiddleware(cfg.API.TLS.AllowedPrincipals))
+	r.Use(m.middleware)
+	r.Use(newRateLimiter(cfg.Limits.RateLimit).middleware)
+	r.Use(maxBytesMiddleware(cfg.Limits.MaxRequestBytes))
+
+	r.HandleFunc("/note", repo.idempotent(repo.CreateNote)).Methods("POST")
+	r.HandleFunc("/note", repo.idempotent(repo.DeleteNote)).Methods("DELETE")
+	r.HandleFunc("/note", repo.GetNote).Methods("GET")
+	r.HandleFunc("/note", repo.idempotent(repo.UpdateNote)).Methods("UPDATE")
+	r.HandleFunc("/note/batch", repo.idempotent(repo.BatchCreateNotes)).Methods("POST")
+	r.HandleFunc("/note/batch", repo.idempotent(repo.BatchDeleteNotes)).Methods("DELETE")
+	r.HandleFunc("/note/batch", repo.BatchGetNotes).Methods("GET")
+	r.HandleFunc("/note/batch", repo.idempotent(repo.BatchUpdateNotes)).Methods("UPDATE")
+	r.HandleFunc("/note/attachment", repo.UploadAttachment).Methods("POST")
+	r.HandleFunc("/note/attachment", repo.DownloadAttachment).Methods("GET")
+	r.HandleFunc("/note/attachment", repo.DeleteAttachment).Methods("DELETE")
+	r.HandleFunc("/note/attachments", repo.ListAttachments).Methods("GET")
+	r.HandleFunc("/note/template", repo.idempotent(repo.CreateNoteFromTemplate)).Methods("POST")
+	r.HandleFunc("/note/checklist", repo.GetChecklist).Methods("GET")
+	r.HandleFunc("/note/checklist", repo.idempotent(repo.ToggleChecklistItem)).Methods("UPDATE")
+	r.HandleFunc("/note/pin", repo.idempotent(repo.PinNote)).Methods("UPDATE")
+	r.HandleFunc("/note/archive", repo.idempotent(repo.ArchiveNote)).Methods("UPDATE")
+	r.HandleFunc("/note/star", repo.idempotent(repo.StarNote)).Methods("UPDATE")
+	r.HandleFunc("/note/links", repo.GetOutgoingLinks).Methods("GET")
+	r.HandleFunc("/note/backlinks", repo.GetBacklinks).Methods("GET")
+	r.HandleFunc("/tag", repo.ListTags).Methods("GET")
+	r.HandleFunc("/tag", repo.DeleteTag).Methods("DELETE")
+	r.HandleFunc("/tag/rename", repo.RenameTag).Methods("POST")
+	r.HandleFunc("/tag/merge", repo.MergeTags).Methods("POST")
+	r.HandleFunc("/template", repo.idempotent(repo.CreateTemplate)).Methods("POST")
+	r.HandleFunc("/template", repo.idempotent(repo.DeleteTemplate)).Methods("DELETE")
+	r.HandleFunc("/template", repo.GetTemplate).Methods("GET")
+	r.HandleFunc("/template", repo.idempotent(repo.UpdateTemplate)).Methods("UPDATE")
+	r.HandleFunc("/notebook", repo.idempotent(repo.CreateNotebook)).Methods("POST")
+	r.HandleFunc("/notebook", repo.GetNotebook).Methods("GET")
+	r.HandleFunc("/notebook/usage", repo.GetUsage).Methods("GET")
+	r.HandleFunc("/notebook/templates", repo.ListTemplates).Methods("GET")
+	r.HandleFunc("/notebook/schema", repo.GetPropertySchema).Methods("GET")
+	r.HandleFunc("/notebook/schema", repo.idempotent(repo.SetPropertySchema)).Methods("POST")
+	r.HandleFunc("/notebook/due", repo.ListDueNotes).Methods("GET")
+	r.HandleFunc("/notebook/reminders/events", repo.ListReminderEvents).Methods("GET")
+	r.HandleFunc("/notebook/links/dangling", repo.ListDanglingLinks).Methods("GET")
+	r.HandleFunc("/notebook/export", repo.ExportNotebook).Methods("GET")
+	r.HandleFunc("/notebook/graph", repo.ExportGraph).Methods("GET")
+	r.HandleFunc("/notebook/import", repo.ImportNotebook).Methods("POST")
+	r.HandleFunc("/query", repo.QueryNotes).Methods("GET")
+	r.HandleFunc("/import", repo.CreateImportJob).Methods("POST")
+	r.HandleFunc("/import", repo.GetImportJob).Methods("GET")
+	r.Handle("/metrics", m).Methods("GET")
+	r.HandleFunc("/healthz", h.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", h.Readyz).Methods("GET")
+	return r
+}
+
 func main() {
-	var wait time.Duration
-	flag.DurationVar(&wait, "graceful-timeout", time.Second*15,
-		"the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
-	flag.Parse()
-
-	port := os.Getenv("NTBK_PORT")
-	if port == "" {
-		// default port entry
-		port = "8080"
+	cfg, printConfig, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		out, err := cfg.redactedYAML()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(out)
+		os.Exit(0)
 	}
-	addr := fmt.Sprintf("0.0.0.0:%s", port)
 
-	log.Println(fmt.Sprintf("Starting notebook server on %s", addr))
-	r := mux.NewRouter()
-	repo := NewNotebookRepo()
+	// validated by loadConfig
+	level, _ := parseLogLevel(cfg.Log.Level)
+	logger := NewLogger(os.Stderr, level)
+
+	logger.Info("Starting notebook server", "addr", cfg.API.Addr, "storage", cfg.Storage.Backend)
+	h := newHealth()
+	repo := NewNotebookRepo(logger)
+	repo.quota = cfg.Limits.Quota
+	repo.maxBatchSize = cfg.Limits.MaxBatchSize
+	repo.idempotency.ttl = cfg.API.IdempotencyTTL
+	repo.blobs = newBlobStore(cfg.Storage.AttachmentsDir)
+	repo.maxAttachmentBytes = cfg.Limits.MaxAttachmentBytes
+	repo.scheduler.interval = cfg.Reminders.Interval
+	repo.scheduler.webhookURL = cfg.Reminders.WebhookURL
+	r := newRouter(repo, h, cfg)
 
 	srv := &http.Server{
 		Handler:      r,
-		Addr:         addr,
-		WriteTimeout: 2 * time.Second,
-		ReadTimeout:  2 * time.Second,
+		Addr:         cfg.API.Addr,
+		WriteTimeout: cfg.API.WriteTimeout,
+		ReadTimeout:  cfg.API.ReadTimeout,
 	}
+	servers := []*http.Server{srv}
 
-	r.HandleFunc("/note", repo.CreateNote).Methods("POST")
-	r.HandleFunc("/note", repo.DeleteNote).Methods("DELETE")
-	r.HandleFunc("/note", repo.GetNote).Methods("GET")
-	r.HandleFunc("/note", repo.UpdateNote).Methods("UPDATE")
-	r.HandleFunc("/notebook", repo.CreateNotebook).Methods("POST")
-	r.HandleFunc("/notebook", repo.GetNotebook).Methods("GET")
+	var certs *certReloader
+	if cfg.API.TLS.enabled() {
+		certs, err = newCertReloader(cfg.API.TLS)
+		if err != nil {
+			logger.Error("Unable to configure TLS", "error", err)
+			os.Exit(1)
+		}
+		srv.TLSConfig = certs.tlsConfig()
+		logger.Info("Serving HTTPS", "client_auth", cfg.API.TLS.ClientAuth)
+	}
+
+	// the admin listener stays off the public port so that it can be
+	// firewalled separately
+	if cfg.Admin.Addr != "" {
+		if cfg.Admin.Token == "" {
+			logger.Warn("admin.token is not set, every /admin request will be refused")
+		}
+		logger.Info("Starting admin server", "addr", cfg.Admin.Addr, "pprof", cfg.Admin.Pprof)
+		servers = append(servers, &http.Server{
+			Handler:     newAdminRouter(repo, h, cfg.Admin),
+			Addr:        cfg.Admin.Addr,
+			ReadTimeout: cfg.API.ReadTimeout,
+		})
+	}
 
-	// Run our server in a goroutine so that it doesn't block.
+	// Run our servers in goroutines so that they don't block.
+	for _, s := range servers {
+		go func(s *http.Server) {
+			serve := s.ListenAndServe
+			if s.TLSConfig != nil {
+				// certificates are served by the TLSConfig of certs
+				serve = func() error { return s.ListenAndServeTLS("", "") }
+			}
+			if err := serve(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Server stopped unexpectedly", "addr", s.Addr, "error", err)
+			}
+		}(s)
+	}
+
+	// the store lives in memory so it is loaded as soon as it is created
+	h.setReady(true)
+
+	stopReminders := make(chan struct{})
+	go repo.scheduler.run(stopReminders)
+
+	// SIGHUP reloads certificates for new handshakes, established
+	// connections keep the ones they negotiated
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+		for range hup {
+			if certs == nil {
+				continue
+			}
+			if err := certs.reload(); err != nil {
+				logger.Error("Unable to reload TLS certificates, keeping the previous ones", "error", err)
+				continue
+			}
+			logger.Info("Reloaded TLS certificates")
 		}
 	}()
 
@@ -59,15 +185,21 @@ func main() {
 	// Block until we receive our signal.
 	<-c
 
+	// stop receiving new traffic while in flight requests drain
+	h.setReady(false)
+
 	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.API.GracefulTimeout)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
-	srv.Shutdown(ctx)
+	for _, s := range servers {
+		s.Shutdown(ctx)
+	}
+	close(stopReminders)
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
-	log.Println("shutting down")
+	logger.Info("shutting down")
 	os.Exit(0)
 }
@@ -0,0 +1,927 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxMarkdownDepth bounds the nesting of block quotes and lists, deeper
+// content is rendered as paragraphs
+const maxMarkdownDepth = 16
+
+var (
+	listMarkerPattern = regexp.MustCompile(`^( {0,3})([-*+]|(\d{1,9})([.)]))( +|$)`)
+	taskPattern       = regexp.MustCompile(`^\[([ xX])\](?: +|$)`)
+	autolinkPattern   = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^<>\s]*)>`)
+	emailPattern      = regexp.MustCompile(`^<([^\s<>@]+@[^\s<>@]+)>`)
+	wikiLinkPattern   = regexp.MustCompile(`^` + titleLinkPattern.String())
+)
+
+// markdownRenderer renders Markdown to HTML, escaping any HTML the source
+// holds and dropping links to unsafe URLs
+type markdownRenderer struct {
+	// resolve returns the URL and title of the note link points to, the URL
+	// being empty when the link is dangling
+	resolve func(link noteLink) (href, title string)
+	// checkbox is written at the start of the next paragraph, holding the
+	// box of a task list item
+	checkbox string
+}
+
+// render returns the HTML rendering of body
+func (m *markdownRenderer) render(body string) string {
+	body = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\x00", "�").Replace(body)
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = expandTabs(line)
+	}
+	var buf bytes.Buffer
+	m.blocks(&buf, lines, false, 0)
+	return buf.String()
+}
+
+// expandTabs replaces the tabs indenting line with spaces, up to the next
+// multiple of 4 columns
+func expandTabs(line string) string {
+	var indent strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			indent.WriteByte(' ')
+		case '\t':
+			indent.WriteString(strings.Repeat(" ", 4-indent.Len()%4))
+		default:
+			return indent.String() + line[i:]
+		}
+	}
+	return indent.String()
+}
+
+// cr starts a new line unless buf is empty or already at one
+func cr(buf *bytes.Buffer) {
+	if buf.Len() != 0 && buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// fence returns the backticks or tildes opening a fenced code block along
+// with its info string
+func fence(line string) (marker, info string, ok bool) {
+	if indentOf(line) > 3 {
+		return "", "", false
+	}
+	trimmed := strings.TrimLeft(line, " ")
+	if !strings.HasPrefix(trimmed, "```") && !strings.HasPrefix(trimmed, "~~~") {
+		return "", "", false
+	}
+	n := len(trimmed) - len(strings.TrimLeft(trimmed, trimmed[:1]))
+	info = strings.TrimSpace(trimmed[n:])
+	if trimmed[0] == '`' && strings.Contains(info, "`") {
+		return "", "", false
+	}
+	return trimmed[:n], info, true
+}
+
+// heading returns the level and text of an ATX heading
+func heading(line string) (int, string) {
+	if indentOf(line) > 3 {
+		return 0, ""
+	}
+	trimmed := strings.TrimLeft(line, " ")
+	level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+	if level == 0 || level > 6 {
+		return 0, ""
+	}
+	text := trimmed[level:]
+	if text != "" && text[0] != ' ' {
+		return 0, ""
+	}
+	text = strings.TrimSpace(text)
+	if closed := strings.TrimRight(text, "#"); closed == "" || strings.HasSuffix(closed, " ") {
+		text = strings.TrimSpace(closed)
+	}
+	return level, text
+}
+
+// isThematicBreak reports whether line is made of 3 or more -, * or _
+func isThematicBreak(line string) bool {
+	if indentOf(line) > 3 {
+		return false
+	}
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || !strings.ContainsAny(trimmed[:1], "-*_") {
+		return false
+	}
+	count := 0
+	for _, c := range trimmed {
+		switch {
+		case byte(c) == trimmed[0]:
+			count++
+		case c != ' ':
+			return false
+		}
+	}
+	return count >= 3
+}
+
+// setextLevel returns the level of the heading underlined by line, or 0
+func setextLevel(line string) int {
+	if indentOf(line) > 3 {
+		return 0
+	}
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case trimmed != "" && strings.Trim(trimmed, "=") == "":
+		return 1
+	case trimmed != "" && strings.Trim(trimmed, "-") == "":
+		return 2
+	}
+	return 0
+}
+
+func isBlockQuote(line string) bool {
+	return indentOf(line) <= 3 && strings.HasPrefix(strings.TrimLeft(line, " "), ">")
+}
+
+// listItem is the marker opening a list item
+type listItem struct {
+	ordered bool
+	// delim is the bullet character of unordered lists, and the character
+	// following the number of ordered ones
+	delim byte
+	start int
+	// width is the indentation of the content of the item
+	width int
+	empty bool
+}
+
+func parseListItem(line string) (listItem, bool) {
+	m := listMarkerPattern.FindStringSubmatch(line)
+	if m == nil {
+		return listItem{}, false
+	}
+	item := listItem{delim: m[2][0], empty: isBlank(line[len(m[0]):])}
+	if m[3] != "" {
+		item.ordered = true
+		item.delim = m[4][0]
+		item.start, _ = strconv.Atoi(m[3])
+	}
+	spaces := len(m[5])
+	if spaces == 0 || spaces > 4 || item.empty {
+		spaces = 1
+	}
+	item.width = len(m[1]) + len(m[2]) + spaces
+	return item, true
+}
+
+// interrupts reports whether line starts a block ending a paragraph
+func interrupts(line string) bool {
+	if _, _, ok := fence(line); ok {
+		return true
+	}
+	if level, _ := heading(line); level != 0 {
+		return true
+	}
+	if item, ok := parseListItem(line); ok {
+		return !item.empty && (!item.ordered || item.start == 1)
+	}
+	return isThematicBreak(line) || isBlockQuote(line)
+}
+
+// blocks renders lines as a sequence of blocks, paragraphs being written
+// without <p> in tight lists
+func (m *markdownRenderer) blocks(buf *bytes.Buffer, lines []string, tight bool, depth int) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		_, _, fenced := fence(line)
+		item, listed := parseListItem(line)
+		level, text := heading(line)
+		switch {
+		case isBlank(line):
+			i++
+		case fenced:
+			i = m.fencedCode(buf, lines, i)
+		case level != 0:
+			cr(buf)
+			tag := "h" + strconv.Itoa(level)
+			buf.WriteString("<" + tag + ">")
+			m.inline(buf, text)
+			buf.WriteString("</" + tag + ">\n")
+			i++
+		case isThematicBreak(line):
+			cr(buf)
+			buf.WriteString("<hr />\n")
+			i++
+		case isBlockQuote(line) && depth < maxMarkdownDepth:
+			i = m.blockQuote(buf, lines, i, depth)
+		case listed && depth < maxMarkdownDepth:
+			i = m.list(buf, lines, i, item, depth)
+		case indentOf(line) >= 4:
+			i = m.indentedCode(buf, lines, i)
+		default:
+			i = m.paragraph(buf, lines, i, tight)
+		}
+	}
+}
+
+func (m *markdownRenderer) fencedCode(buf *bytes.Buffer, lines []string, i int) int {
+	marker, info, _ := fence(lines[i])
+	indent := indentOf(lines[i])
+	cr(buf)
+	buf.WriteString("<pre><code")
+	if fields := strings.Fields(info); len(fields) != 0 {
+		buf.WriteString(` class="language-` + html.EscapeString(fields[0]) + `"`)
+	}
+	buf.WriteString(">")
+	for i++; i < len(lines); i++ {
+		line := lines[i]
+		if indentOf(line) <= 3 {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, marker) && strings.Trim(trimmed, marker[:1]) == "" {
+				i++
+				break
+			}
+		}
+		strip := indentOf(line)
+		if strip > indent {
+			strip = indent
+		}
+		buf.WriteString(html.EscapeString(line[strip:]) + "\n")
+	}
+	buf.WriteString("</code></pre>\n")
+	return i
+}
+
+func (m *markdownRenderer) indentedCode(buf *bytes.Buffer, lines []string, i int) int {
+	var code []string
+	for ; i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) >= 4); i++ {
+		if len(lines[i]) >= 4 {
+			code = append(code, lines[i][4:])
+		} else {
+			code = append(code, "")
+		}
+	}
+	for len(code) != 0 && isBlank(code[len(code)-1]) {
+		code = code[:len(code)-1]
+	}
+	cr(buf)
+	buf.WriteString("<pre><code>")
+	for _, line := range code {
+		buf.WriteString(html.EscapeString(line) + "\n")
+	}
+	buf.WriteString("</code></pre>\n")
+	return i
+}
+
+func (m *markdownRenderer) blockQuote(buf *bytes.Buffer, lines []string, i, depth int) int {
+	var quoted []string
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if isBlockQuote(line) {
+			line = strings.TrimPrefix(strings.TrimLeft(line, " "), ">")
+			quoted = append(quoted, strings.TrimPrefix(line, " "))
+			continue
+		}
+		// lazy continuation lines extend the quoted paragraph
+		if len(quoted) == 0 || isBlank(quoted[len(quoted)-1]) || isBlank(line) || interrupts(line) {
+			break
+		}
+		quoted = append(quoted, line)
+	}
+	cr(buf)
+	buf.WriteString("<blockquote>\n")
+	m.blocks(buf, quoted, false, depth+1)
+	cr(buf)
+	buf.WriteString("</blockquote>\n")
+	return i
+}
+
+func (m *markdownRenderer) list(buf *bytes.Buffer, lines []string, i int, first listItem, depth int) int {
+	var items [][]string
+	tight := true
+	for i < len(lines) {
+		item, ok := parseListItem(lines[i])
+		if !ok || item.ordered != first.ordered || item.delim != first.delim {
+			break
+		}
+		content := []string{lines[i][min(item.width, len(lines[i])):]}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if isBlank(line) {
+				j := i
+				for j < len(lines) && isBlank(lines[j]) {
+					j++
+				}
+				if j == len(lines) || indentOf(lines[j]) < item.width {
+					break
+				}
+				// a blank line between blocks of the item makes the list loose
+				if indentOf(lines[j]) == item.width {
+					tight = false
+				}
+				for ; i < j; i++ {
+					content = append(content, "")
+				}
+				line = lines[i]
+			}
+			if indentOf(line) >= item.width {
+				content = append(content, line[item.width:])
+				continue
+			}
+			// lazy continuation lines extend the paragraph of the item
+			if _, ok := parseListItem(line); ok || isBlank(content[len(content)-1]) || interrupts(line) {
+				break
+			}
+			content = append(content, line)
+		}
+		items = append(items, content)
+
+		j := i
+		for j < len(lines) && isBlank(lines[j]) {
+			j++
+		}
+		if next, ok := parseListItem(safeLine(lines, j)); !ok || next.ordered != first.ordered || next.delim != first.delim {
+			break
+		}
+		if j != i {
+			tight = false
+		}
+		i = j
+	}
+
+	tag := "ul"
+	if first.ordered {
+		tag = "ol"
+	}
+	cr(buf)
+	buf.WriteString("<" + tag)
+	if first.ordered && first.start != 1 {
+		buf.WriteString(` start="` + strconv.Itoa(first.start) + `"`)
+	}
+	buf.WriteString(">\n")
+	for _, content := range items {
+		m.listItem(buf, content, tight, depth)
+	}
+	buf.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func (m *markdownRenderer) listItem(buf *bytes.Buffer, content []string, tight bool, depth int) {
+	task := taskPattern.FindStringSubmatch(content[0])
+	if task == nil {
+		buf.WriteString("<li>")
+		m.blocks(buf, content, tight, depth+1)
+		buf.WriteString("</li>\n")
+		return
+	}
+	checkbox := `<input type="checkbox" disabled="" /> `
+	if task[1] != " " {
+		checkbox = `<input type="checkbox" checked="" disabled="" /> `
+	}
+	buf.WriteString(`<li class="task-list-item">`)
+	content = append([]string{content[0][len(task[0]):]}, content[1:]...)
+	if isBlank(content[0]) {
+		buf.WriteString(strings.TrimSpace(checkbox))
+	} else {
+		m.checkbox = checkbox
+	}
+	m.blocks(buf, content, tight, depth+1)
+	m.checkbox = ""
+	buf.WriteString("</li>\n")
+}
+
+func safeLine(lines []string, i int) string {
+	if i < len(lines) {
+		return lines[i]
+	}
+	return ""
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (m *markdownRenderer) paragraph(buf *bytes.Buffer, lines []string, i int, tight bool) int {
+	text := []string{strings.TrimLeft(lines[i], " ")}
+	level := 0
+	for i++; i < len(lines); i++ {
+		line := lines[i]
+		if level = setextLevel(line); level != 0 {
+			i++
+			break
+		}
+		if isBlank(line) || interrupts(line) {
+			break
+		}
+		text = append(text, strings.TrimLeft(line, " "))
+	}
+	joined := strings.TrimRight(strings.Join(text, "\n"), " ")
+
+	if level != 0 {
+		cr(buf)
+		tag := "h" + strconv.Itoa(level)
+		buf.WriteString("<" + tag + ">")
+		m.inline(buf, joined)
+		buf.WriteString("</" + tag + ">\n")
+		return i
+	}
+	if !tight {
+		cr(buf)
+		buf.WriteString("<p>")
+	}
+	buf.WriteString(m.checkbox)
+	m.checkbox = ""
+	m.inline(buf, joined)
+	if !tight {
+		buf.WriteString("</p>\n")
+	}
+	return i
+}
+
+// safeURL returns raw when it is relative or uses a scheme allowed for
+// links, or images when image is set
+func safeURL(raw string, image bool) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https":
+		return raw, true
+	case "mailto":
+		return raw, !image
+	}
+	return "", false
+}
+
+// inlineState remembers the delimiters found to have no closer, sparing
+// the renderer from scanning for them again. budget bounds the bytes
+// scanned looking for closers and depth the nesting of spans, keeping
+// rendering linear on hostile input
+type inlineState struct {
+	unclosed map[string]bool
+	budget   int
+	depth    int
+}
+
+// inline renders the inline content of s
+func (m *markdownRenderer) inline(buf *bytes.Buffer, s string) {
+	m.inlineSpans(buf, s, &inlineState{unclosed: make(map[string]bool), budget: 16*len(s) + 1024})
+}
+
+// nested renders the content of a span, as text once spans nest too deep
+func (m *markdownRenderer) nested(buf *bytes.Buffer, s string, state *inlineState) {
+	if state.depth >= maxMarkdownDepth {
+		buf.WriteString(html.EscapeString(s))
+		return
+	}
+	state.depth++
+	m.inlineSpans(buf, s, state)
+	state.depth--
+}
+
+func isPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("$+<=>^`|~", c) >= 0
+}
+
+func isSpaceAt(s string, i int) bool {
+	if i < 0 || i >= len(s) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	return unicode.IsSpace(r)
+}
+
+func isAlnumAt(s string, i int) bool {
+	if i < 0 || i >= len(s) {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	if i > 0 && r == utf8.RuneError {
+		r, _ = utf8.DecodeLastRuneInString(s[:i+1])
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (m *markdownRenderer) inlineSpans(buf *bytes.Buffer, s string, state *inlineState) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			buf.WriteString("<br />\n")
+			i += 2
+		case c == '\\' && i+1 < len(s) && isPunct(s[i+1]):
+			buf.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+		case c == ' ':
+			j := i
+			for j < len(s) && s[j] == ' ' {
+				j++
+			}
+			switch {
+			case j < len(s) && s[j] == '\n' && j-i >= 2:
+				buf.WriteString("<br />\n")
+				i = j + 1
+			case j < len(s) && s[j] == '\n':
+				i = j
+			default:
+				buf.WriteString(s[i:j])
+				i = j
+			}
+		case c == '`':
+			i = m.codeSpan(buf, s, i, state)
+		case c == '[' && strings.HasPrefix(s[i:], "[["):
+			i = m.wikiLink(buf, s, i)
+		case c == '[' || c == '!' && strings.HasPrefix(s[i:], "!["):
+			i = m.link(buf, s, i, state)
+		case c == '<':
+			i = m.autolink(buf, s, i)
+		case c == 'n' && strings.HasPrefix(s[i:], "note://") && !isAlnumAt(s, i-1):
+			i = m.idLink(buf, s, i)
+		case c == '*' || c == '_':
+			i = m.emphasis(buf, s, i, state)
+		default:
+			_, size := utf8.DecodeRuneInString(s[i:])
+			buf.WriteString(html.EscapeString(s[i : i+size]))
+			i += size
+		}
+	}
+}
+
+func (m *markdownRenderer) codeSpan(buf *bytes.Buffer, s string, i int, state *inlineState) int {
+	n := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+	marker := s[i : i+n]
+	if !state.unclosed[marker] {
+		for j := i + n; j < len(s); {
+			k := strings.Index(s[j:], marker)
+			if k < 0 {
+				break
+			}
+			j += k
+			run := len(s[j:]) - len(strings.TrimLeft(s[j:], "`"))
+			if run == n {
+				code := strings.Replace(s[i+n:j], "\n", " ", -1)
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+					code = code[1 : len(code)-1]
+				}
+				buf.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				return j + n
+			}
+			j += run
+		}
+		state.unclosed[marker] = true
+	}
+	buf.WriteString(marker)
+	return i + n
+}
+
+func (m *markdownRenderer) wikiLink(buf *bytes.Buffer, s string, i int) int {
+	match := wikiLinkPattern.FindStringSubmatchIndex(s[i:])
+	if match == nil || strings.TrimSpace(s[i+match[2]:i+match[3]]) == "" {
+		buf.WriteString("[")
+		return i + 1
+	}
+	target := strings.TrimSpace(s[i+match[2] : i+match[3]])
+	label := target
+	if match[4] >= 0 {
+		if l := strings.TrimSpace(s[i+match[4]+1 : i+match[5]]); l != "" {
+			label = l
+		}
+	}
+	href, _ := m.resolve(noteLink{kind: linkTitle, target: target})
+	m.noteAnchor(buf, href, label)
+	return i + match[1]
+}
+
+func (m *markdownRenderer) idLink(buf *bytes.Buffer, s string, i int) int {
+	match := idLinkPattern.FindStringSubmatchIndex(s[i:])
+	if match == nil || match[0] != 0 {
+		buf.WriteString("n")
+		return i + 1
+	}
+	href, title := m.resolve(noteLink{kind: linkID, target: s[i+match[2] : i+match[3]]})
+	if title == "" {
+		title = s[i : i+match[1]]
+	}
+	m.noteAnchor(buf, href, title)
+	return i + match[1]
+}
+
+// noteAnchor writes a link to a note, dangling links being written as
+// spans
+func (m *markdownRenderer) noteAnchor(buf *bytes.Buffer, href, label string) {
+	if href == "" {
+		buf.WriteString(`<span class="note-link dangling">` + html.EscapeString(label) + `</span>`)
+		return
+	}
+	buf.WriteString(`<a class="note-link" href="` + html.EscapeString(href) + `">` + html.EscapeString(label) + `</a>`)
+}
+
+// closingBracket returns the index of the ] closing the [ at i, or -1
+func closingBracket(s string, i int, state *inlineState) int {
+	depth := 0
+	for j := i; j < len(s) && state.budget > 0; j++ {
+		state.budget--
+		switch s[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// linkDestination parses the (destination "title") following a link text
+// at i, returning the index following it or -1
+func linkDestination(s string, i int) (dest, title string, end int) {
+	if i >= len(s) || s[i] != '(' {
+		return "", "", -1
+	}
+	j := i + 1
+	for j < len(s) && isSpaceAt(s, j) {
+		j++
+	}
+	if j < len(s) && s[j] == '<' {
+		k := strings.IndexAny(s[j:], ">\n")
+		if k < 0 || s[j+k] != '>' {
+			return "", "", -1
+		}
+		dest = s[j+1 : j+k]
+		j += k + 1
+	} else {
+		start, parens := j, 0
+		for ; j < len(s) && !isSpaceAt(s, j); j++ {
+			if s[j] == '(' {
+				parens++
+			} else if s[j] == ')' {
+				if parens == 0 {
+					break
+				}
+				parens--
+			}
+		}
+		dest = s[start:j]
+	}
+	k := j
+	for k < len(s) && isSpaceAt(s, k) {
+		k++
+	}
+	if k < len(s) && k > j && strings.IndexByte(`"'(`, s[k]) >= 0 {
+		closer := s[k]
+		if closer == '(' {
+			closer = ')'
+		}
+		e := strings.IndexByte(s[k+1:], closer)
+		if e < 0 {
+			return "", "", -1
+		}
+		title = s[k+1 : k+1+e]
+		k += e + 2
+		for k < len(s) && isSpaceAt(s, k) {
+			k++
+		}
+	}
+	if k >= len(s) || s[k] != ')' {
+		return "", "", -1
+	}
+	return dest, title, k + 1
+}
+
+func (m *markdownRenderer) link(buf *bytes.Buffer, s string, i int, state *inlineState) int {
+	image := s[i] == '!'
+	open := i
+	if image {
+		open++
+	}
+	closing := -1
+	if !state.unclosed["["] {
+		if closing = closingBracket(s, open, state); closing < 0 {
+			state.unclosed["["] = true
+		}
+	}
+	dest, title, end := "", "", -1
+	if closing >= 0 {
+		dest, title, end = linkDestination(s, closing+1)
+	}
+	if end < 0 {
+		buf.WriteString(s[i : open+1])
+		return open + 1
+	}
+	text := s[open+1 : closing]
+
+	if image {
+		src, ok := safeURL(dest, true)
+		if !ok {
+			buf.WriteString(html.EscapeString(text))
+			return end
+		}
+		buf.WriteString(`<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(text) + `"`)
+		if title != "" {
+			buf.WriteString(` title="` + html.EscapeString(title) + `"`)
+		}
+		buf.WriteString(" />")
+		return end
+	}
+
+	href, ok := safeURL(dest, false)
+	class := ""
+	if match := idLinkPattern.FindStringSubmatch(dest); match != nil && match[0] == dest {
+		href, _ = m.resolve(noteLink{kind: linkID, target: match[1]})
+		ok, class = href != "", "note-link"
+		if !ok {
+			buf.WriteString(`<span class="note-link dangling">`)
+			m.nested(buf, text, state)
+			buf.WriteString(`</span>`)
+			return end
+		}
+	}
+	if !ok {
+		m.nested(buf, text, state)
+		return end
+	}
+	buf.WriteString("<a")
+	if class != "" {
+		buf.WriteString(` class="` + class + `"`)
+	}
+	buf.WriteString(` href="` + html.EscapeString(href) + `"`)
+	if title != "" {
+		buf.WriteString(` title="` + html.EscapeString(title) + `"`)
+	}
+	buf.WriteString(">")
+	m.nested(buf, text, state)
+	buf.WriteString("</a>")
+	return end
+}
+
+func (m *markdownRenderer) autolink(buf *bytes.Buffer, s string, i int) int {
+	if match := autolinkPattern.FindStringSubmatch(s[i:]); match != nil {
+		if href, ok := safeURL(match[1], false); ok {
+			buf.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(match[1]) + `</a>`)
+			return i + len(match[0])
+		}
+	}
+	if match := emailPattern.FindStringSubmatch(s[i:]); match != nil {
+		buf.WriteString(`<a href="mailto:` + html.EscapeString(match[1]) + `">` + html.EscapeString(match[1]) + `</a>`)
+		return i + len(match[0])
+	}
+	buf.WriteString("&lt;")
+	return i + 1
+}
+
+// delimiterRun returns the length of the run of s[i] starting at i
+func delimiterRun(s string, i int) int {
+	return len(s[i:]) - len(strings.TrimLeft(s[i:], s[i:i+1]))
+}
+
+// canOpen and canClose report whether the delimiter run at i of length n
+// opens or closes emphasis, underscores not doing so inside words
+func canOpen(s string, i, n int) bool {
+	return !isSpaceAt(s, i+n) && (s[i] == '*' || !isAlnumAt(s, i-1))
+}
+
+func canClose(s string, i, n int) bool {
+	return !isSpaceAt(s, i-1) && (s[i] == '*' || !isAlnumAt(s, i+n))
+}
+
+// emphasisCloser returns the index of the run closing emphasis opened by
+// n delimiters at i, along with its length, skipping over code spans and
+// nested emphasis
+func emphasisCloser(s string, i, n int, state *inlineState, depth int) (int, int) {
+	c := s[i]
+	for j := i + n; j < len(s); state.budget-- {
+		if state.budget <= 0 {
+			return -1, 0
+		}
+		switch s[j] {
+		case '\\':
+			j += 2
+			continue
+		case '`':
+			run := delimiterRun(s, j)
+			if k := strings.Index(s[j+run:], s[j:j+run]); k >= 0 {
+				j += run + k + run
+			} else {
+				j += run
+			}
+			continue
+		case c:
+		default:
+			j++
+			continue
+		}
+		run := delimiterRun(s, j)
+		closes := canClose(s, j, run)
+		switch {
+		case closes && (run >= n || run == 1 && n == 3 || n == 1):
+			return j, run
+		case canOpen(s, j, run) && depth < maxMarkdownDepth:
+			// a nested run of another length is skipped along with its closer
+			if k, r := emphasisCloser(s, j, run, state, depth+1); k >= 0 {
+				j = k + r
+				continue
+			}
+		}
+		j += run
+	}
+	return -1, 0
+}
+
+func (m *markdownRenderer) emphasis(buf *bytes.Buffer, s string, i int, state *inlineState) int {
+	n := delimiterRun(s, i)
+	key := s[i : i+n]
+	if !canOpen(s, i, n) || state.unclosed[key] {
+		buf.WriteString(key)
+		return i + n
+	}
+	j, run := emphasisCloser(s, i, n, state, 0)
+	if j < 0 {
+		state.unclosed[key] = true
+		buf.WriteString(key)
+		return i + n
+	}
+
+	// the shortest of the opening and closing runs is used, the rest of the
+	// opening run being written as is
+	used := n
+	if run < used {
+		used = run
+	}
+	if used > 3 {
+		used = 3
+	}
+	buf.WriteString(s[i : i+n-used])
+	inner := s[i+n : j]
+	switch used {
+	case 1:
+		buf.WriteString("<em>")
+		m.nested(buf, inner, state)
+		buf.WriteString("</em>")
+	case 2:
+		buf.WriteString("<strong>")
+		m.nested(buf, inner, state)
+		buf.WriteString("</strong>")
+	default:
+		buf.WriteString("<em><strong>")
+		m.nested(buf, inner, state)
+		buf.WriteString("</strong></em>")
+	}
+	return j + used
+}
+
+// noteURL returns the URL GetNote serves the note with id at
+func noteURL(notebookName, id string) string {
+	return "/note?" + url.Values{"notebook_name": {notebookName}, "id": {id}}.Encode()
+}
+
+// renderHTML renders the body of note, the notebook being named name, with
+// links to other notes pointing to their noteURL
+func (nb Notebook) renderHTML(name string, note *Note) string {
+	graph := nb.linkGraph()
+	m := &markdownRenderer{resolve: func(link noteLink) (string, string) {
+		ids := graph.resolve(link)
+		if len(ids) == 0 {
+			return "", ""
+		}
+		return noteURL(name, ids[0]), nb.notes[ids[0]].GetTitle()
+	}}
+	return m.render(note.GetBody())
+}
+
+// acceptsHTML reports whether r accepts text/html ahead of JSON
+func acceptsHTML(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(accepted)
+		switch mediaType {
+		case "text/html":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
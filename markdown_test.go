@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+func newMarkdownRepo() *NotebookRepo {
+	return newTestRepo("md_notebook",
+		&Note{Id: "id_1", Title: "Design", Body: "# Design\n\nsee [[Roadmap]]"},
+		&Note{Id: "id_2", Title: "Roadmap", Body: "<b>bold</b>"},
+	)
+}
+
+func TestMarkdownGolden(t *testing.T) {
+	notebook := newMarkdownRepo().notebooks["md_notebook"]
+	sources, err := filepath.Glob(filepath.Join("testdata", "markdown", "*.md"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, sources)
+
+	for _, source := range sources {
+		source := source
+		t.Run(filepath.Base(source), func(t *testing.T) {
+			body, err := ioutil.ReadFile(source)
+			assert.NoError(t, err)
+			rendered := notebook.renderHTML("md_notebook", &Note{Body: string(body)})
+
+			golden := strings.TrimSuffix(source, ".md") + ".html"
+			if *updateGolden {
+				assert.NoError(t, ioutil.WriteFile(golden, []byte(rendered), 0644))
+			}
+			expected, err := ioutil.ReadFile(golden)
+			assert.NoError(t, err)
+			assert.Equal(t, string(expected), rendered)
+		})
+	}
+}
+
+func TestMarkdownHostileInput(t *testing.T) {
+	m := &markdownRenderer{resolve: func(noteLink) (string, string) { return "", "" }}
+	for _, body := range []string{
+		strings.Repeat("*a ", 20000),
+		strings.Repeat("**a *b ", 20000),
+		strings.Repeat("[", 20000) + strings.Repeat("](u)", 20000),
+		strings.Repeat("> ", 20000) + "deep",
+		strings.Repeat("`", 20000),
+	} {
+		rendered := m.render(body)
+		assert.NotContains(t, rendered, "<script")
+		assert.NotEmpty(t, rendered)
+	}
+}
+
+func TestGetNoteHTML(t *testing.T) {
+	request := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		newRouter(newMarkdownRepo(), newHealth(), defaultConfig()).ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("RenderHTML", func(t *testing.T) {
+		w := request("GET", "/note", `{"notebook_name": "md_notebook", "id": "id_1", "render_html": true}`)
+		assert.Equal(t, 200, w.Code)
+		result := &GetNoteResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Equal(t, "# Design\n\nsee [[Roadmap]]", result.Note.Body)
+		assert.Equal(t, "<h1>Design</h1>\n<p>see <a class=\"note-link\" href=\"/note?id=id_2&amp;notebook_name=md_notebook\">Roadmap</a></p>\n", result.Html)
+	})
+	t.Run("RenderHTML/NotRequested", func(t *testing.T) {
+		w := request("GET", "/note", `{"notebook_name": "md_notebook", "id": "id_1"}`)
+		result := &GetNoteResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Empty(t, result.Html)
+	})
+	t.Run("Accept", func(t *testing.T) {
+		w := request("GET", "/note", `{"notebook_name": "md_notebook", "id": "id_2"}`, "Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, "<p>&lt;b&gt;bold&lt;/b&gt;</p>\n", w.Body.String())
+	})
+	t.Run("Accept/JSON", func(t *testing.T) {
+		w := request("GET", "/note", `{"notebook_name": "md_notebook", "id": "id_2"}`, "Accept", "application/json, text/html")
+
+		assert.Equal(t, 200, w.Code)
+		assert.True(t, json.Valid(w.Body.Bytes()))
+	})
+	t.Run("QueryParameters", func(t *testing.T) {
+		w := request("GET", "/note?id=id_2&notebook_name=md_notebook", "", "Accept", "text/html")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "<p>&lt;b&gt;bold&lt;/b&gt;</p>\n", w.Body.String())
+	})
+}
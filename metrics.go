@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// latencyBuckets are the upper bounds in seconds of the request duration
+// histograms, matching the Prometheus client defaults
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// sizeBuckets are the upper bounds in bytes of the payload size histograms
+var sizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+
+// histogram is a cumulative Prometheus histogram
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// observe adds v to every bucket it fits in
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write renders the histogram series of name for a set of labels
+func (h *histogram) write(w io.Writer, name, labels string) {
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// requestKey labels the request counter
+type requestKey struct {
+	method string
+	route  string
+	status int
+}
+
+// routeKey labels the per route histograms
+type routeKey struct {
+	method string
+	route  string
+}
+
+// metrics collects HTTP server metrics and exposes them alongside the size
+// of the NotebookRepo in the Prometheus text exposition format
+type metrics struct {
+	repo     *NotebookRepo
+	inFlight int64
+
+	mu            sync.Mutex
+	requests      map[requestKey]uint64
+	durations     map[requestKey]*histogram
+	requestSizes  map[routeKey]*histogram
+	responseSizes map[routeKey]*histogram
+}
+
+// newMetrics returns metrics reporting the size of repo
+func newMetrics(repo *NotebookRepo) *metrics {
+	return &metrics{
+		repo:          repo,
+		requests:      make(map[requestKey]uint64),
+		durations:     make(map[requestKey]*histogram),
+		requestSizes:  make(map[routeKey]*histogram),
+		responseSizes: make(map[routeKey]*histogram),
+	}
+}
+
+// statusRecorder captures the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.size += n
+	return n, err
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	size int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.size += n
+	return n, err
+}
+
+// middleware records every request served by a matched mux route
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		m.observe(r.Method, routeTemplate(r), recorder.status, time.Since(start), body.size, recorder.size)
+	})
+}
+
+// routeTemplate returns the path template of the mux route serving r,
+// falling back to the request path
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// observe records a single served request
+func (m *metrics) observe(method, route string, status int, duration time.Duration, requestSize, responseSize int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := requestKey{method: method, route: route, status: status}
+	m.requests[key]++
+	if m.durations[key] == nil {
+		m.durations[key] = newHistogram(latencyBuckets)
+	}
+	m.durations[key].observe(duration.Seconds())
+
+	rKey := routeKey{method: method, route: route}
+	if m.requestSizes[rKey] == nil {
+		m.requestSizes[rKey] = newHistogram(sizeBuckets)
+		m.responseSizes[rKey] = newHistogram(sizeBuckets)
+	}
+	m.requestSizes[rKey].observe(float64(requestSize))
+	m.responseSizes[rKey].observe(float64(responseSize))
+}
+
+// repoStats is a point in time summary of the size of a NotebookRepo
+type repoStats struct {
+	notebooks     int
+	notes         int
+	tags          int
+	tagReferences int
+}
+
+// stats summarises the size of every notebook
+func (n *NotebookRepo) stats() repoStats {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	stats := repoStats{notebooks: len(n.notebooks)}
+	for _, notebook := range n.notebooks {
+		stats.notes += len(notebook.notes)
+		stats.tags += len(notebook.tags)
+		for _, noteIDs := range notebook.tags {
+			stats.tagReferences += len(noteIDs)
+		}
+	}
+	return stats
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	stats := m.repo.stats()
+
+	writeMetricHeader(w, "notebook_http_requests_in_flight", "gauge", "Requests currently being served.")
+	fmt.Fprintf(w, "notebook_http_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+	writeGauge(w, "notebook_notebooks", "Notebooks currently stored.", stats.notebooks)
+	writeGauge(w, "notebook_notes", "Notes currently stored across every notebook.", stats.notes)
+	writeGauge(w, "notebook_tags", "Entries of the tags index across every notebook.", stats.tags)
+	writeGauge(w, "notebook_tag_references", "Note IDs referenced by the tags index across every notebook.", stats.tagReferences)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	routeKeys := make([]routeKey, 0, len(m.requestSizes))
+	for key := range m.requestSizes {
+		routeKeys = append(routeKeys, key)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool {
+		if routeKeys[i].route != routeKeys[j].route {
+			return routeKeys[i].route < routeKeys[j].route
+		}
+		return routeKeys[i].method < routeKeys[j].method
+	})
+
+	writeMetricHeader(w, "notebook_http_requests_total", "counter", "Requests served by route, method and status code.")
+	for _, key := range requestKeys {
+		fmt.Fprintf(w, "notebook_http_requests_total{%s} %d\n", key.labels(), m.requests[key])
+	}
+	writeMetricHeader(w, "notebook_http_request_duration_seconds", "histogram", "Request latency by route, method and status code.")
+	for _, key := range requestKeys {
+		m.durations[key].write(w, "notebook_http_request_duration_seconds", key.labels())
+	}
+	writeMetricHeader(w, "notebook_http_request_size_bytes", "histogram", "Request body sizes by route and method.")
+	for _, key := range routeKeys {
+		m.requestSizes[key].write(w, "notebook_http_request_size_bytes", key.labels())
+	}
+	writeMetricHeader(w, "notebook_http_response_size_bytes", "histogram", "Response body sizes by route and method.")
+	for _, key := range routeKeys {
+		m.responseSizes[key].write(w, "notebook_http_response_size_bytes", key.labels())
+	}
+}
+
+func (k requestKey) labels() string {
+	return fmt.Sprintf("method=%s,route=%s,status=\"%d\"", quoteLabel(k.method), quoteLabel(k.route), k.status)
+}
+
+func (k routeKey) labels() string {
+	return fmt.Sprintf("method=%s,route=%s", quoteLabel(k.method), quoteLabel(k.route))
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeGauge(w io.Writer, name, help string, value int) {
+	writeMetricHeader(w, name, "gauge", help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// labelEscaper escapes label values as required by the exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, server *httptest.Server) string {
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	server := httptest.NewServer(newRouter(NewNotebookRepo(nil), newHealth(), defaultConfig()))
+	defer server.Close()
+
+	post := func(path, body string) {
+		resp, err := server.Client().Post(server.URL+path, "application/json", bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	post("/notebook", `{"name": "metrics_notebook"}`)
+	post("/notebook", `{"name": "metrics_notebook"}`)
+	post("/note", `{"notebook_name": "metrics_notebook", "title": "title_1", "body": "body_1", "tags": ["tag_1", "tag_2"]}`)
+
+	metrics := scrape(t, server)
+
+	assert.Contains(t, metrics, "# TYPE notebook_http_requests_total counter\n")
+	assert.Contains(t, metrics, `notebook_http_requests_total{method="POST",route="/notebook",status="200"} 1`)
+	assert.Contains(t, metrics, `notebook_http_requests_total{method="POST",route="/notebook",status="409"} 1`)
+	assert.Contains(t, metrics, `notebook_http_requests_total{method="POST",route="/note",status="200"} 1`)
+	assert.Contains(t, metrics, `notebook_http_request_duration_seconds_count{method="POST",route="/notebook",status="200"} 1`)
+	assert.Contains(t, metrics, `notebook_http_request_duration_seconds_bucket{method="POST",route="/note",status="200",le="+Inf"} 1`)
+	assert.Contains(t, metrics, `notebook_http_request_size_bytes_sum{method="POST",route="/notebook"} 56`)
+	assert.Contains(t, metrics, `notebook_http_request_size_bytes_bucket{method="POST",route="/notebook",le="100"} 2`)
+	assert.Contains(t, metrics, `notebook_http_response_size_bytes_count{method="POST",route="/note"} 1`)
+	assert.Contains(t, metrics, "notebook_http_requests_in_flight 1\n")
+	assert.Contains(t, metrics, "notebook_notebooks 1\n")
+	assert.Contains(t, metrics, "notebook_notes 1\n")
+	assert.Contains(t, metrics, "notebook_tags 2\n")
+	assert.Contains(t, metrics, "notebook_tag_references 2\n")
+
+	// the previous scrape is only recorded once it has been served
+	metrics = scrape(t, server)
+	assert.Contains(t, metrics, `notebook_http_requests_total{method="GET",route="/metrics",status="200"} 1`)
+}
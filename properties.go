@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// property types declared by PropertyDefinition.type
+const (
+	propertyString = "string"
+	propertyNumber = "number"
+	propertyBool   = "bool"
+	propertyTime   = "time"
+)
+
+// propertyNamePattern matches property names, so that they can be used in
+// where filters
+const propertyNamePattern = "^[A-Za-z_][A-Za-z0-9_]*$"
+
+// MarshalJSON encodes v as it is decoded from requests, encoding/json
+// having no representation for the oneof of PropertyValue
+func (v *PropertyValue) MarshalJSON() ([]byte, error) {
+	return protojson.MarshalOptions{UseProtoNames: true}.Marshal(v)
+}
+
+// UnmarshalJSON decodes v as encoded by MarshalJSON
+func (v *PropertyValue) UnmarshalJSON(data []byte) error {
+	return protojson.Unmarshal(data, v)
+}
+
+// propertyKind returns the type of v, or an empty string when it has no
+// value
+func propertyKind(v *PropertyValue) string {
+	switch v.GetKind().(type) {
+	case *PropertyValue_StringValue:
+		return propertyString
+	case *PropertyValue_NumberValue:
+		return propertyNumber
+	case *PropertyValue_BoolValue:
+		return propertyBool
+	case *PropertyValue_TimeValue:
+		return propertyTime
+	}
+	return ""
+}
+
+// orderedFloat maps f to an int64 ordered as f
+func orderedFloat(f float64) int64 {
+	if f == 0 {
+		// -0 is equal to 0
+		f = 0
+	}
+	bits := math.Float64bits(f)
+	if bits>>63 != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return int64(bits ^ 1<<63)
+}
+
+// propertyEntry returns the sortedEntry v is indexed under
+func propertyEntry(v *PropertyValue, id string) sortedEntry {
+	switch kind := v.GetKind().(type) {
+	case *PropertyValue_StringValue:
+		return sortedEntry{str: kind.StringValue, id: id}
+	case *PropertyValue_NumberValue:
+		return sortedEntry{num: orderedFloat(kind.NumberValue), id: id}
+	case *PropertyValue_BoolValue:
+		if kind.BoolValue {
+			return sortedEntry{num: 1, id: id}
+		}
+	case *PropertyValue_TimeValue:
+		return sortedEntry{num: timestampNanos(kind.TimeValue), id: id}
+	}
+	return sortedEntry{id: id}
+}
+
+// compareValue orders entries by value regardless of their ids
+func compareValue(a, b sortedEntry) int {
+	switch {
+	case a.num != b.num && a.num < b.num, a.num == b.num && a.str < b.str:
+		return -1
+	case a.num != b.num, a.str != b.str:
+		return 1
+	}
+	return 0
+}
+
+// compared returns the ids of the entries whose value compares to v as op
+func (x *sortedIndex) compared(op string, v sortedEntry) []string {
+	n := len(x.entries)
+	lo := sort.Search(n, func(i int) bool { return compareValue(x.entries[i], v) >= 0 })
+	hi := sort.Search(n, func(i int) bool { return compareValue(x.entries[i], v) > 0 })
+	ids := func(spans ...[2]int) []string {
+		var ids []string
+		for _, span := range spans {
+			for _, e := range x.entries[span[0]:span[1]] {
+				ids = append(ids, e.id)
+			}
+		}
+		return ids
+	}
+	switch op {
+	case "=":
+		return ids([2]int{lo, hi})
+	case "!=":
+		return ids([2]int{0, lo}, [2]int{hi, n})
+	case "<":
+		return ids([2]int{0, lo})
+	case "<=":
+		return ids([2]int{0, hi})
+	case ">":
+		return ids([2]int{hi, n})
+	case ">=":
+		return ids([2]int{lo, n})
+	}
+	return nil
+}
+
+// propertyKey identifies the index of the values of a type held by a
+// property
+type propertyKey struct {
+	name string
+	kind string
+}
+
+// propertyIndex indexes the notes of a notebook by the value of each of
+// their properties, it is kept up to date by Notebook.putNote and
+// Notebook.removeNote
+type propertyIndex struct {
+	values map[propertyKey]*sortedIndex
+	// indexed holds the entries each note was indexed with
+	indexed map[string]map[propertyKey]sortedEntry
+}
+
+func newPropertyIndex() *propertyIndex {
+	return &propertyIndex{
+		values:  make(map[propertyKey]*sortedIndex),
+		indexed: make(map[string]map[propertyKey]sortedEntry),
+	}
+}
+
+// put indexes the properties of note, replacing any previous version
+func (x *propertyIndex) put(note *Note) {
+	if x == nil {
+		return
+	}
+	x.remove(note.Id)
+	if len(note.GetProperties()) == 0 {
+		return
+	}
+	entries := make(map[propertyKey]sortedEntry, len(note.GetProperties()))
+	for name, value := range note.GetProperties() {
+		key := propertyKey{name: name, kind: propertyKind(value)}
+		index, ok := x.values[key]
+		if !ok {
+			index = &sortedIndex{}
+			x.values[key] = index
+		}
+		entries[key] = propertyEntry(value, note.Id)
+		index.insert(entries[key])
+	}
+	x.indexed[note.Id] = entries
+}
+
+// remove drops the properties of the note with id
+func (x *propertyIndex) remove(id string) {
+	if x == nil {
+		return
+	}
+	for key, entry := range x.indexed[id] {
+		index := x.values[key]
+		index.remove(entry)
+		if len(index.entries) == 0 {
+			delete(x.values, key)
+		}
+	}
+	delete(x.indexed, id)
+}
+
+// propertyIndex returns the property index of the notebook, notebooks
+// built without one get an index computed from their notes
+func (nb Notebook) propertyIndex() *propertyIndex {
+	if nb.properties != nil {
+		return nb.properties
+	}
+	index := newPropertyIndex()
+	for _, note := range nb.notes {
+		index.put(note)
+	}
+	return index
+}
+
+// checkProperties returns an error when one of properties is invalid or
+// when they do not conform to the schema of the notebook
+func (nb Notebook) checkProperties(properties map[string]*PropertyValue) error {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := properties[name]
+		if !compilePattern(propertyNamePattern).MatchString(name) {
+			return fmt.Errorf("Property name '%s' must match %s", name, propertyNamePattern)
+		}
+		kind := propertyKind(value)
+		if kind == "" {
+			return fmt.Errorf("Property '%s' has no value", name)
+		}
+		if kind == propertyNumber && (math.IsNaN(value.GetNumberValue()) || math.IsInf(value.GetNumberValue(), 0)) {
+			return fmt.Errorf("Property '%s' must be a finite number", name)
+		}
+		if len(nb.schema) == 0 {
+			continue
+		}
+		definition, ok := nb.schema[name]
+		if !ok {
+			return fmt.Errorf("Property '%s' is not declared by the notebook schema", name)
+		}
+		if definition.Type != kind {
+			return fmt.Errorf("Property '%s' must be a %s", name, definition.Type)
+		}
+	}
+	for _, definition := range nb.sortedSchema() {
+		if _, ok := properties[definition.Name]; definition.Required && !ok {
+			return fmt.Errorf("Property '%s' is required", definition.Name)
+		}
+	}
+	return nil
+}
+
+// sortedSchema returns the property definitions of the notebook by name
+func (nb Notebook) sortedSchema() []*PropertyDefinition {
+	definitions := make([]*PropertyDefinition, 0, len(nb.schema))
+	for _, definition := range nb.schema {
+		definitions = append(definitions, definition)
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	return definitions
+}
+
+// ----------------------------------------------------------------------
+// where filters
+//
+//	filter     = or
+//	or         = and { "OR" and }
+//	and        = not { "AND" not }
+//	not        = "NOT" not | "(" filter ")" | comparison
+//	comparison = name ( "=" | "!=" | "<" | "<=" | ">" | ">=" ) value
+//	value      = string | number | "true" | "false"
+//
+// Keywords are case insensitive. Strings are double quoted and compare with
+// string properties, and with time properties when they hold an RFC 3339
+// time or a 2006-01-02 date. A comparison only matches notes holding the
+// property with a value of the type of the literal
+// ----------------------------------------------------------------------
+
+// propertyFilter is a parsed where filter
+type propertyFilter interface {
+	// match returns the ids of the notes of nb matching the filter
+	match(nb Notebook, index *propertyIndex) map[string]bool
+}
+
+type filterAnd struct{ left, right propertyFilter }
+type filterOr struct{ left, right propertyFilter }
+type filterNot struct{ inner propertyFilter }
+
+type filterCompare struct {
+	name string
+	op   string
+	// values holds the literal as each type it compares with
+	values []*PropertyValue
+}
+
+func (f filterAnd) match(nb Notebook, index *propertyIndex) map[string]bool {
+	left, right := f.left.match(nb, index), f.right.match(nb, index)
+	if len(right) < len(left) {
+		left, right = right, left
+	}
+	ids := make(map[string]bool)
+	for id := range left {
+		if right[id] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (f filterOr) match(nb Notebook, index *propertyIndex) map[string]bool {
+	ids := f.left.match(nb, index)
+	for id := range f.right.match(nb, index) {
+		ids[id] = true
+	}
+	return ids
+}
+
+func (f filterNot) match(nb Notebook, index *propertyIndex) map[string]bool {
+	excluded := f.inner.match(nb, index)
+	ids := make(map[string]bool)
+	for id := range nb.notes {
+		if !excluded[id] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (f filterCompare) match(nb Notebook, index *propertyIndex) map[string]bool {
+	ids := make(map[string]bool)
+	for _, value := range f.values {
+		values, ok := index.values[propertyKey{name: f.name, kind: propertyKind(value)}]
+		if !ok {
+			continue
+		}
+		for _, id := range values.compared(f.op, propertyEntry(value, "")) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// filterToken is a lexical token of a where filter, kind being one of
+// name, string, number, op, ( and )
+type filterToken struct {
+	kind string
+	text string
+	at   int
+}
+
+func tokenizeFilter(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{kind: string(c), text: string(c), at: i})
+			i++
+		case strings.ContainsRune("=!<>", rune(c)):
+			op := string(c)
+			if i+1 < len(s) && s[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected '!' at offset %d", i)
+			}
+			tokens = append(tokens, filterToken{kind: "op", text: op, at: i})
+			i += len(op)
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			text, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d", i)
+			}
+			tokens = append(tokens, filterToken{kind: "string", text: text, at: i})
+			i = j + 1
+		case c == '-' || c == '.' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(s) && (strings.IndexByte("0123456789.eE", s[j]) >= 0 || (s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E')) {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: "number", text: s[i:j], at: i})
+			i = j
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: "name", text: s[i:j], at: i})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", rune(c), i)
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser is a recursive descent parser of where filters
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	end    int
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return filterToken{}, false
+}
+
+// keyword reports whether the next token is word, consuming it
+func (p *filterParser) keyword(word string) bool {
+	if t, ok := p.peek(); ok && t.kind == "name" && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// unexpected describes the token at the current position
+func (p *filterParser) unexpected(expected string) error {
+	t, ok := p.peek()
+	if !ok {
+		return fmt.Errorf("expected %s at offset %d", expected, p.end)
+	}
+	return fmt.Errorf("expected %s at offset %d, found %q", expected, t.at, t.text)
+}
+
+func (p *filterParser) or() (propertyFilter, error) {
+	left, err := p.and()
+	for err == nil && p.keyword("OR") {
+		var right propertyFilter
+		if right, err = p.and(); err == nil {
+			left = filterOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) and() (propertyFilter, error) {
+	left, err := p.not()
+	for err == nil && p.keyword("AND") {
+		var right propertyFilter
+		if right, err = p.not(); err == nil {
+			left = filterAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) not() (propertyFilter, error) {
+	if p.keyword("NOT") {
+		inner, err := p.not()
+		return filterNot{inner}, err
+	}
+	if t, ok := p.peek(); ok && t.kind == "(" {
+		p.pos++
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.kind != ")" {
+			return nil, p.unexpected("')'")
+		}
+		p.pos++
+		return inner, nil
+	}
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (propertyFilter, error) {
+	name, ok := p.peek()
+	if !ok || name.kind != "name" {
+		return nil, p.unexpected("a property name")
+	}
+	p.pos++
+	op, ok := p.peek()
+	if !ok || op.kind != "op" {
+		return nil, p.unexpected("a comparison operator")
+	}
+	p.pos++
+	value, ok := p.peek()
+	if !ok {
+		return nil, p.unexpected("a value")
+	}
+	p.pos++
+
+	compare := filterCompare{name: name.text, op: op.text}
+	switch {
+	case value.kind == "string":
+		compare.values = append(compare.values, &PropertyValue{Kind: &PropertyValue_StringValue{StringValue: value.text}})
+		if t, ok := parseFilterTime(value.text); ok {
+			compare.values = append(compare.values, &PropertyValue{Kind: &PropertyValue_TimeValue{TimeValue: t}})
+		}
+	case value.kind == "number":
+		f, err := strconv.ParseFloat(value.text, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("invalid number %q at offset %d", value.text, value.at)
+		}
+		compare.values = append(compare.values, &PropertyValue{Kind: &PropertyValue_NumberValue{NumberValue: f}})
+	case value.kind == "name" && (strings.EqualFold(value.text, "true") || strings.EqualFold(value.text, "false")):
+		b := strings.EqualFold(value.text, "true")
+		compare.values = append(compare.values, &PropertyValue{Kind: &PropertyValue_BoolValue{BoolValue: b}})
+	default:
+		p.pos--
+		return nil, p.unexpected("a string, number or boolean")
+	}
+	return compare, nil
+}
+
+// parseFilterTime parses an RFC 3339 time or a date, taken at midnight UTC
+func parseFilterTime(s string) (*timestamp.Timestamp, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			ts, err := ptypes.TimestampProto(t)
+			return ts, err == nil
+		}
+	}
+	return nil, false
+}
+
+// parsePropertyFilter parses a where filter, an empty filter yielding nil
+func parsePropertyFilter(s string) (propertyFilter, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens, end: len(s)}
+	filter, err := p.or()
+	if err == nil && p.pos != len(tokens) {
+		err = p.unexpected("AND, OR or the end of the filter")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// GetPropertySchema takes a request body attempting to deserialise it to a
+// GetPropertySchemaRequest object
+func (n *NotebookRepo) GetPropertySchema(w http.ResponseWriter, r *http.Request) {
+	body := &GetPropertySchemaRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &GetPropertySchemaResponse{NotebookName: body.GetNotebookName(), Properties: notebook.sortedSchema()}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// SetPropertySchema takes a request body attempting to deserialise it to a
+// SetPropertySchemaRequest object. The schema is refused with a conflict
+// when a note of the notebook does not conform to it
+func (n *NotebookRepo) SetPropertySchema(w http.ResponseWriter, r *http.Request) {
+	body := &SetPropertySchemaRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	schema := make(map[string]*PropertyDefinition, len(body.GetProperties()))
+	for i, definition := range body.GetProperties() {
+		if _, ok := schema[definition.Name]; ok {
+			n.writeBadRequest(w, r, []*FieldViolation{{
+				Field:       fmt.Sprintf("properties[%d].name", i),
+				Description: fmt.Sprintf("property '%s' is declared twice", definition.Name),
+			}})
+			return
+		}
+		schema[definition.Name] = definition
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids := make([]string, 0, len(notebook.notes))
+	for id := range notebook.notes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	candidate := Notebook{schema: schema}
+	for _, id := range ids {
+		if err := candidate.checkProperties(notebook.notes[id].GetProperties()); err != nil {
+			errMsg := fmt.Sprintf("Note with id '%s' does not conform to the schema: %v", id, err)
+			n.log(r).Error(errMsg)
+			http.Error(w, errMsg, http.StatusConflict)
+			return
+		}
+	}
+	for name := range notebook.schema {
+		delete(notebook.schema, name)
+	}
+	for name, definition := range schema {
+		notebook.schema[name] = definition
+	}
+
+	result := &SetPropertySchemaResponse{NotebookName: body.GetNotebookName(), Properties: notebook.sortedSchema()}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
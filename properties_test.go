@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// newPropertiesRepo holds notes id_0 to id_3 with properties status,
+// priority, done and due
+func newPropertiesRepo() *NotebookRepo {
+	var notes []*Note
+	for _, note := range []string{
+		`{"id": "id_0", "title": "a", "body": "b", "properties": {"status": {"string_value": "open"}, "priority": {"number_value": 3}, "due": {"time_value": "2020-01-10T00:00:00Z"}}}`,
+		`{"id": "id_1", "title": "a", "body": "b", "properties": {"status": {"string_value": "open"}, "priority": {"number_value": -1.5}, "done": {"bool_value": false}}}`,
+		`{"id": "id_2", "title": "a", "body": "b", "properties": {"status": {"string_value": "closed"}, "priority": {"number_value": 5}, "done": {"bool_value": true}, "due": {"time_value": "2020-02-01T12:00:00Z"}}}`,
+		`{"id": "id_3", "title": "a", "body": "b"}`,
+	} {
+		parsed := &Note{}
+		if err := json.Unmarshal([]byte(note), parsed); err != nil {
+			panic(err)
+		}
+		notes = append(notes, parsed)
+	}
+	return newTestRepo("props_notebook", notes...)
+}
+
+func TestPropertyFilters(t *testing.T) {
+	request := func(repo *NotebookRepo, where string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body, _ := json.Marshal(&GetNotebookRequest{Name: "props_notebook", Where: where})
+		newRouter(repo, newHealth(), defaultConfig()).ServeHTTP(w, httptest.NewRequest("GET", "/notebook", bytes.NewBuffer(body)))
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		where    string
+		expected []string
+	}{
+		{"Equal", `status = "open"`, []string{"id_0", "id_1"}},
+		{"NotEqual", `status != "open"`, []string{"id_2"}},
+		{"Greater", `priority > 2`, []string{"id_0", "id_2"}},
+		{"Negative", `priority <= -1.5`, []string{"id_1"}},
+		{"LessOrEqual", `priority >= 3 AND priority <= 3`, []string{"id_0"}},
+		{"And", `status = "open" AND priority > 2`, []string{"id_0"}},
+		{"Or", `status = "closed" or priority < 0`, []string{"id_1", "id_2"}},
+		{"Not", `NOT status = "open"`, []string{"id_2", "id_3"}},
+		{"Parentheses", `(status = "closed" OR done = false) AND NOT priority > 4`, []string{"id_1"}},
+		{"Precedence", `status = "closed" OR done = false AND priority > 4`, []string{"id_2"}},
+		{"Bool", `done = TRUE`, []string{"id_2"}},
+		{"Date", `due < "2020-01-31"`, []string{"id_0"}},
+		{"Time", `due >= "2020-02-01T12:00:00Z"`, []string{"id_2"}},
+		{"TypeMismatch", `status = 3`, nil},
+		{"Unknown", `owner = "me"`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := request(newPropertiesRepo(), test.where)
+			assert.Equal(t, 200, w.Code)
+			result := &GetNotebookResponse{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+			var ids []string
+			for _, note := range result.Notes {
+				ids = append(ids, note.Id)
+			}
+			sort.Strings(ids)
+			assert.Equal(t, test.expected, ids)
+		})
+	}
+	t.Run("Meta", func(t *testing.T) {
+		w := request(newPropertiesRepo(), `done = true`)
+		result := &GetNotebookResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Equal(t, "closed", result.Notes[0].Properties["status"].GetStringValue())
+		assert.Equal(t, int64(1580558400), result.Notes[0].Properties["due"].GetTimeValue().GetSeconds())
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		for where, expected := range map[string]string{
+			`status =`:               "expected a value at offset 8",
+			`status "open"`:          `expected a comparison operator at offset 7, found "open"`,
+			`(status = "open"`:       "expected ')' at offset 16",
+			`status = "open`:         "unterminated string at offset 9",
+			`status = open`:          `expected a string, number or boolean at offset 9, found "open"`,
+			`status = "a" priority`:  `expected AND, OR or the end of the filter at offset 13`,
+			`priority > 1e999`:       "invalid number",
+			`status ! "open"`:        "unexpected '!' at offset 7",
+			`status = "open" AND #`:  `unexpected '#' at offset 20`,
+			`AND status = "open"`:    "expected a comparison operator at offset 4",
+			`NOT (status = "a") OR `: "expected a property name at offset 22",
+		} {
+			w := request(newPropertiesRepo(), where)
+			assert.Equal(t, 400, w.Code, where)
+			result := &BadRequest{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+			if assert.Len(t, result.Violations, 1, where) {
+				assert.Equal(t, "where", result.Violations[0].Field)
+				assert.Contains(t, result.Violations[0].Description, expected, where)
+			}
+		}
+	})
+}
+
+func TestPropertyIndex(t *testing.T) {
+	t.Run("Updates", func(t *testing.T) {
+		repo := newPropertiesRepo()
+		notebook := repo.notebooks["props_notebook"]
+		note := proto.Clone(notebook.notes["id_0"]).(*Note)
+		note.Properties["status"] = &PropertyValue{Kind: &PropertyValue_StringValue{StringValue: "closed"}}
+		notebook.putNote(note)
+		notebook.removeNote("id_2")
+
+		filter, err := parsePropertyFilter(`status = "closed"`)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]bool{"id_0": true}, filter.match(notebook, notebook.properties))
+		assert.Len(t, notebook.properties.values[propertyKey{name: "done", kind: propertyBool}].entries, 1)
+		assert.NotContains(t, notebook.properties.values, propertyKey{name: "due", kind: propertyString})
+	})
+	t.Run("Fallback", func(t *testing.T) {
+		notebook := newPropertiesRepo().notebooks["props_notebook"]
+		literal := Notebook{notes: notebook.notes}
+
+		assert.Equal(t, notebook.properties.values, literal.propertyIndex().values)
+	})
+	t.Run("OrderedFloat", func(t *testing.T) {
+		values := []float64{math.Inf(-1), -1e300, -2, -1, -0.5, 0, 0.5, 1, 2, 1e300, math.Inf(1)}
+		for i := 1; i < len(values); i++ {
+			assert.Less(t, orderedFloat(values[i-1]), orderedFloat(values[i]), values[i])
+		}
+		assert.Equal(t, orderedFloat(0), orderedFloat(math.Copysign(0, -1)))
+	})
+}
+
+func TestPropertySchema(t *testing.T) {
+	request := func(repo *NotebookRepo, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		newRouter(repo, newHealth(), defaultConfig()).ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	schema := `{"notebook_name": "props_notebook", "properties": [
+		{"name": "status", "type": "string", "required": true},
+		{"name": "priority", "type": "number"}]}`
+
+	t.Run("CreateNote/NoSchema", func(t *testing.T) {
+		repo := newPropertiesRepo()
+		w := request(repo, "POST", "/note", `{"notebook_name": "props_notebook", "title": "t", "body": "b", "properties": {"anything": {"bool_value": true}}}`)
+		assert.Equal(t, 200, w.Code)
+		result := &CreateNoteResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		notebook := repo.notebooks["props_notebook"]
+		assert.True(t, notebook.notes[result.Id].Properties["anything"].GetBoolValue())
+		filter, _ := parsePropertyFilter(`anything = true`)
+		assert.Equal(t, map[string]bool{result.Id: true}, filter.match(notebook, notebook.properties))
+	})
+	t.Run("CreateNote/Invalid", func(t *testing.T) {
+		for properties, expected := range map[string]string{
+			`{"1st": {"bool_value": true}}`:    "Property name '1st' must match",
+			`{"empty": {}}`:                    "Property 'empty' has no value",
+			`{"nan": {"number_value": "NaN"}}`: "Property 'nan' must be a finite number",
+		} {
+			w := request(newPropertiesRepo(), "POST", "/note", `{"notebook_name": "props_notebook", "title": "t", "body": "b", "properties": `+properties+`}`)
+			assert.Equal(t, 400, w.Code, properties)
+			assert.Contains(t, w.Body.String(), expected, properties)
+		}
+	})
+	t.Run("Set/Conflict", func(t *testing.T) {
+		repo := newPropertiesRepo()
+		w := request(repo, "POST", "/notebook/schema", schema)
+
+		assert.Equal(t, 409, w.Code)
+		assert.Contains(t, w.Body.String(), "Note with id 'id_0' does not conform to the schema: Property 'due' is not declared")
+		assert.Empty(t, repo.notebooks["props_notebook"].schema)
+	})
+	t.Run("Set/Duplicate", func(t *testing.T) {
+		w := request(newPropertiesRepo(), "POST", "/notebook/schema", `{"notebook_name": "props_notebook", "properties": [{"name": "a", "type": "bool"}, {"name": "a", "type": "time"}]}`)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "properties[1].name")
+	})
+	t.Run("Set/InvalidType", func(t *testing.T) {
+		w := request(newPropertiesRepo(), "POST", "/notebook/schema", `{"notebook_name": "props_notebook", "properties": [{"name": "a", "type": "date"}]}`)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "properties[0].type")
+	})
+	t.Run("Enforced", func(t *testing.T) {
+		repo := newTestRepo("props_notebook")
+		w := request(repo, "POST", "/notebook/schema", schema)
+		assert.Equal(t, 200, w.Code)
+
+		w = request(repo, "GET", "/notebook/schema", `{"notebook_name": "props_notebook"}`)
+		assert.Equal(t, 200, w.Code)
+		got := &GetPropertySchemaResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), got))
+		assert.Len(t, got.Properties, 2)
+		assert.Equal(t, "priority", got.Properties[0].Name)
+		assert.True(t, got.Properties[1].Required)
+
+		for properties, expected := range map[string]string{
+			`{"priority": {"number_value": 1}}`:                                     "Property 'status' is required",
+			`{"status": {"number_value": 1}}`:                                       "Property 'status' must be a string",
+			`{"status": {"string_value": "open"}, "owner": {"string_value": "me"}}`: "Property 'owner' is not declared by the notebook schema",
+		} {
+			w = request(repo, "POST", "/note", `{"notebook_name": "props_notebook", "title": "t", "body": "b", "properties": `+properties+`}`)
+			assert.Equal(t, 400, w.Code, properties)
+			assert.Contains(t, w.Body.String(), expected, properties)
+		}
+		w = request(repo, "POST", "/note", `{"notebook_name": "props_notebook", "title": "t", "body": "b", "properties": {"status": {"string_value": "open"}}}`)
+		assert.Equal(t, 200, w.Code)
+		result := &CreateNoteResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		w = request(repo, "UPDATE", "/note", `{"notebook_name": "props_notebook", "id": "`+result.Id+`", "title": "t", "body": "b"}`)
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "Property 'status' is required")
+	})
+}
+
+func TestPropertiesBackup(t *testing.T) {
+	repo := newPropertiesRepo()
+	repo.notebooks["props_notebook"].schema["status"] = &PropertyDefinition{Name: "status", Type: propertyString}
+	var buf bytes.Buffer
+	assert.NoError(t, writeBackup(&buf, repo.snapshot(), nil))
+	_, backups, _, err := readBackup(&buf)
+	assert.NoError(t, err)
+
+	restored := restoreNotebook(backups[0], newGlobalIndex())
+	assert.Equal(t, propertyString, restored.schema["status"].Type)
+	filter, _ := parsePropertyFilter(`priority > 4`)
+	assert.Equal(t, map[string]bool{"id_2": true}, filter.match(restored, restored.properties))
+}
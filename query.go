@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// query page sizes, larger page_size values are lowered to maxQueryPageSize
+const (
+	defaultQueryPageSize = 50
+	maxQueryPageSize     = 1000
+)
+
+// noteRef identifies a note across notebooks
+type noteRef struct {
+	notebook string
+	id       string
+}
+
+// queryKey orders the notes of the global index by created time, ties
+// being broken by notebook name and note id so that cursors are stable
+type queryKey struct {
+	created int64
+	noteRef
+}
+
+func (k queryKey) less(other queryKey) bool {
+	if k.created != other.created {
+		return k.created < other.created
+	}
+	if k.notebook != other.notebook {
+		return k.notebook < other.notebook
+	}
+	return k.id < other.id
+}
+
+// timestampNanos returns ts in nanoseconds since the epoch, notes without
+// a created time sort first
+func timestampNanos(ts *timestamp.Timestamp) int64 {
+	if ts == nil {
+		return 0
+	}
+	return ts.GetSeconds()*1e9 + int64(ts.GetNanos())
+}
+
+// globalIndex references the notes of every notebook by tag and by created
+// time so that QueryNotes never iterates the notebooks themselves. It is
+// guarded by NotebookRepo.mu and kept up to date by Notebook.putNote and
+// Notebook.removeNote
+type globalIndex struct {
+	notes map[noteRef]*Note
+	// keys holds the key each note was indexed with, used to find it in
+	// byCreated when the note is replaced or removed
+	keys      map[noteRef]queryKey
+	byCreated []queryKey
+	tags      map[string]map[noteRef]bool
+	tree      *tagTree
+}
+
+func newGlobalIndex() *globalIndex {
+	return &globalIndex{
+		notes: make(map[noteRef]*Note),
+		keys:  make(map[noteRef]queryKey),
+		tags:  make(map[string]map[noteRef]bool),
+		tree:  newTagTree(),
+	}
+}
+
+// reset removes every note from the index
+func (g *globalIndex) reset() {
+	if g == nil {
+		return
+	}
+	*g = *newGlobalIndex()
+}
+
+// put indexes note as stored in notebook, replacing any previous version
+func (g *globalIndex) put(notebook string, note *Note) {
+	if g == nil {
+		return
+	}
+	ref := noteRef{notebook: notebook, id: note.Id}
+	g.remove(notebook, note.Id)
+
+	key := queryKey{created: timestampNanos(note.Created), noteRef: ref}
+	i := sort.Search(len(g.byCreated), func(i int) bool { return key.less(g.byCreated[i]) })
+	g.byCreated = append(g.byCreated, queryKey{})
+	copy(g.byCreated[i+1:], g.byCreated[i:])
+	g.byCreated[i] = key
+	g.keys[ref] = key
+	g.notes[ref] = note
+
+	for _, tag := range note.Tags {
+		if len(g.tags[tag]) == 0 {
+			g.tags[tag] = make(map[noteRef]bool)
+			g.tree.insert(tag)
+		}
+		g.tags[tag][ref] = true
+	}
+}
+
+// remove drops the note id of notebook from the index
+func (g *globalIndex) remove(notebook, id string) {
+	if g == nil {
+		return
+	}
+	ref := noteRef{notebook: notebook, id: id}
+	key, ok := g.keys[ref]
+	if !ok {
+		return
+	}
+	i := sort.Search(len(g.byCreated), func(i int) bool { return !g.byCreated[i].less(key) })
+	g.byCreated = append(g.byCreated[:i], g.byCreated[i+1:]...)
+	for _, tag := range g.notes[ref].Tags {
+		delete(g.tags[tag], ref)
+		if len(g.tags[tag]) == 0 {
+			delete(g.tags, tag)
+			g.tree.remove(tag)
+		}
+	}
+	delete(g.keys, ref)
+	delete(g.notes, ref)
+}
+
+// candidates returns the keys of the notes holding any of tags or their
+// descendants, every indexed note when tags is empty, sorted by created time
+func (g *globalIndex) candidates(tags []string) []queryKey {
+	if len(tags) == 0 {
+		return g.byCreated
+	}
+	refs := make(map[noteRef]bool)
+	for _, tag := range tags {
+		node := g.tree.find(tag)
+		if node == nil {
+			continue
+		}
+		node.walk(tag, func(tag string) {
+			for ref := range g.tags[tag] {
+				refs[ref] = true
+			}
+		})
+	}
+	keys := make([]queryKey, 0, len(refs))
+	for ref := range refs {
+		keys = append(keys, g.keys[ref])
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	return keys
+}
+
+// query returns up to limit notes matching body that sort after cursor,
+// along with whether more notes match. starred reports whether the calling
+// principal starred a note
+func (g *globalIndex) query(body *QueryNotesRequest, cursor *queryKey, limit int, starred func(ref noteRef) bool) ([]queryKey, bool) {
+	keys := g.candidates(body.GetTags())
+	start := 0
+	if body.GetCreatedAfter() != nil {
+		after := timestampNanos(body.GetCreatedAfter())
+		start = sort.Search(len(keys), func(i int) bool { return keys[i].created >= after })
+	}
+	if cursor != nil {
+		if i := sort.Search(len(keys), func(i int) bool { return cursor.less(keys[i]) }); i > start {
+			start = i
+		}
+	}
+
+	var found []queryKey
+	for _, key := range keys[start:] {
+		if body.GetCreatedBefore() != nil && key.created >= timestampNanos(body.GetCreatedBefore()) {
+			break
+		}
+		note := g.notes[key.noteRef]
+		modified := modifiedNanos(note)
+		if body.GetModifiedAfter() != nil && modified < timestampNanos(body.GetModifiedAfter()) {
+			continue
+		}
+		if body.GetModifiedBefore() != nil && modified >= timestampNanos(body.GetModifiedBefore()) {
+			continue
+		}
+		if !matchesState(body.GetPinned(), stateInclude, note.GetPinned()) ||
+			!matchesState(body.GetArchived(), stateExclude, note.GetArchived()) ||
+			!matchesState(body.GetStarred(), stateInclude, starred(key.noteRef)) {
+			continue
+		}
+		if len(found) == limit {
+			return found, true
+		}
+		found = append(found, key)
+	}
+	return found, false
+}
+
+// encodePageToken returns the opaque page token resuming after key
+func encodePageToken(key queryKey) (string, error) {
+	data, err := proto.Marshal(&QueryCursor{
+		Created:      &timestamp.Timestamp{Seconds: key.created / 1e9, Nanos: int32(key.created % 1e9)},
+		NotebookName: key.notebook,
+		Id:           key.id,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodePageToken returns the key a page token resumes after
+func decodePageToken(token string) (*queryKey, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &QueryCursor{}
+	if err := proto.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	return &queryKey{
+		created: timestampNanos(cursor.GetCreated()),
+		noteRef: noteRef{notebook: cursor.GetNotebookName(), id: cursor.GetId()},
+	}, nil
+}
+
+// QueryNotes takes a request body attempting to deserialise it to a
+// QueryNotesRequest object, searching the notes of every notebook
+func (n *NotebookRepo) QueryNotes(w http.ResponseWriter, r *http.Request) {
+	body := &QueryNotesRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	limit := int(body.GetPageSize())
+	switch {
+	case limit < 0:
+		n.writeBadRequest(w, r, []*FieldViolation{{Field: "page_size", Description: "must not be negative"}})
+		return
+	case limit == 0:
+		limit = defaultQueryPageSize
+	case limit > maxQueryPageSize:
+		limit = maxQueryPageSize
+	}
+	var cursor *queryKey
+	if body.GetPageToken() != "" {
+		var err error
+		if cursor, err = decodePageToken(body.GetPageToken()); err != nil {
+			n.writeBadRequest(w, r, []*FieldViolation{{Field: "page_token", Description: fmt.Sprintf("is invalid: %v", err)}})
+			return
+		}
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	caller := principal(r)
+	starred := func(ref noteRef) bool {
+		return n.notebooks[ref.notebook].starred(ref.id, caller)
+	}
+	keys, more := n.global.query(body, cursor, limit, starred)
+	result := &QueryNotesResponse{}
+	for _, key := range keys {
+		// results are listed without their body
+		note := proto.Clone(n.global.notes[key.noteRef]).(*Note)
+		note.Body = ""
+		note.Starred = starred(key.noteRef)
+		result.Results = append(result.Results, &QueryResult{
+			NotebookName: key.notebook,
+			Note:         note,
+		})
+	}
+	if more {
+		token, err := encodePageToken(keys[len(keys)-1])
+		if err != nil {
+			n.log(r).Error("Unable to encode page token", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.NextPageToken = token
+	}
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
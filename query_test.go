@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+)
+
+// newQueryRepo holds the notes id_0 to id_5 created an hour apart, spread
+// over two notebooks
+func newQueryRepo(start time.Time) *NotebookRepo {
+	var work, home []*Note
+	tags := [][]string{{"urgent"}, {"project/alpha", "urgent"}, {"project/beta"}, {}, {"urgent/today"}, {"project"}}
+	for i, noteTags := range tags {
+		created, _ := ptypes.TimestampProto(start.Add(time.Duration(i) * time.Hour))
+		note := &Note{
+			Id:           "id_" + string(rune('0'+i)),
+			Title:        "title",
+			Body:         "body",
+			Tags:         noteTags,
+			Created:      created,
+			LastModified: created,
+		}
+		if i%2 == 1 {
+			home = append(home, note)
+		} else {
+			work = append(work, note)
+		}
+	}
+	repo := newTestRepo("work", work...)
+	notebook := makeNotebook("home", repo.global)
+	for _, note := range home {
+		notebook.addNote(note)
+	}
+	repo.notebooks["home"] = notebook
+	return repo
+}
+
+func TestQueryNotes(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := func(repo *NotebookRepo, body string) (int, *QueryNotesResponse) {
+		w := httptest.NewRecorder()
+		router := newRouter(repo, newHealth(), defaultConfig())
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/query", bytes.NewBufferString(body)))
+		result := &QueryNotesResponse{}
+		if w.Code == 200 {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		}
+		return w.Code, result
+	}
+	refs := func(result *QueryNotesResponse) []string {
+		var refs []string
+		for _, r := range result.Results {
+			refs = append(refs, r.NotebookName+"/"+r.Note.Id)
+		}
+		return refs
+	}
+
+	t.Run("Tags/AcrossNotebooks", func(t *testing.T) {
+		code, result := query(newQueryRepo(start), `{"tags": ["urgent"]}`)
+
+		assert.Equal(t, 200, code)
+		assert.Equal(t, []string{"work/id_0", "home/id_1", "work/id_4"}, refs(result))
+		assert.Empty(t, result.Results[0].Note.Body)
+		assert.Empty(t, result.NextPageToken)
+	})
+	t.Run("Tags/Descendants", func(t *testing.T) {
+		_, result := query(newQueryRepo(start), `{"tags": ["project"]}`)
+
+		assert.Equal(t, []string{"home/id_1", "work/id_2", "home/id_5"}, refs(result))
+	})
+	t.Run("CreatedRange", func(t *testing.T) {
+		_, result := query(newQueryRepo(start), `{"created_after": "2020-01-01T01:00:00Z", "created_before": "2020-01-01T04:00:00Z"}`)
+
+		assert.Equal(t, []string{"home/id_1", "work/id_2", "home/id_3"}, refs(result))
+	})
+	t.Run("ModifiedRange", func(t *testing.T) {
+		repo := newQueryRepo(start)
+		w := httptest.NewRecorder()
+		newRouter(repo, newHealth(), defaultConfig()).ServeHTTP(w, httptest.NewRequest("UPDATE", "/note",
+			bytes.NewBufferString(`{"notebook_name": "home", "id": "id_3", "title": "t", "body": "b", "tags": ["urgent"]}`)))
+		assert.Equal(t, 200, w.Code)
+
+		_, result := query(repo, `{"tags": ["urgent"], "modified_after": "2021-01-01T00:00:00Z"}`)
+		assert.Equal(t, []string{"home/id_3"}, refs(result))
+	})
+	t.Run("Pagination", func(t *testing.T) {
+		repo := newQueryRepo(start)
+		var pages [][]string
+		token := ""
+		for {
+			_, result := query(repo, `{"page_size": 4, "page_token": "`+token+`"}`)
+			pages = append(pages, refs(result))
+			if token = result.NextPageToken; token == "" {
+				break
+			}
+		}
+
+		assert.Equal(t, [][]string{
+			{"work/id_0", "home/id_1", "work/id_2", "home/id_3"},
+			{"work/id_4", "home/id_5"},
+		}, pages)
+	})
+	t.Run("DeletedNote", func(t *testing.T) {
+		repo := newQueryRepo(start)
+		w := httptest.NewRecorder()
+		newRouter(repo, newHealth(), defaultConfig()).ServeHTTP(w, httptest.NewRequest("DELETE", "/note",
+			bytes.NewBufferString(`{"notebook_name": "work", "id": "id_2"}`)))
+		assert.Equal(t, 200, w.Code)
+
+		_, result := query(repo, `{"tags": ["project"]}`)
+		assert.Equal(t, []string{"home/id_1", "home/id_5"}, refs(result))
+		assert.Nil(t, repo.global.tree.find("project/beta"))
+	})
+	t.Run("States", func(t *testing.T) {
+		repo := newQueryRepo(start)
+		repo.notebooks["work"].notes["id_2"].Archived = true
+		repo.notebooks["home"].notes["id_3"].Pinned = true
+		repo.notebooks["home"].star("id_1", "alice", true)
+		// query calls QueryNotes as principal
+		query := func(principal, body string) []string {
+			r := httptest.NewRequest("GET", "/query", bytes.NewBufferString(body))
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, &requestInfo{principal: principal, logger: discardLogger}))
+			w := httptest.NewRecorder()
+			repo.QueryNotes(w, r)
+			assert.Equal(t, 200, w.Code)
+			result := &QueryNotesResponse{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+			for _, r := range result.Results {
+				assert.Equal(t, principal == "alice" && r.Note.Id == "id_1", r.Note.Starred)
+			}
+			return refs(result)
+		}
+
+		assert.Equal(t, []string{"work/id_0", "home/id_1", "home/id_3", "work/id_4", "home/id_5"}, query("alice", `{}`))
+		assert.Equal(t, []string{"work/id_2"}, query("alice", `{"archived": "only"}`))
+		assert.Equal(t, []string{"home/id_3"}, query("alice", `{"pinned": "only"}`))
+		assert.Equal(t, []string{"home/id_1"}, query("alice", `{"starred": "only"}`))
+		assert.Empty(t, query("bob", `{"starred": "only"}`))
+		assert.Len(t, query("bob", `{"archived": "include"}`), 6)
+	})
+	t.Run("InvalidPageToken", func(t *testing.T) {
+		code, _ := query(newQueryRepo(start), `{"page_token": "not a token"}`)
+
+		assert.Equal(t, 400, code)
+	})
+	t.Run("NegativePageSize", func(t *testing.T) {
+		code, _ := query(newQueryRepo(start), `{"page_size": -1}`)
+
+		assert.Equal(t, 400, code)
+	})
+}
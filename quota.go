@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// quotaError reports a change that would take a notebook over its quota
+type quotaError struct {
+	notebook string
+	reason   string
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("Notebook '%s' quota exceeded: %s", e.notebook, e.reason)
+}
+
+// errorStatus maps an error returned while storing a note to the status
+// code of the response
+func errorStatus(err error) int {
+	if _, ok := err.(*quotaError); ok {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// notebookUsage is what a notebook holds, counted against its quota
+type notebookUsage struct {
+	notes     int64
+	bodyBytes int64
+}
+
+// usage returns what the notebook holds, notebooks built without usage
+// counters count their notes
+func (nb Notebook) usage() notebookUsage {
+	if nb.used != nil {
+		return *nb.used
+	}
+	usage := notebookUsage{notes: int64(len(nb.notes))}
+	for _, note := range nb.notes {
+		usage.bodyBytes += int64(len(note.Body))
+	}
+	return usage
+}
+
+// with returns the usage once note is stored, old is the note it replaces
+// or nil for a new note
+func (u notebookUsage) with(old, note *Note) notebookUsage {
+	if old == nil {
+		u.notes++
+	} else {
+		u.bodyBytes -= int64(len(old.Body))
+	}
+	u.bodyBytes += int64(len(note.Body))
+	return u
+}
+
+// put counts note in place of old, old being nil for a new note. Usage is
+// kept up to date by Notebook.putNote and Notebook.removeNote
+func (u *notebookUsage) put(old, note *Note) {
+	if u == nil {
+		return
+	}
+	*u = u.with(old, note)
+}
+
+// remove stops counting old, which may be nil
+func (u *notebookUsage) remove(old *Note) {
+	if u == nil || old == nil {
+		return
+	}
+	u.notes--
+	u.bodyBytes -= int64(len(old.Body))
+}
+
+// check returns a quotaError when storing note in the notebook named name
+// would exceed q, old is the note it replaces or nil for a new note
+func (q QuotaConfig) check(name string, nb Notebook, old, note *Note) error {
+	return q.checkUsage(name, nb.usage(), old, note)
+}
+
+// checkUsage is check against a notebook currently holding usage
+func (q QuotaConfig) checkUsage(name string, usage notebookUsage, old, note *Note) error {
+	if q.MaxTagsPerNote != 0 && int64(len(note.Tags)) > q.MaxTagsPerNote {
+		return &quotaError{name, fmt.Sprintf("a note holds at most %d tags", q.MaxTagsPerNote)}
+	}
+
+	usage = usage.with(old, note)
+	if q.MaxNotes != 0 && usage.notes > q.MaxNotes {
+		return &quotaError{name, fmt.Sprintf("a notebook holds at most %d notes", q.MaxNotes)}
+	}
+	if q.MaxBodyBytes != 0 && usage.bodyBytes > q.MaxBodyBytes {
+		return &quotaError{name, fmt.Sprintf("the notes of a notebook hold at most %d bytes", q.MaxBodyBytes)}
+	}
+	return nil
+}
+
+// GetUsage takes a request body attempting to deserialise it to a
+// GetUsageRequest object, responding with the usage and quota of the
+// notebook
+func (n *NotebookRepo) GetUsage(w http.ResponseWriter, r *http.Request) {
+	body := &GetUsageRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, ok := n.notebooks[body.GetName()]
+	if !ok {
+		errMsg := fmt.Sprintf("Notebook with name '%s' does not exist", body.GetName())
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	usage := notebook.usage()
+	result := &GetUsageResponse{
+		Name:      body.GetName(),
+		Notes:     usage.notes,
+		BodyBytes: usage.bodyBytes,
+		Tags:      int64(len(notebook.tags)),
+		Quota: &NotebookQuota{
+			MaxNotes:           n.quota.MaxNotes,
+			MaxBodyBytes:       n.quota.MaxBodyBytes,
+			MaxTagsPerNote:     n.quota.MaxTagsPerNote,
+			MaxAttachmentBytes: n.quota.MaxAttachmentBytes,
+		},
+		AttachmentBytes: notebook.attachmentBytes(),
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuota(t *testing.T) {
+	cfg := defaultConfig()
+	repo := NewNotebookRepo(nil)
+	repo.quota = QuotaConfig{MaxNotes: 2, MaxBodyBytes: 10, MaxTagsPerNote: 2}
+	router := newRouter(repo, newHealth(), cfg)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	assert.Equal(t, 200, request("POST", "/notebook", `{"name": "quota_notebook"}`).Code)
+
+	created := request("POST", "/note", `{"notebook_name": "quota_notebook", "title": "title_1", "body": "body_1"}`)
+	assert.Equal(t, 200, created.Code)
+	note := &CreateNoteResponse{}
+	assert.NoError(t, json.Unmarshal(created.Body.Bytes(), note))
+
+	t.Run("MaxTagsPerNote/Forbidden", func(t *testing.T) {
+		w := request("POST", "/note", `{"notebook_name": "quota_notebook", "title": "title_2", "body": "b", "tags": ["a", "b", "c"]}`)
+
+		assert.Equal(t, 403, w.Code)
+		assert.Contains(t, w.Body.String(), "at most 2 tags")
+	})
+	t.Run("MaxBodyBytes/Forbidden", func(t *testing.T) {
+		w := request("POST", "/note", `{"notebook_name": "quota_notebook", "title": "title_2", "body": "body_2"}`)
+
+		assert.Equal(t, 403, w.Code)
+		assert.Contains(t, w.Body.String(), "at most 10 bytes")
+	})
+	t.Run("MaxNotes/Forbidden", func(t *testing.T) {
+		assert.Equal(t, 200, request("POST", "/note", `{"notebook_name": "quota_notebook", "title": "title_2", "body": "b2"}`).Code)
+		w := request("POST", "/note", `{"notebook_name": "quota_notebook", "title": "title_3", "body": "b3"}`)
+
+		assert.Equal(t, 403, w.Code)
+		assert.Contains(t, w.Body.String(), "at most 2 notes")
+	})
+	t.Run("Usage", func(t *testing.T) {
+		w := request("GET", "/notebook/usage", `{"name": "quota_notebook"}`)
+		assert.Equal(t, 200, w.Code)
+
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		usage := &GetUsageResponse{}
+		assert.NoError(t, json.Unmarshal(body, usage))
+		assert.Equal(t, int64(2), usage.Notes)
+		assert.Equal(t, int64(8), usage.BodyBytes)
+		assert.Equal(t, int64(2), usage.Quota.MaxNotes)
+		assert.Equal(t, int64(10), usage.Quota.MaxBodyBytes)
+		assert.Equal(t, int64(2), usage.Quota.MaxTagsPerNote)
+	})
+	t.Run("UpdateNote", func(t *testing.T) {
+		// the replaced body no longer counts against the quota
+		ok := request("UPDATE", "/note", `{"notebook_name": "quota_notebook", "id": "`+note.Id+`", "title": "t", "body": "body_1_1"}`)
+		assert.Equal(t, 200, ok.Code)
+
+		w := request("UPDATE", "/note", `{"notebook_name": "quota_notebook", "id": "`+note.Id+`", "title": "t", "body": "body_1_1_1"}`)
+		assert.Equal(t, 403, w.Code)
+	})
+	t.Run("Usage/UnknownNotebook", func(t *testing.T) {
+		assert.Equal(t, 400, request("GET", "/notebook/usage", `{"name": "missing"}`).Code)
+	})
+}
+
+func TestNotebookUsage(t *testing.T) {
+	notebook := makeNotebook("usage_notebook", nil)
+	notebook.putNote(&Note{Id: "id_1", Body: "body_1"})
+	notebook.putNote(&Note{Id: "id_2", Body: "body_2"})
+	notebook.putNote(&Note{Id: "id_1", Body: "body_1_1"})
+	notebook.removeNote("id_2")
+	notebook.removeNote("missing")
+
+	assert.Equal(t, notebookUsage{notes: 1, bodyBytes: 8}, notebook.usage())
+	// the counters match what walking the notes finds
+	notebook.used = nil
+	assert.Equal(t, notebookUsage{notes: 1, bodyBytes: 8}, notebook.usage())
+}
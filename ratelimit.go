@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that refilled are dropped
+const sweepInterval = time.Minute
+
+// bucket is the token bucket of a single client on a single route
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	route  string
+	client string
+}
+
+// rateLimiter keeps a token bucket per client and route, clients are
+// identified by their principal or, when anonymous, their IP address
+type rateLimiter struct {
+	cfg RateLimitConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		cfg:     cfg,
+		now:     time.Now,
+		buckets: make(map[bucketKey]*bucket),
+	}
+}
+
+// limit returns the RateLimit applied to route
+func (l *rateLimiter) limit(route string) RateLimit {
+	if limit, ok := l.cfg.Routes[route]; ok {
+		return limit
+	}
+	return l.cfg.Default
+}
+
+// allow takes a token from the bucket of client on route, when none is
+// left it returns how long until the next one is available
+func (l *rateLimiter) allow(route, client string) (bool, time.Duration) {
+	limit := l.limit(route)
+	if limit.RequestsPerSecond <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	key := bucketKey{route: route, client: client}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.RequestsPerSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / limit.RequestsPerSecond
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops every bucket that refilled since it was last used, as it
+// behaves exactly like a new one, callers must hold l.mu
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		limit := l.limit(key.route)
+		if b.tokens+now.Sub(b.last).Seconds()*limit.RequestsPerSecond >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimitClient identifies who a request is counted against
+func rateLimitClient(r *http.Request) string {
+	if p := principal(r); p != anonymousPrincipal {
+		return p
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// middleware responds with 429 Too Many Requests once a client exhausted
+// its bucket for the requested route, Retry-After holds the seconds until
+// the next request is allowed
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, wait := l.allow(r.Method+" "+routeTemplate(r), rateLimitClient(r))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
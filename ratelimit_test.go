@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1591012800, 0)
+	limiter := newRateLimiter(RateLimitConfig{
+		Default: RateLimit{RequestsPerSecond: 1, Burst: 2},
+		Routes: map[string]RateLimit{
+			"GET /note": {},
+		},
+	})
+	limiter.now = func() time.Time { return now }
+
+	t.Run("Burst", func(t *testing.T) {
+		allowed, _ := limiter.allow("POST /note", "alice")
+		assert.True(t, allowed)
+		allowed, _ = limiter.allow("POST /note", "alice")
+		assert.True(t, allowed)
+		allowed, wait := limiter.allow("POST /note", "alice")
+		assert.False(t, allowed)
+		assert.Equal(t, time.Second, wait)
+	})
+	t.Run("Refill", func(t *testing.T) {
+		now = now.Add(500 * time.Millisecond)
+		allowed, wait := limiter.allow("POST /note", "alice")
+		assert.False(t, allowed)
+		assert.Equal(t, 500*time.Millisecond, wait)
+
+		now = now.Add(500 * time.Millisecond)
+		allowed, _ = limiter.allow("POST /note", "alice")
+		assert.True(t, allowed)
+	})
+	t.Run("SeparateClientsAndRoutes", func(t *testing.T) {
+		allowed, _ := limiter.allow("POST /note", "bob")
+		assert.True(t, allowed)
+		allowed, _ = limiter.allow("POST /notebook", "alice")
+		assert.True(t, allowed)
+	})
+	t.Run("RouteOverride/Unlimited", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			allowed, _ := limiter.allow("GET /note", "alice")
+			assert.True(t, allowed)
+		}
+	})
+	t.Run("Sweep", func(t *testing.T) {
+		assert.Len(t, limiter.buckets, 3)
+		now = now.Add(sweepInterval)
+		limiter.allow("POST /note", "alice")
+
+		assert.Len(t, limiter.buckets, 1)
+	})
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Limits.RateLimit.Routes = map[string]RateLimit{
+		"POST /notebook": {RequestsPerSecond: 0.1, Burst: 1},
+	}
+	router := newRouter(NewNotebookRepo(nil), newHealth(), cfg)
+	post := func(remoteAddr, name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/notebook", bytes.NewBufferString(`{"name": "`+name+`"}`))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 200, post("192.0.2.1:1234", "notebook_1").Code)
+	limited := post("192.0.2.1:5678", "notebook_2")
+	assert.Equal(t, 429, limited.Code)
+	assert.Equal(t, "10", limited.Header().Get("Retry-After"))
+	assert.Equal(t, 200, post("192.0.2.2:1234", "notebook_2").Code)
+
+	// routes without a limit are not counted
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, w.Code)
+}
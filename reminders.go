@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// defaultReminderInterval is how often due reminders are looked for when
+// reminders.interval is not configured
+const defaultReminderInterval = 10 * time.Second
+
+// maxReminderEvents bounds the events kept for ListReminderEvents, the
+// oldest are dropped first
+const maxReminderEvents = 1000
+
+// webhookTimeout bounds the delivery of an event to reminders.webhook_url
+const webhookTimeout = 5 * time.Second
+
+// events are delivered to the webhook by webhookWorkers goroutines, at most
+// maxQueuedDeliveries of them waiting for one
+const (
+	webhookWorkers      = 4
+	maxQueuedDeliveries = 1000
+)
+
+// recurrence frequencies, a subset of the FREQ values of RFC 5545
+const (
+	freqHourly  = "HOURLY"
+	freqDaily   = "DAILY"
+	freqWeekly  = "WEEKLY"
+	freqMonthly = "MONTHLY"
+	freqYearly  = "YEARLY"
+)
+
+// maxRecurrenceInterval bounds the INTERVAL of a recurrence rule
+const maxRecurrenceInterval = 1000
+
+// recurrence is a parsed recurrence rule such as FREQ=WEEKLY;INTERVAL=2,
+// occurrences past until are not fired
+type recurrence struct {
+	freq     string
+	interval int
+	until    time.Time
+}
+
+// parseRecurrence parses a rule made of the FREQ, INTERVAL and UNTIL parts
+// of an RFC 5545 RRULE, UNTIL being an RFC 3339 time or a 2006-01-02 date
+func parseRecurrence(rule string) (recurrence, error) {
+	r := recurrence{interval: 1}
+	for _, part := range strings.Split(rule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return recurrence{}, fmt.Errorf("invalid recurrence part '%s', expected KEY=VALUE", part)
+		}
+		value := kv[1]
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			switch strings.ToUpper(value) {
+			case freqHourly, freqDaily, freqWeekly, freqMonthly, freqYearly:
+				r.freq = strings.ToUpper(value)
+			default:
+				return recurrence{}, fmt.Errorf("unknown recurrence FREQ '%s', expected %s, %s, %s, %s or %s",
+					value, freqHourly, freqDaily, freqWeekly, freqMonthly, freqYearly)
+			}
+		case "INTERVAL":
+			interval, err := strconv.Atoi(value)
+			if err != nil || interval < 1 || interval > maxRecurrenceInterval {
+				return recurrence{}, fmt.Errorf("recurrence INTERVAL must be between 1 and %d", maxRecurrenceInterval)
+			}
+			r.interval = interval
+		case "UNTIL":
+			until, ok := parseFilterTime(value)
+			if !ok {
+				return recurrence{}, fmt.Errorf("recurrence UNTIL '%s' must be an RFC 3339 time or a 2006-01-02 date", value)
+			}
+			r.until, _ = ptypes.Timestamp(until)
+		default:
+			return recurrence{}, fmt.Errorf("unsupported recurrence part '%s'", kv[0])
+		}
+	}
+	if r.freq == "" {
+		return recurrence{}, fmt.Errorf("recurrence requires FREQ")
+	}
+	return r, nil
+}
+
+// step returns the occurrence following t
+func (r recurrence) step(t time.Time) time.Time {
+	switch r.freq {
+	case freqHourly:
+		return t.Add(time.Duration(r.interval) * time.Hour)
+	case freqDaily:
+		return t.AddDate(0, 0, r.interval)
+	case freqWeekly:
+		return t.AddDate(0, 0, 7*r.interval)
+	case freqMonthly:
+		return t.AddDate(0, r.interval, 0)
+	}
+	return t.AddDate(r.interval, 0, 0)
+}
+
+// period returns the fixed duration between occurrences, or zero when it
+// depends on the calendar. Times are UTC so days are always 24 hours long
+func (r recurrence) period() time.Duration {
+	switch r.freq {
+	case freqHourly:
+		return time.Duration(r.interval) * time.Hour
+	case freqDaily:
+		return time.Duration(r.interval) * 24 * time.Hour
+	case freqWeekly:
+		return time.Duration(r.interval) * 7 * 24 * time.Hour
+	}
+	return 0
+}
+
+// after returns the first occurrence following from that is later than
+// now, along with the number of occurrences skipped in between. ok is false
+// when that occurrence is past until
+func (r recurrence) after(from, now time.Time) (next time.Time, skipped int64, ok bool) {
+	bound := now
+	if !r.until.IsZero() && r.until.Before(now) {
+		bound = r.until
+	}
+	next = r.step(from)
+	if period := r.period(); period > 0 && !next.After(bound) {
+		// jump over the missed occurrences rather than stepping through
+		// each of them
+		skipped = int64(bound.Sub(next) / period)
+		next = next.Add(time.Duration(skipped) * period)
+	}
+	for !next.After(bound) {
+		next = r.step(next)
+		skipped++
+	}
+	return next, skipped, r.until.IsZero() || !next.After(r.until)
+}
+
+// checkReminder returns an error when a reminder cannot be scheduled
+func checkReminder(remindAt *timestamp.Timestamp, rule string) error {
+	if remindAt != nil {
+		if _, err := ptypes.Timestamp(remindAt); err != nil {
+			return fmt.Errorf("invalid remind_at: %v", err)
+		}
+	}
+	if rule == "" {
+		return nil
+	}
+	if remindAt == nil {
+		return fmt.Errorf("recurrence requires remind_at")
+	}
+	_, err := parseRecurrence(rule)
+	return err
+}
+
+// pendingReminder reports whether the reminder of note has yet to fire
+func pendingReminder(note *Note) bool {
+	return note.GetRemindAt() != nil &&
+		(note.GetRemindedAt() == nil || timestampNanos(note.GetRemindedAt()) < timestampNanos(note.GetRemindAt()))
+}
+
+// reminderIndex indexes the notes holding a reminder by remind_at, pending
+// only holding those whose reminder has yet to fire. It is kept up to date
+// by Notebook.putNote and Notebook.removeNote
+type reminderIndex struct {
+	due     sortedIndex
+	pending sortedIndex
+	indexed map[string]sortedEntry
+}
+
+func newReminderIndex() *reminderIndex {
+	return &reminderIndex{indexed: make(map[string]sortedEntry)}
+}
+
+// put indexes the reminder of note, replacing any previous version
+func (x *reminderIndex) put(note *Note) {
+	if x == nil {
+		return
+	}
+	x.remove(note.Id)
+	if note.GetRemindAt() == nil {
+		return
+	}
+	entry := sortedEntry{num: timestampNanos(note.GetRemindAt()), id: note.Id}
+	x.due.insert(entry)
+	if pendingReminder(note) {
+		x.pending.insert(entry)
+	}
+	x.indexed[note.Id] = entry
+}
+
+// remove drops the reminder of the note with id
+func (x *reminderIndex) remove(id string) {
+	if x == nil {
+		return
+	}
+	entry, ok := x.indexed[id]
+	if !ok {
+		return
+	}
+	x.due.remove(entry)
+	x.pending.remove(entry)
+	delete(x.indexed, id)
+}
+
+// reminderIndex returns the reminder index of the notebook, notebooks
+// built without one get an index computed from their notes
+func (nb Notebook) reminderIndex() *reminderIndex {
+	if nb.reminders != nil {
+		return nb.reminders
+	}
+	index := newReminderIndex()
+	for _, note := range nb.notes {
+		index.put(note)
+	}
+	return index
+}
+
+// reminderScheduler fires the reminders of every notebook once due. Each
+// firing is recorded as a ReminderEvent and queued for delivery to
+// webhookURL when set
+type reminderScheduler struct {
+	repo       *NotebookRepo
+	now        func() time.Time
+	interval   time.Duration
+	webhookURL string
+	client     *http.Client
+	deliveries chan *ReminderEvent
+
+	mu       sync.Mutex
+	events   []*ReminderEvent
+	sequence int64
+}
+
+func newReminderScheduler(repo *NotebookRepo) *reminderScheduler {
+	return &reminderScheduler{
+		repo:     repo,
+		now:      time.Now,
+		interval: defaultReminderInterval,
+		client:   &http.Client{Timeout: webhookTimeout},
+
+		deliveries: make(chan *ReminderEvent, maxQueuedDeliveries),
+	}
+}
+
+// run fires due reminders every interval until stop is closed, delivering
+// the events to the webhook alongside. Reminders missed while the server
+// was down are caught up by the first firing
+func (s *reminderScheduler) run(stop <-chan struct{}) {
+	var workers sync.WaitGroup
+	for i := 0; i < webhookWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.deliverQueued(stop)
+		}()
+	}
+	defer workers.Wait()
+
+	s.fire()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.fire()
+		}
+	}
+}
+
+// fire fires every reminder due at s.now(), returning the events recorded
+func (s *reminderScheduler) fire() []*ReminderEvent {
+	now := s.now().UTC()
+	var events []*ReminderEvent
+
+	s.repo.mu.Lock()
+	names := make([]string, 0, len(s.repo.notebooks))
+	for name := range s.repo.notebooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		notebook := s.repo.notebooks[name]
+		for _, id := range notebook.reminderIndex().pending.between(math.MinInt64, now.UnixNano()+1) {
+			if note, ok := notebook.notes[id]; ok {
+				events = append(events, s.fireNote(name, notebook, note, now))
+			}
+		}
+	}
+	s.repo.mu.Unlock()
+
+	s.record(events)
+	for _, event := range events {
+		s.enqueue(event)
+	}
+	return events
+}
+
+// fireNote marks the reminder of note as fired, moving recurring reminders
+// to their next occurrence, and returns the event of the firing
+func (s *reminderScheduler) fireNote(name string, notebook Notebook, note *Note, now time.Time) *ReminderEvent {
+	remindAt, _ := ptypes.Timestamp(note.GetRemindAt())
+	firedAt, _ := ptypes.TimestampProto(now)
+	event := &ReminderEvent{
+		NotebookName: name,
+		NoteId:       note.Id,
+		Title:        note.Title,
+		RemindAt:     note.RemindAt,
+		FiredAt:      firedAt,
+		Late:         now.Sub(remindAt) > s.interval,
+	}
+
+	fired := proto.Clone(note).(*Note)
+	fired.RemindedAt = note.RemindAt
+	if rule, err := parseRecurrence(note.GetRecurrence()); note.GetRecurrence() != "" && err == nil {
+		next, skipped, ok := rule.after(remindAt, now)
+		event.Skipped = skipped
+		if ok {
+			fired.RemindAt, _ = ptypes.TimestampProto(next)
+		}
+	}
+	notebook.putNote(fired)
+	return event
+}
+
+// record numbers events and keeps them for ListReminderEvents
+func (s *reminderScheduler) record(events []*ReminderEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range events {
+		s.sequence++
+		event.Sequence = s.sequence
+		s.events = append(s.events, event)
+	}
+	if len(s.events) > maxReminderEvents {
+		s.events = append([]*ReminderEvent(nil), s.events[len(s.events)-maxReminderEvents:]...)
+	}
+}
+
+// since returns the recorded events of a notebook following sequence
+func (s *reminderScheduler) since(notebookName string, sequence int64) []*ReminderEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.events), func(i int) bool { return s.events[i].Sequence > sequence })
+	var events []*ReminderEvent
+	for _, event := range s.events[i:] {
+		if event.NotebookName == notebookName {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// enqueue queues event for delivery to the webhook without waiting, the
+// event is dropped when the queue is full and remains available through
+// ListReminderEvents
+func (s *reminderScheduler) enqueue(event *ReminderEvent) {
+	if s.webhookURL == "" {
+		return
+	}
+	select {
+	case s.deliveries <- event:
+	default:
+		s.repo.logger.Warn("Reminder webhook queue is full, dropping event",
+			"notebook_name", event.NotebookName, "note_id", event.NoteId, "sequence", event.Sequence)
+	}
+}
+
+// deliverQueued delivers the queued events until stop is closed
+func (s *reminderScheduler) deliverQueued(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-s.deliveries:
+			s.deliver(event)
+		}
+	}
+}
+
+// deliver posts event to the webhook, failures are logged and the event
+// remains available through ListReminderEvents
+func (s *reminderScheduler) deliver(event *ReminderEvent) {
+	if s.webhookURL == "" {
+		return
+	}
+	logger := s.repo.logger.With("notebook_name", event.NotebookName, "note_id", event.NoteId, "sequence", event.Sequence)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("Unable to marshal reminder event", "error", err)
+		return
+	}
+	resp, err := s.client.Post(s.webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		logger.Warn("Unable to deliver reminder event", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warn("Reminder webhook refused event", "status", resp.StatusCode)
+	}
+}
+
+// ListDueNotes takes a request body attempting to deserialise it to a
+// ListDueNotesRequest object
+func (n *NotebookRepo) ListDueNotes(w http.ResponseWriter, r *http.Request) {
+	body := &ListDueNotesRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	before := n.scheduler.now().UnixNano()
+	if body.GetBefore() != nil {
+		before = timestampNanos(body.GetBefore())
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &ListDueNotesResponse{NotebookName: body.GetNotebookName()}
+	for _, id := range notebook.reminderIndex().due.between(math.MinInt64, before+1) {
+		// due notes are listed without their body
+		note := proto.Clone(notebook.notes[id]).(*Note)
+		note.Body = ""
+		result.Notes = append(result.Notes, note)
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// ListReminderEvents takes a request body attempting to deserialise it to
+// a ListReminderEventsRequest object
+func (n *NotebookRepo) ListReminderEvents(w http.ResponseWriter, r *http.Request) {
+	body := &ListReminderEventsRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	_, err := n.lookupNotebook(body.GetNotebookName())
+	n.mu.RUnlock()
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &ListReminderEventsResponse{
+		NotebookName: body.GetNotebookName(),
+		Events:       n.scheduler.since(body.GetNotebookName(), body.GetAfterSequence()),
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecurrence(t *testing.T) {
+	at := func(s string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, s)
+		assert.NoError(t, err)
+		return parsed
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for rule, expected := range map[string]string{
+			"":                         "invalid recurrence part ''",
+			"FREQ=SECONDLY":            "unknown recurrence FREQ 'SECONDLY'",
+			"FREQ=DAILY;INTERVAL=0":    "recurrence INTERVAL must be between 1 and 1000",
+			"FREQ=DAILY;UNTIL=someday": "recurrence UNTIL 'someday' must be",
+			"FREQ=DAILY;COUNT=3":       "unsupported recurrence part 'COUNT'",
+			"INTERVAL=2":               "recurrence requires FREQ",
+		} {
+			_, err := parseRecurrence(rule)
+			if assert.Error(t, err, rule) {
+				assert.Contains(t, err.Error(), expected, rule)
+			}
+		}
+	})
+	t.Run("After", func(t *testing.T) {
+		tests := []struct {
+			rule, from, now string
+			next            string
+			skipped         int64
+			ok              bool
+		}{
+			{"FREQ=DAILY", "2020-01-01T09:00:00Z", "2020-01-01T09:00:05Z", "2020-01-02T09:00:00Z", 0, true},
+			{"freq=daily;interval=2", "2020-01-01T09:00:00Z", "2020-01-08T10:00:00Z", "2020-01-09T09:00:00Z", 3, true},
+			{"FREQ=HOURLY", "2020-01-01T09:00:00Z", "2020-01-01T12:00:00Z", "2020-01-01T13:00:00Z", 3, true},
+			{"FREQ=WEEKLY", "2020-01-01T09:00:00Z", "2020-01-02T00:00:00Z", "2020-01-08T09:00:00Z", 0, true},
+			{"FREQ=MONTHLY", "2020-01-15T09:00:00Z", "2020-04-01T00:00:00Z", "2020-04-15T09:00:00Z", 2, true},
+			{"FREQ=YEARLY", "2020-02-01T00:00:00Z", "2020-02-01T00:00:00Z", "2021-02-01T00:00:00Z", 0, true},
+			{"FREQ=DAILY;UNTIL=2020-01-03", "2020-01-01T09:00:00Z", "2020-01-01T10:00:00Z", "2020-01-02T09:00:00Z", 0, true},
+			{"FREQ=DAILY;UNTIL=2020-01-03", "2020-01-02T09:00:00Z", "2020-01-02T10:00:00Z", "2020-01-03T09:00:00Z", 0, false},
+			{"FREQ=DAILY;UNTIL=2020-01-03T12:00:00Z", "2020-01-01T09:00:00Z", "2020-01-10T00:00:00Z", "2020-01-04T09:00:00Z", 2, false},
+		}
+		for _, test := range tests {
+			rule, err := parseRecurrence(test.rule)
+			assert.NoError(t, err)
+			next, skipped, ok := rule.after(at(test.from), at(test.now))
+
+			assert.Equal(t, at(test.next), next, test.rule)
+			assert.Equal(t, test.skipped, skipped, test.rule)
+			assert.Equal(t, test.ok, ok, test.rule)
+		}
+	})
+}
+
+// newRemindersRepo holds an empty notebook, its scheduler reading the time
+// from clock
+func newRemindersRepo(clock *time.Time) *NotebookRepo {
+	repo := newTestRepo("reminders_notebook")
+	repo.scheduler.interval = time.Minute
+	repo.scheduler.now = func() time.Time { return *clock }
+	return repo
+}
+
+func TestReminders(t *testing.T) {
+	start := time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)
+	request := func(repo *NotebookRepo, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		newRouter(repo, newHealth(), defaultConfig()).ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	create := func(repo *NotebookRepo, title, reminder string) string {
+		w := request(repo, "POST", "/note", `{"notebook_name": "reminders_notebook", "title": "`+title+`", "body": "b"`+reminder+`}`)
+		assert.Equal(t, 200, w.Code, w.Body.String())
+		result := &CreateNoteResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		return result.Id
+	}
+	due := func(repo *NotebookRepo, body string) []string {
+		w := request(repo, "GET", "/notebook/due", body)
+		assert.Equal(t, 200, w.Code)
+		result := &ListDueNotesResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		var titles []string
+		for _, note := range result.Notes {
+			titles = append(titles, note.Title)
+		}
+		return titles
+	}
+
+	t.Run("Fire", func(t *testing.T) {
+		clock := start
+		repo := newRemindersRepo(&clock)
+		once := create(repo, "once", `, "remind_at": "2020-01-01T10:00:00Z"`)
+		daily := create(repo, "daily", `, "remind_at": "2020-01-01T09:30:00Z", "recurrence": "FREQ=DAILY"`)
+		create(repo, "none", "")
+
+		assert.Empty(t, repo.scheduler.fire())
+		assert.Empty(t, due(repo, `{"notebook_name": "reminders_notebook"}`))
+		assert.Equal(t, []string{"daily", "once"}, due(repo, `{"notebook_name": "reminders_notebook", "before": "2020-01-01T10:00:00Z"}`))
+
+		clock = start.Add(time.Hour)
+		events := repo.scheduler.fire()
+		if assert.Len(t, events, 2) {
+			assert.Equal(t, daily, events[0].NoteId)
+			assert.Equal(t, int64(1), events[0].Sequence)
+			assert.Equal(t, once, events[1].NoteId)
+			assert.Equal(t, "reminders_notebook", events[1].NotebookName)
+			assert.False(t, events[1].Late)
+			assert.Equal(t, int64(0), events[1].Skipped)
+		}
+		assert.Empty(t, repo.scheduler.fire())
+
+		notes := repo.notebooks["reminders_notebook"].notes
+		assert.Equal(t, int64(1577957400), notes[daily].RemindAt.Seconds)
+		assert.Equal(t, int64(1577871000), notes[daily].RemindedAt.Seconds)
+		assert.True(t, proto.Equal(notes[once].RemindAt, notes[once].RemindedAt))
+		assert.Nil(t, notes[once].LastModified)
+		// fired one-off reminders stay due until they are changed
+		assert.Equal(t, []string{"once"}, due(repo, `{"notebook_name": "reminders_notebook"}`))
+
+		w := request(repo, "GET", "/notebook/reminders/events", `{"notebook_name": "reminders_notebook", "after_sequence": 1}`)
+		assert.Equal(t, 200, w.Code)
+		result := &ListReminderEventsResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		if assert.Len(t, result.Events, 1) {
+			assert.Equal(t, once, result.Events[0].NoteId)
+			assert.Equal(t, int64(2), result.Events[0].Sequence)
+		}
+	})
+	t.Run("CatchUp", func(t *testing.T) {
+		clock := start.Add(3*24*time.Hour + time.Hour)
+		repo := newRemindersRepo(&clock)
+		id := create(repo, "daily", `, "remind_at": "2020-01-01T09:00:00Z", "recurrence": "FREQ=DAILY"`)
+
+		events := repo.scheduler.fire()
+		if assert.Len(t, events, 1) {
+			assert.True(t, events[0].Late)
+			assert.Equal(t, int64(3), events[0].Skipped)
+			assert.Equal(t, int64(1577869200), events[0].RemindAt.Seconds)
+		}
+		next, _ := ptypes.Timestamp(repo.notebooks["reminders_notebook"].notes[id].RemindAt)
+		assert.Equal(t, start.AddDate(0, 0, 4), next)
+	})
+	t.Run("Update", func(t *testing.T) {
+		clock := start.Add(2 * time.Hour)
+		repo := newRemindersRepo(&clock)
+		id := create(repo, "once", `, "remind_at": "2020-01-01T10:00:00Z"`)
+		assert.Len(t, repo.scheduler.fire(), 1)
+
+		w := request(repo, "UPDATE", "/note", `{"notebook_name": "reminders_notebook", "id": "`+id+`", "title": "once", "body": "b", "remind_at": "2020-01-01T10:00:00Z"}`)
+		assert.Equal(t, 200, w.Code)
+		assert.Empty(t, repo.scheduler.fire())
+
+		w = request(repo, "UPDATE", "/note", `{"notebook_name": "reminders_notebook", "id": "`+id+`", "title": "once", "body": "b", "remind_at": "2020-01-01T10:30:00Z"}`)
+		assert.Equal(t, 200, w.Code)
+		assert.Len(t, repo.scheduler.fire(), 1)
+
+		w = request(repo, "UPDATE", "/note", `{"notebook_name": "reminders_notebook", "id": "`+id+`", "title": "once", "body": "b"}`)
+		assert.Equal(t, 200, w.Code)
+		assert.Empty(t, due(repo, `{"notebook_name": "reminders_notebook"}`))
+	})
+	t.Run("Rename", func(t *testing.T) {
+		clock := start
+		repo := newRemindersRepo(&clock)
+		create(repo, "tagged", `, "tags": ["a"], "remind_at": "2020-01-01T10:00:00Z", "recurrence": "FREQ=WEEKLY"`)
+
+		w := request(repo, "POST", "/tag/rename", `{"notebook_name": "reminders_notebook", "name": "a", "new_name": "b"}`)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []string{"tagged"}, due(repo, `{"notebook_name": "reminders_notebook", "before": "2020-01-02T00:00:00Z"}`))
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		clock := start
+		for reminder, expected := range map[string]string{
+			`, "recurrence": "FREQ=DAILY"`:                                         "recurrence requires remind_at",
+			`, "remind_at": "2020-01-01T10:00:00Z", "recurrence": "FREQ=MINUTELY"`: "unknown recurrence FREQ",
+		} {
+			w := request(newRemindersRepo(&clock), "POST", "/note", `{"notebook_name": "reminders_notebook", "title": "t", "body": "b"`+reminder+`}`)
+			assert.Equal(t, 400, w.Code, reminder)
+			assert.Contains(t, w.Body.String(), expected, reminder)
+		}
+	})
+	t.Run("Webhook", func(t *testing.T) {
+		var mu sync.Mutex
+		var received []*ReminderEvent
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			event := &ReminderEvent{}
+			assert.NoError(t, json.Unmarshal(data, event))
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			mu.Lock()
+			received = append(received, event)
+			mu.Unlock()
+		}))
+		defer server.Close()
+
+		clock := start.Add(time.Hour)
+		repo := newRemindersRepo(&clock)
+		repo.scheduler.webhookURL = server.URL
+		id := create(repo, "once", `, "remind_at": "2020-01-01T10:00:00Z"`)
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			repo.scheduler.run(stop)
+			close(done)
+		}()
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(received) == 1
+		}, time.Second, time.Millisecond)
+		close(stop)
+		<-done
+
+		mu.Lock()
+		defer mu.Unlock()
+		if assert.Len(t, received, 1) {
+			assert.Equal(t, id, received[0].NoteId)
+			assert.Equal(t, int64(1), received[0].Sequence)
+		}
+	})
+	t.Run("Webhook/Queued", func(t *testing.T) {
+		clock := start.Add(time.Hour)
+		repo := newRemindersRepo(&clock)
+		repo.scheduler.webhookURL = "http://127.0.0.1:0"
+		create(repo, "once", `, "remind_at": "2020-01-01T10:00:00Z"`)
+
+		// firing only queues the event, the delivery workers are not running
+		assert.Len(t, repo.scheduler.fire(), 1)
+		assert.Len(t, repo.scheduler.deliveries, 1)
+	})
+	t.Run("Run", func(t *testing.T) {
+		clock := start.Add(time.Hour)
+		repo := newRemindersRepo(&clock)
+		repo.scheduler.interval = time.Millisecond
+		create(repo, "once", `, "remind_at": "2020-01-01T10:00:00Z"`)
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			repo.scheduler.run(stop)
+			close(done)
+		}()
+		assert.Eventually(t, func() bool { return len(repo.scheduler.since("reminders_notebook", 0)) == 1 }, time.Second, time.Millisecond)
+		close(stop)
+		<-done
+	})
+}
+
+func TestRemindersBackup(t *testing.T) {
+	clock := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	repo := newRemindersRepo(&clock)
+	remindAt, _ := ptypes.TimestampProto(clock.Add(-time.Hour))
+	repo.notebooks["reminders_notebook"].addNote(&Note{Id: "id_1", Title: "t", Body: "b", RemindAt: remindAt})
+	var buf bytes.Buffer
+	assert.NoError(t, writeBackup(&buf, repo.snapshot(), nil))
+	_, backups, _, err := readBackup(&buf)
+	assert.NoError(t, err)
+
+	// a restored repo catches up on the reminders missed in between
+	restored := newRemindersRepo(&clock)
+	restored.notebooks["reminders_notebook"] = restoreNotebook(backups[0], restored.global)
+	events := restored.scheduler.fire()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "id_1", events[0].NoteId)
+		assert.True(t, events[0].Late)
+	}
+}
@@ -3,40 +3,55 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"sync"
 
-	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/uuid"
 )
 
 const requiredProperty = "%s cannot be empty"
 
-// assertRequiredProperty is a convenience function to check if a request body
-// has a non zero length required string field
-func assertRequiredProperty(w http.ResponseWriter, property interface{}, propertyName string) error {
-	// NOTE For now only handle string casts
-	if strProperty, ok := property.(string); ok {
-		if strProperty == "" {
-			errMsg := fmt.Sprintf(requiredProperty, propertyName)
-			http.Error(w, errMsg, http.StatusBadRequest)
-			return fmt.Errorf(errMsg)
-		}
-	}
-	return nil
-}
-
 // NotebookRepo is an in memory db holding all notebooks
 type NotebookRepo struct {
+	// mu guards notebooks, handlers and background jobs must hold it
+	// for as long as they touch a Notebook
+	mu        sync.RWMutex
 	notebooks map[string]Notebook
+	imports   importJobs
+	logger    *Logger
+	// quota bounds every notebook, the zero value is unlimited
+	quota        QuotaConfig
+	maxBatchSize int64
+	idempotency  *idempotencyKeys
+	// global indexes the notes of every notebook for QueryNotes
+	global *globalIndex
+	// blobs stores the content of every attachment
+	blobs              *blobStore
+	maxAttachmentBytes int64
+	// scheduler fires the reminders of the notes of every notebook
+	scheduler *reminderScheduler
 }
 
-// NewNotebookRepo returns a reference to a NotebookRepo object
-func NewNotebookRepo() *NotebookRepo {
-	return &NotebookRepo{
-		notebooks: make(map[string]Notebook),
+// NewNotebookRepo returns a reference to a NotebookRepo object logging
+// through logger, a nil logger discards every entry
+func NewNotebookRepo(logger *Logger) *NotebookRepo {
+	if logger == nil {
+		logger = discardLogger
 	}
+	n := &NotebookRepo{
+		notebooks:    make(map[string]Notebook),
+		logger:       logger,
+		global:       newGlobalIndex(),
+		maxBatchSize: defaultMaxBatchSize,
+		idempotency:  newIdempotencyKeys(defaultIdempotencyTTL),
+		blobs:        newBlobStore(defaultAttachmentsDir),
+
+		maxAttachmentBytes: defaultMaxAttachmentBytes,
+	}
+	n.scheduler = newReminderScheduler(n)
+	return n
 }
 
 type tags map[string][]string
@@ -48,30 +63,79 @@ type Notebook struct {
 	// tags is a map with names as the key with values holding
 	// a slice of string note IDs
 	tags tags
+	// tree indexes tags by their / separated segments
+	tree *tagTree
+	// sorted indexes notes by timestamps, title and body length
+	sorted *noteIndexes
+	// links holds the links found in the body of each note
+	links *linkGraph
+	// attachments holds the attachments of each note by note ID
+	attachments map[string][]*Attachment
+	// templates holds the note templates of the notebook by name
+	templates map[string]*NoteTemplate
+	// properties indexes notes by the value of each of their properties
+	properties *propertyIndex
+	// schema holds the property definitions notes must conform to by
+	// name, notes may hold any property when it is empty
+	schema map[string]*PropertyDefinition
+	// reminders indexes the notes holding a reminder by remind_at
+	reminders *reminderIndex
+	// checklists holds the checklist progress of the notes by note ID
+	checklists *checklistIndex
+	// stars holds the principals who starred each note by note ID
+	stars map[string]map[string]bool
+	// used counts the notes and body bytes held against the quota
+	used *notebookUsage
+	// name and global reference the notes of the notebook in the index
+	// shared by every notebook of the repo
+	name   string
+	global *globalIndex
+}
+
+// makeNotebook returns an empty Notebook named name, its notes being
+// referenced in global
+func makeNotebook(name string, global *globalIndex) Notebook {
+	return Notebook{
+		notes:  make(map[string]*Note),
+		tags:   make(tags),
+		tree:   newTagTree(),
+		sorted: newNoteIndexes(),
+		links:  newLinkGraph(),
+		name:   name,
+		global: global,
+
+		attachments: make(map[string][]*Attachment),
+		templates:   make(map[string]*NoteTemplate),
+		properties:  newPropertyIndex(),
+		schema:      make(map[string]*PropertyDefinition),
+		reminders:   newReminderIndex(),
+		checklists:  newChecklistIndex(),
+		stars:       make(map[string]map[string]bool),
+		used:        &notebookUsage{},
+	}
 }
 
 // CreateNotebook takes a response body attempting to deserialise it to a
 // CreateNotebookRequest object
 func (n *NotebookRepo) CreateNotebook(w http.ResponseWriter, r *http.Request) {
 	body := &CreateNotebookRequest{}
-	if err := jsonpb.Unmarshal(r.Body, body); err != nil {
-		log.Fatalf("Unable to unmarshal message from request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !n.decodeRequest(w, r, body) {
 		return
 	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	if _, ok := n.notebooks[body.GetName()]; ok {
 		http.Error(w, fmt.Sprintf("Notebook with name '%s' already exists", body.GetName()), http.StatusConflict)
 		return
 	}
-	n.notebooks[body.GetName()] = Notebook{
-		notes: make(map[string]*Note),
-		tags:  make(map[string][]string),
-	}
+	n.notebooks[body.GetName()] = makeNotebook(body.GetName(), n.global)
 
 	result := &CreateNotebookResponse{Name: body.GetName()}
 	response, err := json.Marshal(result)
 	if err != nil {
-		log.Fatalf("Unable to marshal response : %v", err)
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Write(response)
 
@@ -80,68 +144,52 @@ func (n *NotebookRepo) CreateNotebook(w http.ResponseWriter, r *http.Request) {
 // notesMeta is meant to be returned in a GetNotebookResponse.Notes slice
 type notesMeta []*Note
 
-// hasID checks if a noteID string is present in a notesMeta object
-// as a Note object
-func (m notesMeta) hasID(noteID string) bool {
-	for _, note := range m {
-		if note.Id == noteID {
-			return true
-		}
-	}
-	return false
-}
-
 // GetNotebook takes a response body attempting to deserialise it to a
 func (n *NotebookRepo) GetNotebook(w http.ResponseWriter, r *http.Request) {
 	body := &GetNotebookRequest{}
-	if err := jsonpb.Unmarshal(r.Body, body); err != nil {
-		log.Fatalf("Unable to unmarshal message from request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	where, err := parsePropertyFilter(body.GetWhere())
+	if err != nil {
+		n.writeBadRequest(w, r, []*FieldViolation{{Field: "where", Description: err.Error()}})
 		return
 	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 
 	notebook, ok := n.notebooks[body.GetName()]
 	if !ok {
 		errMsg := fmt.Sprintf("Notebook with name '%s' does not exist", body.GetName())
-		log.Fatalf(errMsg)
+		n.log(r).Error(errMsg)
 		http.Error(w, errMsg, http.StatusBadRequest)
 		return
 	}
 
 	var notes notesMeta
+	checklists := make(map[string]*ChecklistProgress)
 
-	for _, note := range notebook.notes {
-		if len(body.Tags) != 0 {
-			for _, tag := range body.Tags {
-				if notebook.tags.tagHoldsNoteID(tag, note.GetId()) && !notes.hasID(note.Id) {
-					notes = append(notes, &Note{
-						Id:      note.Id,
-						Title:   note.Title,
-						Body:    "",
-						Tags:    note.Tags,
-						Created: note.Created,
-					})
-				}
-			}
-		} else {
-			notes = append(notes, &Note{
-				Id:      note.Id,
-				Title:   note.Title,
-				Body:    "",
-				Tags:    note.Tags,
-				Created: note.Created,
-			})
+	for _, note := range notebook.filterStates(notebook.filterNotes(body, where), body, principal(r)) {
+		if progress, ok := notebook.checklistProgress(note.Id); ok {
+			checklists[note.Id] = progress
 		}
+		listed := proto.Clone(note).(*Note)
+		listed.Body = ""
+		listed.Starred = notebook.starred(note.Id, principal(r))
+		notes = append(notes, listed)
 	}
 
 	result := &GetNotebookResponse{
-		Name:  body.Name,
-		Notes: notes,
+		Name:       body.Name,
+		Notes:      notes,
+		Checklists: checklists,
 	}
 
 	response, err := json.Marshal(result)
 	if err != nil {
-		log.Fatalf("Unable to marshal response : %v", err)
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Write(response)
 
@@ -151,69 +199,163 @@ func (n *NotebookRepo) GetNotebook(w http.ResponseWriter, r *http.Request) {
 // CreateNotebookRequest object
 func (n *NotebookRepo) CreateNote(w http.ResponseWriter, r *http.Request) {
 	body := &CreateNoteRequest{}
-	if err := jsonpb.Unmarshal(r.Body, body); err != nil {
-		log.Fatalf("Unable to unmarshal message from request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !n.decodeRequest(w, r, body) {
 		return
 	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	notebook, ok := n.notebooks[body.GetNotebookName()]
-	if !ok {
-		errMsg := fmt.Sprintf("Notebook with name '%s' does not exist", body.GetNotebookName())
-		log.Fatalf(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+	note, err := n.createNote(body)
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
-	if err := assertRequiredProperty(w, body.Title, "title"); err != nil {
-		log.Fatalf(err.Error())
+	result := &CreateNoteResponse{Id: note.Id, Created: note.Created}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err := assertRequiredProperty(w, body.Body, "body"); err != nil {
-		log.Fatalf(err.Error())
-		return
+	w.Write(response)
+
+}
+
+// createNote validates a CreateNoteRequest and stores it as a new note in
+// the requested notebook, callers must hold n.mu for writing
+func (n *NotebookRepo) createNote(body *CreateNoteRequest) (*Note, error) {
+	notebook, note, err := n.newNote(body)
+	if err != nil {
+		return nil, err
 	}
+	notebook.addNote(note)
+	return note, nil
+}
 
-	id := uuid.New().String()
-	createdPb := ptypes.TimestampNow()
-	note := Note{
-		Id:      id,
-		Title:   body.Title,
-		Body:    body.Body,
-		Tags:    body.Tags,
-		Created: createdPb,
+// newNote validates a CreateNoteRequest and returns the note it creates
+// along with its notebook, without storing it
+func (n *NotebookRepo) newNote(body *CreateNoteRequest) (Notebook, *Note, error) {
+	notebook, ok := n.notebooks[body.GetNotebookName()]
+	if !ok {
+		return Notebook{}, nil, fmt.Errorf("Notebook with name '%s' does not exist", body.GetNotebookName())
 	}
 
-	notebook.notes[id] = &note
-	for _, tag := range note.Tags {
-		if !notebook.tags.tagHoldsNoteID(tag, id) {
-			notebook.tags[tag] = append(notebook.tags[tag], id)
-		}
+	if body.GetTitle() == "" {
+		return Notebook{}, nil, fmt.Errorf(requiredProperty, "title")
+	}
+	if body.GetBody() == "" {
+		return Notebook{}, nil, fmt.Errorf(requiredProperty, "body")
+	}
+	if err := notebook.checkProperties(body.GetProperties()); err != nil {
+		return Notebook{}, nil, err
+	}
+	if err := checkReminder(body.GetRemindAt(), body.GetRecurrence()); err != nil {
+		return Notebook{}, nil, err
 	}
 
-	result := &CreateNoteResponse{Id: id, Created: createdPb}
-	response, err := json.Marshal(result)
+	note := &Note{
+		Id:         uuid.New().String(),
+		Title:      body.Title,
+		Body:       body.Body,
+		Tags:       body.Tags,
+		Properties: body.Properties,
+		Created:    ptypes.TimestampNow(),
+		RemindAt:   body.RemindAt,
+		Recurrence: body.Recurrence,
+	}
+	if err := n.quota.check(body.GetNotebookName(), notebook, nil, note); err != nil {
+		return Notebook{}, nil, err
+	}
+	return notebook, note, nil
+}
+
+// lookupNotebook returns the notebook named name
+func (n *NotebookRepo) lookupNotebook(name string) (Notebook, error) {
+	notebook, ok := n.notebooks[name]
+	if !ok {
+		return Notebook{}, fmt.Errorf("Notebook with name '%s' does not exist", name)
+	}
+	return notebook, nil
+}
+
+// lookupNote returns a stored note along with its notebook
+func (n *NotebookRepo) lookupNote(notebookName, id string) (Notebook, *Note, error) {
+	notebook, err := n.lookupNotebook(notebookName)
 	if err != nil {
-		log.Fatalf("Unable to marshal response : %v", err)
+		return Notebook{}, nil, err
 	}
-	w.Write(response)
+	note, ok := notebook.notes[id]
+	if !ok {
+		return Notebook{}, nil, fmt.Errorf("Note with id '%s' does not exist", id)
+	}
+	return notebook, note, nil
+}
+
+// updateNote replaces the title, body, tags, properties and reminder of a
+// stored note, returning
+// the old and new notes. The tags index is left for the caller to update,
+// callers must hold n.mu for writing
+func (n *NotebookRepo) updateNote(body *UpdateNoteRequest) (notebook Notebook, old, note *Note, err error) {
+	notebook, old, err = n.lookupNote(body.GetNotebookName(), body.GetId())
+	if err != nil {
+		return Notebook{}, nil, nil, err
+	}
+	if err := notebook.checkProperties(body.GetProperties()); err != nil {
+		return Notebook{}, nil, nil, err
+	}
+	if err := checkReminder(body.GetRemindAt(), body.GetRecurrence()); err != nil {
+		return Notebook{}, nil, nil, err
+	}
+
+	// update with everyting from new note expect timestamps
+	note = proto.Clone(old).(*Note)
+	note.Title = body.Title
+	note.Body = body.Body
+	note.Tags = body.Tags
+	note.Properties = body.Properties
+	note.LastModified = ptypes.TimestampNow()
+	note.RemindAt = body.RemindAt
+	note.Recurrence = body.Recurrence
+	if err := n.quota.check(body.GetNotebookName(), notebook, old, note); err != nil {
+		return Notebook{}, nil, nil, err
+	}
+	notebook.putNote(note)
+	return notebook, old, note, nil
+}
 
+// deleteNote removes a stored note, returning it. The tags index is left
+// for the caller to update, callers must hold n.mu for writing
+func (n *NotebookRepo) deleteNote(body *DeleteNoteRequest) (Notebook, *Note, error) {
+	notebook, note, err := n.lookupNote(body.GetNotebookName(), body.GetId())
+	if err != nil {
+		return Notebook{}, nil, err
+	}
+	notebook.removeNote(note.Id)
+	return notebook, note, nil
 }
 
 // GetNote takes a response body attempting to deserialise it to a
 // GetNoteRequest object
 func (n *NotebookRepo) GetNote(w http.ResponseWriter, r *http.Request) {
 	body := &GetNoteRequest{}
-	if err := jsonpb.Unmarshal(r.Body, body); err != nil {
-		log.Fatalf("Unable to unmarshal message from request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// note links rendered to HTML point to the note in the query parameters
+	if query := r.URL.Query(); query.Get("id") != "" {
+		body.NotebookName, body.Id = query.Get("notebook_name"), query.Get("id")
+		if !n.validRequest(w, r, body) {
+			return
+		}
+	} else if !n.decodeRequest(w, r, body) {
 		return
 	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 
 	notebook, ok := n.notebooks[body.GetNotebookName()]
 	if !ok {
 		errMsg := fmt.Sprintf("Notebook with name '%s' does not exist", body.GetNotebookName())
-		log.Fatalf(errMsg)
+		n.log(r).Error(errMsg)
 		http.Error(w, errMsg, http.StatusBadRequest)
 		return
 	}
@@ -221,15 +363,30 @@ func (n *NotebookRepo) GetNote(w http.ResponseWriter, r *http.Request) {
 	note, ok := notebook.notes[body.GetId()]
 	if !ok {
 		errMsg := fmt.Sprintf("Note with id '%s' does not exist", body.GetId())
-		log.Fatalf(errMsg)
+		n.log(r).Error(errMsg)
 		http.Error(w, errMsg, http.StatusBadRequest)
 		return
 	}
 
+	if acceptsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src *")
+		w.Write([]byte(notebook.renderHTML(body.GetNotebookName(), note)))
+		return
+	}
 	result := &GetNoteResponse{Note: note}
+	if notebook.starred(note.Id, principal(r)) {
+		result.Note = proto.Clone(note).(*Note)
+		result.Note.Starred = true
+	}
+	if body.GetRenderHtml() {
+		result.Html = notebook.renderHTML(body.GetNotebookName(), note)
+	}
 	response, err := json.Marshal(result)
 	if err != nil {
-		log.Fatalf("Unable to marshal response : %v", err)
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Write(response)
 
@@ -239,61 +396,52 @@ func (n *NotebookRepo) GetNote(w http.ResponseWriter, r *http.Request) {
 // UpdateNotebookRequest object
 func (n *NotebookRepo) UpdateNote(w http.ResponseWriter, r *http.Request) {
 	body := &UpdateNoteRequest{}
-	if err := jsonpb.Unmarshal(r.Body, body); err != nil {
-		log.Fatalf("Unable to unmarshal message from request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	log.Println("UpdateNote: ", body)
-
-	notebook, ok := n.notebooks[body.GetNotebookName()]
-	if !ok {
-		errMsg := fmt.Sprintf("Notebook with name '%s' does not exist", body.GetNotebookName())
-		log.Fatalf(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+	if !n.decodeRequest(w, r, body) {
 		return
 	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.log(r).Debug("UpdateNote", "request", body)
 
-	note, ok := notebook.notes[body.GetId()]
-	if !ok {
-		errMsg := fmt.Sprintf("Note with id '%s' does not exist", body.GetId())
-		log.Fatalf(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+	notebook, old, note, err := n.updateNote(body)
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
 	// compiles a list of tag names to determine which
 	// ones should be added and removed by returning
 	// two distinct string slices for addion and removal
-	add, remove := tagsToAddAndRemove(note.Tags, body.Tags)
+	add, remove := tagsToAddAndRemove(old.Tags, note.Tags)
 
 	// removal first to marginally reduce O(n) complexity
 	// of addition
 	for _, tagName := range remove {
-		notebook.tags[tagName] = removeNoteID(notebook.tags[tagName], body.Id)
-		// if no noteIDs are left in the tag slice
-		if len(notebook.tags[tagName]) == 0 {
-			delete(notebook.tags, tagName)
-		}
+		notebook.unindexTag(tagName, body.Id)
 	}
 
 	for _, tagName := range add {
-		notebook.tags[tagName] = addNoteID(notebook.tags[tagName], body.Id)
+		notebook.indexTag(tagName, body.Id)
 	}
 
-	// update with everyting from new note expect timestamps
-	note = &Note{
-		Title:        body.Title,
-		Body:         body.Body,
-		Tags:         body.Tags,
-		Created:      note.Created,
-		LastModified: ptypes.TimestampNow(),
+	// links to the old title only break once no note holds it
+	var referrers []string
+	if title := notebook.orphanedTitle(old.Title); title != "" {
+		referrers = notebook.referrers(old, title, false)
+		if body.GetRewriteLinks() {
+			notebook.rewriteLinks(referrers, old, title, false, func(_, label string) string {
+				return wikiLink(note.Title, label)
+			})
+		}
 	}
 
-	result := &UpdateNoteResponse{Note: note}
+	result := &UpdateNoteResponse{Note: note, Referrers: referrers}
 	response, err := json.Marshal(result)
 	if err != nil {
-		log.Fatalf("Unable to marshal response : %v", err)
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Write(response)
 
@@ -303,26 +451,17 @@ func (n *NotebookRepo) UpdateNote(w http.ResponseWriter, r *http.Request) {
 // DeleteNotebookRequest object
 func (n *NotebookRepo) DeleteNote(w http.ResponseWriter, r *http.Request) {
 	body := &DeleteNoteRequest{}
-	if err := jsonpb.Unmarshal(r.Body, body); err != nil {
-		log.Fatalf("Unable to unmarshal message from request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !n.decodeRequest(w, r, body) {
 		return
 	}
-	log.Println("DeleteNote: ", body)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.log(r).Debug("DeleteNote", "request", body)
 
-	notebook, ok := n.notebooks[body.GetNotebookName()]
-	if !ok {
-		errMsg := fmt.Sprintf("Notebook with name '%s' does not exist", body.GetNotebookName())
-		log.Fatalf(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
-		return
-	}
-
-	note, ok := notebook.notes[body.GetId()]
-	if !ok {
-		errMsg := fmt.Sprintf("Note with id '%s' does not exist", body.GetId())
-		log.Fatalf(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+	notebook, note, err := n.deleteNote(body)
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -330,30 +469,88 @@ func (n *NotebookRepo) DeleteNote(w http.ResponseWriter, r *http.Request) {
 	_, remove := tagsToAddAndRemove(note.Tags, []string{""})
 
 	for _, tagName := range remove {
-		notebook.tags[tagName] = removeNoteID(notebook.tags[tagName], body.Id)
+		notebook.unindexTag(tagName, body.Id)
 	}
 
-	// once tags have been scrubbed, delete the key proper
-	delete(notebook.notes, body.GetId())
+	n.releaseAttachments(notebook, note.Id)
+	delete(notebook.stars, note.Id)
 
-	// update with everyting from new note expect timestamps
-	note = &Note{
-		Title:        note.Title,
-		Body:         note.Body,
-		Tags:         note.Tags,
-		Created:      note.Created,
-		LastModified: ptypes.TimestampNow(),
+	title := notebook.orphanedTitle(note.Title)
+	referrers := notebook.referrers(note, title, true)
+	if body.GetRewriteLinks() {
+		// links are replaced by the text they were displayed with
+		notebook.rewriteLinks(referrers, note, title, true, func(target, label string) string {
+			if label != "" {
+				return label
+			}
+			return target
+		})
 	}
 
-	result := &DeleteNoteResponse{Note: note}
+	// update with everyting from new note expect timestamps
+	note = proto.Clone(note).(*Note)
+	note.LastModified = ptypes.TimestampNow()
+
+	result := &DeleteNoteResponse{Note: note, Referrers: referrers}
 	response, err := json.Marshal(result)
 	if err != nil {
-		log.Fatalf("Unable to marshal response : %v", err)
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Write(response)
 
 }
 
+// addNote stores a note in the notebook and references its ID in every
+// tag it holds
+func (nb Notebook) addNote(note *Note) {
+	nb.putNote(note)
+	for _, tag := range note.Tags {
+		nb.indexTag(tag, note.Id)
+	}
+}
+
+// putNote stores note in the notebook, replacing any note with its ID. The
+// tags index is left for the caller to update
+func (nb Notebook) putNote(note *Note) {
+	nb.used.put(nb.notes[note.Id], note)
+	nb.notes[note.Id] = note
+	nb.sorted.put(note)
+	nb.links.put(note)
+	nb.properties.put(note)
+	nb.reminders.put(note)
+	nb.checklists.put(note)
+	nb.global.put(nb.name, note)
+}
+
+// removeNote removes the note with id from the notebook. The tags index is
+// left for the caller to update
+func (nb Notebook) removeNote(id string) {
+	nb.used.remove(nb.notes[id])
+	delete(nb.notes, id)
+	nb.sorted.remove(id)
+	nb.links.remove(id)
+	nb.properties.remove(id)
+	nb.reminders.remove(id)
+	nb.checklists.remove(id)
+	nb.global.remove(nb.name, id)
+}
+
+// rebuildTags discards the tags index of a notebook and recreates it
+// from the tags held by each note
+func (nb Notebook) rebuildTags() {
+	for tagName := range nb.tags {
+		delete(nb.tags, tagName)
+	}
+	nb.tree.reset()
+	for id, note := range nb.notes {
+		for _, tag := range note.Tags {
+			nb.indexTag(tag, id)
+		}
+	}
+}
+
 // tagHoldsNoteId is used to determine whether a Notebook.tags entry
 // holds a noteID reference
 func (t tags) tagHoldsNoteID(tagName, noteID string) bool {
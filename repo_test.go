@@ -39,8 +39,20 @@ var newNotebookNoBody = &NotebookRepo{
 	},
 }
 
+// newTestRepo holds a single notebook with the given name and notes, built
+// like any other notebook so that every index is kept
+func newTestRepo(name string, notes ...*Note) *NotebookRepo {
+	repo := NewNotebookRepo(nil)
+	notebook := makeNotebook(name, repo.global)
+	for _, note := range notes {
+		notebook.addNote(note)
+	}
+	repo.notebooks[name] = notebook
+	return repo
+}
+
 func TestCreateNotebook(t *testing.T) {
-	repo := NewNotebookRepo()
+	repo := NewNotebookRepo(nil)
 	t.Run("Success", func(t *testing.T) {
 		req := httptest.NewRequest(
 			"POST",
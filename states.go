@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// values of the pinned, archived and starred filters of a
+// GetNotebookRequest or a QueryNotesRequest, the empty value standing for
+// the default of each
+const (
+	stateInclude = "include"
+	stateExclude = "exclude"
+	stateOnly    = "only"
+)
+
+// matchesState reports whether a note holding state passes filter, fallback
+// being used when filter is empty
+func matchesState(filter, fallback string, state bool) bool {
+	if filter == "" {
+		filter = fallback
+	}
+	switch filter {
+	case stateExclude:
+		return !state
+	case stateOnly:
+		return state
+	}
+	return true
+}
+
+// starred reports whether principal starred the note with id, anonymous
+// requests have no stars
+func (nb Notebook) starred(id, principal string) bool {
+	return principal != anonymousPrincipal && nb.stars[id][principal]
+}
+
+// star stars or unstars the note with id for principal
+func (nb Notebook) star(id, principal string, starred bool) {
+	if !starred {
+		delete(nb.stars[id], principal)
+		if len(nb.stars[id]) == 0 {
+			delete(nb.stars, id)
+		}
+		return
+	}
+	if nb.stars[id] == nil {
+		nb.stars[id] = make(map[string]bool)
+	}
+	nb.stars[id][principal] = true
+}
+
+// collectStars drops the stars of the notes no longer held by the notebook
+func (nb Notebook) collectStars() {
+	for id := range nb.stars {
+		if _, ok := nb.notes[id]; !ok {
+			delete(nb.stars, id)
+		}
+	}
+}
+
+// filterStates returns the notes passing the pinned, archived and starred
+// filters of body, archived notes being excluded by default. Pinned notes
+// are sorted first, notes being otherwise sorted by creation time
+func (nb Notebook) filterStates(notes []*Note, body *GetNotebookRequest, principal string) []*Note {
+	var filtered []*Note
+	for _, note := range notes {
+		if !matchesState(body.GetPinned(), stateInclude, note.GetPinned()) ||
+			!matchesState(body.GetArchived(), stateExclude, note.GetArchived()) ||
+			!matchesState(body.GetStarred(), stateInclude, nb.starred(note.Id, principal)) {
+			continue
+		}
+		filtered = append(filtered, note)
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		a, b := filtered[i], filtered[j]
+		if a.GetPinned() != b.GetPinned() {
+			return a.GetPinned()
+		}
+		if created := timestampNanos(a.GetCreated()); created != timestampNanos(b.GetCreated()) {
+			return created < timestampNanos(b.GetCreated())
+		}
+		return a.Id < b.Id
+	})
+	return filtered
+}
+
+// PinNote takes a request body attempting to deserialise it to a
+// PinNoteRequest object
+func (n *NotebookRepo) PinNote(w http.ResponseWriter, r *http.Request) {
+	body := &PinNoteRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.setNoteState(w, r, body.GetNotebookName(), body.GetId(), func(_ Notebook, note *Note) {
+		note.Pinned = body.GetPinned()
+	})
+}
+
+// ArchiveNote takes a request body attempting to deserialise it to an
+// ArchiveNoteRequest object
+func (n *NotebookRepo) ArchiveNote(w http.ResponseWriter, r *http.Request) {
+	body := &ArchiveNoteRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.setNoteState(w, r, body.GetNotebookName(), body.GetId(), func(_ Notebook, note *Note) {
+		note.Archived = body.GetArchived()
+	})
+}
+
+// StarNote takes a request body attempting to deserialise it to a
+// StarNoteRequest object, stars being kept per principal so anonymous
+// requests are refused
+func (n *NotebookRepo) StarNote(w http.ResponseWriter, r *http.Request) {
+	body := &StarNoteRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	if principal(r) == anonymousPrincipal {
+		errMsg := "Starring a note requires an authenticated principal"
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusUnauthorized)
+		return
+	}
+	n.setNoteState(w, r, body.GetNotebookName(), body.GetId(), func(notebook Notebook, note *Note) {
+		notebook.star(note.Id, principal(r), body.GetStarred())
+	})
+}
+
+// setNoteState applies set to a copy of a stored note, storing the copy
+// when it differs. States are not edits of the note, last_modified is left
+// untouched
+func (n *NotebookRepo) setNoteState(w http.ResponseWriter, r *http.Request, notebookName, id string, set func(notebook Notebook, note *Note)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, note, err := n.lookupNote(notebookName, id)
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updated := proto.Clone(note).(*Note)
+	set(notebook, updated)
+	if !proto.Equal(updated, note) {
+		notebook.putNote(updated)
+	}
+
+	result := &NoteStateResponse{Note: proto.Clone(updated).(*Note)}
+	result.Note.Starred = notebook.starred(id, principal(r))
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoteStates(t *testing.T) {
+	newRepo := func() (*NotebookRepo, map[string]string) {
+		var notes []*Note
+		ids := make(map[string]string)
+		for i, title := range []string{"first", "second", "third"} {
+			note := &Note{Id: title + "-id", Title: title, Body: title, Tags: []string{"work"}, Created: &timestamp.Timestamp{Seconds: int64(i + 1)}}
+			notes = append(notes, note)
+			ids[title] = note.Id
+		}
+		return newTestRepo("state_notebook", notes...), ids
+	}
+	// request calls handler as principal, empty for anonymous requests
+	request := func(handler http.HandlerFunc, principal, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("UPDATE", "/", bytes.NewBufferString(body))
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, &requestInfo{principal: principal, logger: discardLogger}))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	titles := func(t *testing.T, w *httptest.ResponseRecorder) []string {
+		assert.Equal(t, 200, w.Code)
+		result := &GetNotebookResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		var titles []string
+		for _, note := range result.Notes {
+			titles = append(titles, note.Title)
+		}
+		return titles
+	}
+
+	t.Run("Pin", func(t *testing.T) {
+		repo, ids := newRepo()
+		w := request(repo.PinNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["third"]+`", "pinned": true}`)
+		assert.Equal(t, 200, w.Code)
+		result := &NoteStateResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		assert.True(t, result.Note.Pinned)
+		assert.Nil(t, result.Note.LastModified)
+
+		get := func(filter string) []string {
+			return titles(t, request(repo.GetNotebook, "", `{"name": "state_notebook"`+filter+`}`))
+		}
+		assert.Equal(t, []string{"third", "first", "second"}, get(""))
+		assert.Equal(t, []string{"third"}, get(`, "pinned": "only"`))
+		assert.Equal(t, []string{"first", "second"}, get(`, "pinned": "exclude"`))
+
+		request(repo.PinNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["third"]+`"}`)
+		assert.Equal(t, []string{"first", "second", "third"}, get(""))
+	})
+	t.Run("Archive", func(t *testing.T) {
+		repo, ids := newRepo()
+		w := request(repo.ArchiveNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["second"]+`", "archived": true}`)
+		assert.Equal(t, 200, w.Code)
+
+		get := func(filter string) []string {
+			return titles(t, request(repo.GetNotebook, "", `{"name": "state_notebook"`+filter+`}`))
+		}
+		assert.Equal(t, []string{"first", "third"}, get(""))
+		assert.Equal(t, []string{"first", "second", "third"}, get(`, "archived": "include"`))
+		assert.Equal(t, []string{"second"}, get(`, "archived": "only"`))
+		// tag filters are applied as before, the states on top of them
+		assert.Equal(t, []string{"second"}, get(`, "archived": "only", "tags": ["work"]`))
+		assert.Empty(t, get(`, "archived": "only", "title_prefix": "f"`))
+	})
+	t.Run("Star", func(t *testing.T) {
+		repo, ids := newRepo()
+		w := request(repo.StarNote, "alice", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`", "starred": true}`)
+		assert.Equal(t, 200, w.Code)
+		result := &NoteStateResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		assert.True(t, result.Note.Starred)
+		assert.False(t, repo.notebooks["state_notebook"].notes[ids["first"]].Starred)
+
+		get := func(principal string) *GetNotebookResponse {
+			w := request(repo.GetNotebook, principal, `{"name": "state_notebook", "starred": "only"}`)
+			assert.Equal(t, 200, w.Code)
+			result := &GetNotebookResponse{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+			return result
+		}
+		alice := get("alice")
+		assert.Len(t, alice.Notes, 1)
+		assert.True(t, alice.Notes[0].Starred)
+		assert.Empty(t, get("bob").Notes)
+		assert.Empty(t, get("").Notes)
+
+		w = request(repo.GetNote, "alice", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`"}`)
+		assert.Contains(t, w.Body.String(), `"starred":true`)
+		w = request(repo.GetNote, "bob", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`"}`)
+		assert.NotContains(t, w.Body.String(), `"starred"`)
+
+		request(repo.StarNote, "alice", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`"}`)
+		assert.Empty(t, get("alice").Notes)
+		assert.Empty(t, repo.notebooks["state_notebook"].stars)
+	})
+	t.Run("Star/Anonymous/Error", func(t *testing.T) {
+		repo, ids := newRepo()
+		w := request(repo.StarNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`", "starred": true}`)
+		assert.Equal(t, 401, w.Code)
+		assert.Empty(t, repo.notebooks["state_notebook"].stars)
+
+		// stars recorded for anonymous by earlier versions are not shared
+		repo.notebooks["state_notebook"].star(ids["first"], anonymousPrincipal, true)
+		w = request(repo.GetNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`"}`)
+		assert.NotContains(t, w.Body.String(), `"starred"`)
+	})
+	t.Run("Update", func(t *testing.T) {
+		repo, ids := newRepo()
+		request(repo.PinNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`", "pinned": true}`)
+		request(repo.ArchiveNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`", "archived": true}`)
+		w := request(repo.UpdateNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`", "title": "first", "body": "edited"}`)
+		assert.Equal(t, 200, w.Code)
+
+		note := repo.notebooks["state_notebook"].notes[ids["first"]]
+		assert.True(t, note.Pinned)
+		assert.True(t, note.Archived)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		repo, ids := newRepo()
+		request(repo.StarNote, "alice", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`", "starred": true}`)
+		w := request(repo.DeleteNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`"}`)
+		assert.Equal(t, 200, w.Code)
+
+		assert.Empty(t, repo.notebooks["state_notebook"].stars)
+	})
+	t.Run("UnknownNote", func(t *testing.T) {
+		repo, _ := newRepo()
+		w := request(repo.PinNote, "", `{"notebook_name": "state_notebook", "id": "missing", "pinned": true}`)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "Note with id 'missing' does not exist")
+	})
+	t.Run("InvalidFilter", func(t *testing.T) {
+		repo, _ := newRepo()
+		w := request(repo.GetNotebook, "", `{"name": "state_notebook", "archived": "hidden"}`)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "archived")
+	})
+	t.Run("Backup", func(t *testing.T) {
+		repo, ids := newRepo()
+		request(repo.StarNote, "alice", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`", "starred": true}`)
+		request(repo.PinNote, "", `{"notebook_name": "state_notebook", "id": "`+ids["first"]+`", "pinned": true}`)
+		var archive bytes.Buffer
+		assert.NoError(t, writeBackup(&archive, repo.snapshot(), nil))
+
+		restored := NewNotebookRepo(nil)
+		w := httptest.NewRecorder()
+		restored.Restore(w, httptest.NewRequest("POST", "/admin/restore", &archive))
+		assert.Equal(t, 200, w.Code)
+
+		notebook := restored.notebooks["state_notebook"]
+		assert.True(t, notebook.notes[ids["first"]].Pinned)
+		assert.True(t, notebook.starred(ids["first"], "alice"))
+		assert.False(t, notebook.starred(ids["first"], "bob"))
+	})
+}
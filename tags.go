@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// tag list orders accepted by ListTagsRequest.sort
+const (
+	tagSortCount = "count"
+	tagSortName  = "name"
+)
+
+// tagSeparator splits hierarchical tags into their segments, a note tagged
+// project/alpha/design is found by filtering on project or project/alpha
+const tagSeparator = "/"
+
+// tagTree indexes the tags of a notebook by segment so that the descendants
+// of a tag are found without scanning every tag of the notebook
+type tagTree struct {
+	children map[string]*tagTree
+	// tagged is set when the path leading to the node is a tag held by at
+	// least one note, intermediate segments may not be
+	tagged bool
+}
+
+func newTagTree() *tagTree {
+	return &tagTree{children: make(map[string]*tagTree)}
+}
+
+// insert marks tag as held by a note, creating its missing ancestors
+func (t *tagTree) insert(tag string) {
+	if t == nil {
+		return
+	}
+	node := t
+	for _, segment := range strings.Split(tag, tagSeparator) {
+		child, ok := node.children[segment]
+		if !ok {
+			child = newTagTree()
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.tagged = true
+}
+
+// remove unmarks tag, pruning the segments left without tags below them
+func (t *tagTree) remove(tag string) {
+	if t == nil {
+		return
+	}
+	segments := strings.Split(tag, tagSeparator)
+	path := []*tagTree{t}
+	for _, segment := range segments {
+		child, ok := path[len(path)-1].children[segment]
+		if !ok {
+			return
+		}
+		path = append(path, child)
+	}
+	path[len(path)-1].tagged = false
+	for i := len(segments) - 1; i >= 0; i-- {
+		node := path[i+1]
+		if node.tagged || len(node.children) != 0 {
+			return
+		}
+		delete(path[i].children, segments[i])
+	}
+}
+
+// reset removes every tag from the tree
+func (t *tagTree) reset() {
+	if t == nil {
+		return
+	}
+	t.children = make(map[string]*tagTree)
+	t.tagged = false
+}
+
+// find returns the node of tag, or nil when neither tag nor any of its
+// descendants is held by a note
+func (t *tagTree) find(tag string) *tagTree {
+	node := t
+	for _, segment := range strings.Split(tag, tagSeparator) {
+		if node == nil {
+			return nil
+		}
+		node = node.children[segment]
+	}
+	return node
+}
+
+// walk calls fn with the path of every tagged node below t, t itself
+// being reached through path
+func (t *tagTree) walk(path string, fn func(tag string)) {
+	if t.tagged {
+		fn(path)
+	}
+	for segment, child := range t.children {
+		child.walk(path+tagSeparator+segment, fn)
+	}
+}
+
+// hierarchy returns the tag tree of the notebook, notebooks built without
+// one get a tree computed from their tags index
+func (nb Notebook) hierarchy() *tagTree {
+	if nb.tree != nil {
+		return nb.tree
+	}
+	tree := newTagTree()
+	for tag, ids := range nb.tags {
+		if len(ids) != 0 {
+			tree.insert(tag)
+		}
+	}
+	return tree
+}
+
+// subtree returns tag and its descendants held by at least one note,
+// sorted by name
+func (nb Notebook) subtree(tag string) []string {
+	var found []string
+	if node := nb.hierarchy().find(tag); node != nil {
+		node.walk(tag, func(tag string) {
+			found = append(found, tag)
+		})
+	}
+	sort.Strings(found)
+	return found
+}
+
+// expandTags returns the filter tags with every one of their descendants
+func (nb Notebook) expandTags(filter []string) []string {
+	seen := make(map[string]bool)
+	var expanded []string
+	for _, tag := range filter {
+		for _, tag := range append([]string{tag}, nb.subtree(tag)...) {
+			if !seen[tag] {
+				seen[tag] = true
+				expanded = append(expanded, tag)
+			}
+		}
+	}
+	return expanded
+}
+
+// indexTag references id in tag
+func (nb Notebook) indexTag(tag, id string) {
+	if len(nb.tags[tag]) == 0 {
+		nb.tree.insert(tag)
+	}
+	nb.tags[tag] = addNoteID(nb.tags[tag], id)
+}
+
+// unindexTag removes the reference to id from tag, dropping the tag once
+// no note holds it
+func (nb Notebook) unindexTag(tag, id string) {
+	nb.tags[tag] = removeNoteID(nb.tags[tag], id)
+	if len(nb.tags[tag]) == 0 {
+		nb.dropTag(tag)
+	}
+}
+
+// dropTag removes tag from the tags index
+func (nb Notebook) dropTag(tag string) {
+	delete(nb.tags, tag)
+	nb.tree.remove(tag)
+}
+
+// tagNodes converts the children of t into TagNodes ordered by order,
+// returning them with the distinct notes tagged below t
+func (nb Notebook) tagNodes(t *tagTree, prefix, order string) ([]*TagNode, map[string]bool) {
+	var nodes []*TagNode
+	below := make(map[string]bool)
+	for segment, child := range t.children {
+		node := &TagNode{Name: segment, Path: prefix + segment}
+		var ids map[string]bool
+		node.Children, ids = nb.tagNodes(child, node.Path+tagSeparator, order)
+		if child.tagged {
+			node.Count = int64(len(nb.tags[node.Path]))
+			for _, id := range nb.tags[node.Path] {
+				ids[id] = true
+			}
+		}
+		node.Total = int64(len(ids))
+		for id := range ids {
+			below[id] = true
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if order != tagSortName && nodes[i].Total != nodes[j].Total {
+			return nodes[i].Total > nodes[j].Total
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes, below
+}
+
+// retag rewrites the tags of every note holding one of names with rewrite,
+// bumping their last_modified. Notes are replaced rather than modified so
+// that responses already handed out are left untouched. The tags index is
+// left for the caller to update
+func (nb Notebook) retag(names []string, rewrite func(tags []string) []string) []string {
+	affected := make(map[string]bool)
+	for _, name := range names {
+		for _, id := range nb.tags[name] {
+			affected[id] = true
+		}
+	}
+
+	now := ptypes.TimestampNow()
+	ids := make([]string, 0, len(affected))
+	for id := range affected {
+		note, ok := nb.notes[id]
+		if !ok {
+			continue
+		}
+		retagged := proto.Clone(note).(*Note)
+		retagged.Tags = rewrite(note.Tags)
+		retagged.LastModified = now
+		nb.putNote(retagged)
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// replaceTags replaces every tag found in rename by its new name, keeping
+// the first occurrence of each tag, an empty new name removes the tag
+func replaceTags(tags []string, rename map[string]string) []string {
+	seen := make(map[string]bool)
+	var replaced []string
+	for _, tag := range tags {
+		if to, ok := rename[tag]; ok {
+			tag = to
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		replaced = append(replaced, tag)
+	}
+	return replaced
+}
+
+// writeTagChange responds with a TagChangeResponse
+func (n *NotebookRepo) writeTagChange(w http.ResponseWriter, r *http.Request, notebookName string, ids []string) {
+	result := &TagChangeResponse{NotebookName: notebookName, NoteIds: ids}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// ListTags takes a request body attempting to deserialise it to a
+// ListTagsRequest object
+func (n *NotebookRepo) ListTags(w http.ResponseWriter, r *http.Request) {
+	body := &ListTagsRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var counts []*TagCount
+	tree := newTagTree()
+	for name, ids := range notebook.tags {
+		if len(ids) != 0 && strings.HasPrefix(name, body.GetPrefix()) {
+			counts = append(counts, &TagCount{Name: name, Count: int64(len(ids))})
+			tree.insert(name)
+		}
+	}
+	result := &ListTagsResponse{NotebookName: body.GetNotebookName()}
+	if body.GetTree() {
+		result.Tree, _ = notebook.tagNodes(tree, "", body.GetSort())
+		counts = nil
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if body.GetSort() != tagSortName && counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+
+	result.Tags = counts
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// RenameTag takes a request body attempting to deserialise it to a
+// RenameTagRequest object, renaming onto an existing tag is refused as
+// MergeTags does it explicitly
+func (n *NotebookRepo) RenameTag(w http.ResponseWriter, r *http.Request) {
+	body := &RenameTagRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := notebook.subtree(body.GetName())
+	if len(names) == 0 {
+		errMsg := fmt.Sprintf("Tag with name '%s' does not exist", body.GetName())
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	// every descendant follows its ancestor, project/alpha/design becomes
+	// archive/alpha/design when project is renamed to archive
+	rename := make(map[string]string, len(names))
+	for _, name := range names {
+		rename[name] = body.GetNewName() + strings.TrimPrefix(name, body.GetName())
+	}
+	for _, name := range names {
+		if _, renamed := rename[rename[name]]; !renamed && len(notebook.tags[rename[name]]) != 0 {
+			errMsg := fmt.Sprintf("Tag with name '%s' already exists", rename[name])
+			n.log(r).Error(errMsg)
+			http.Error(w, errMsg, http.StatusConflict)
+			return
+		}
+	}
+
+	ids := notebook.retag(names, func(tags []string) []string {
+		return replaceTags(tags, rename)
+	})
+	moved := make(map[string][]string, len(names))
+	for _, name := range names {
+		moved[rename[name]] = notebook.tags[name]
+		notebook.dropTag(name)
+	}
+	for name, noteIDs := range moved {
+		for _, id := range noteIDs {
+			notebook.indexTag(name, id)
+		}
+	}
+
+	n.writeTagChange(w, r, body.GetNotebookName(), ids)
+}
+
+// MergeTags takes a request body attempting to deserialise it to a
+// MergeTagsRequest object, the target tag is created when missing
+func (n *NotebookRepo) MergeTags(w http.ResponseWriter, r *http.Request) {
+	body := &MergeTagsRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rename := make(map[string]string)
+	var sources []string
+	for _, source := range body.GetSources() {
+		if _, ok := rename[source]; source != body.GetTarget() && !ok {
+			rename[source] = body.GetTarget()
+			sources = append(sources, source)
+		}
+	}
+	ids := notebook.retag(sources, func(tags []string) []string {
+		return replaceTags(tags, rename)
+	})
+	for _, source := range sources {
+		for _, id := range notebook.tags[source] {
+			notebook.indexTag(body.GetTarget(), id)
+		}
+		notebook.dropTag(source)
+	}
+
+	n.writeTagChange(w, r, body.GetNotebookName(), ids)
+}
+
+// DeleteTag takes a request body attempting to deserialise it to a
+// DeleteTagRequest object
+func (n *NotebookRepo) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	body := &DeleteTagRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(notebook.tags[body.GetName()]) == 0 {
+		errMsg := fmt.Sprintf("Tag with name '%s' does not exist", body.GetName())
+		n.log(r).Error(errMsg)
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	rename := map[string]string{body.GetName(): ""}
+	ids := notebook.retag([]string{body.GetName()}, func(tags []string) []string {
+		return replaceTags(tags, rename)
+	})
+	notebook.dropTag(body.GetName())
+
+	n.writeTagChange(w, r, body.GetNotebookName(), ids)
+}
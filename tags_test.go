@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTagsRepo() *NotebookRepo {
+	created := ptypes.TimestampNow()
+	return newTestRepo("tags_notebook",
+		&Note{Id: "id_1", Title: "t1", Body: "b1", Tags: []string{"go", "golang", "web"}, Created: created},
+		&Note{Id: "id_2", Title: "t2", Body: "b2", Tags: []string{"golang", "web"}, Created: created},
+		&Note{Id: "id_3", Title: "t3", Body: "b3", Tags: []string{"web", "rust"}, Created: created},
+	)
+}
+
+func TestTags(t *testing.T) {
+	request := func(repo *NotebookRepo, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router := newRouter(repo, newHealth(), defaultConfig())
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	listTags := func(repo *NotebookRepo, body string) []*TagCount {
+		w := request(repo, "GET", "/tag", body)
+		assert.Equal(t, 200, w.Code)
+		result := &ListTagsResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		return result.Tags
+	}
+	changed := func(w *httptest.ResponseRecorder) []string {
+		assert.Equal(t, 200, w.Code)
+		result := &TagChangeResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		return result.NoteIds
+	}
+	indexed := func(repo *NotebookRepo, tag string) []string {
+		ids := append([]string(nil), repo.notebooks["tags_notebook"].tags[tag]...)
+		sort.Strings(ids)
+		return ids
+	}
+
+	t.Run("List/ByCount", func(t *testing.T) {
+		assert.Equal(t, []*TagCount{
+			{Name: "web", Count: 3},
+			{Name: "golang", Count: 2},
+			{Name: "go", Count: 1},
+			{Name: "rust", Count: 1},
+		}, listTags(newTagsRepo(), `{"notebook_name": "tags_notebook"}`))
+	})
+	t.Run("List/ByName/Prefix", func(t *testing.T) {
+		assert.Equal(t, []*TagCount{
+			{Name: "go", Count: 1},
+			{Name: "golang", Count: 2},
+		}, listTags(newTagsRepo(), `{"notebook_name": "tags_notebook", "prefix": "go", "sort": "name"}`))
+	})
+	t.Run("List/InvalidSort", func(t *testing.T) {
+		assert.Equal(t, 400, request(newTagsRepo(), "GET", "/tag", `{"notebook_name": "tags_notebook", "sort": "age"}`).Code)
+	})
+	t.Run("Rename", func(t *testing.T) {
+		repo := newTagsRepo()
+		before := repo.notebooks["tags_notebook"].notes["id_1"]
+		ids := changed(request(repo, "POST", "/tag/rename", `{"notebook_name": "tags_notebook", "name": "web", "new_name": "www"}`))
+
+		assert.Equal(t, []string{"id_1", "id_2", "id_3"}, ids)
+		after := repo.notebooks["tags_notebook"].notes["id_1"]
+		assert.Equal(t, []string{"go", "golang", "www"}, after.Tags)
+		assert.NotNil(t, after.LastModified)
+		assert.Equal(t, []string{"go", "golang", "web"}, before.Tags)
+		assert.Empty(t, indexed(repo, "web"))
+		assert.Equal(t, []string{"id_1", "id_2", "id_3"}, indexed(repo, "www"))
+	})
+	t.Run("Rename/Conflict", func(t *testing.T) {
+		w := request(newTagsRepo(), "POST", "/tag/rename", `{"notebook_name": "tags_notebook", "name": "go", "new_name": "golang"}`)
+		assert.Equal(t, 409, w.Code)
+	})
+	t.Run("Rename/Missing", func(t *testing.T) {
+		w := request(newTagsRepo(), "POST", "/tag/rename", `{"notebook_name": "tags_notebook", "name": "java", "new_name": "jvm"}`)
+		assert.Equal(t, 400, w.Code)
+	})
+	t.Run("Merge", func(t *testing.T) {
+		repo := newTagsRepo()
+		ids := changed(request(repo, "POST", "/tag/merge", `{"notebook_name": "tags_notebook", "sources": ["go", "golang"], "target": "go-lang"}`))
+
+		assert.Equal(t, []string{"id_1", "id_2"}, ids)
+		assert.Equal(t, []string{"go-lang", "web"}, repo.notebooks["tags_notebook"].notes["id_1"].Tags)
+		assert.Empty(t, indexed(repo, "go"))
+		assert.Empty(t, indexed(repo, "golang"))
+		assert.Equal(t, []string{"id_1", "id_2"}, indexed(repo, "go-lang"))
+		assert.Nil(t, repo.notebooks["tags_notebook"].notes["id_3"].LastModified)
+	})
+	t.Run("Merge/IntoExisting", func(t *testing.T) {
+		repo := newTagsRepo()
+		changed(request(repo, "POST", "/tag/merge", `{"notebook_name": "tags_notebook", "sources": ["go"], "target": "golang"}`))
+
+		assert.Equal(t, []string{"golang", "web"}, repo.notebooks["tags_notebook"].notes["id_1"].Tags)
+		assert.Equal(t, []string{"id_1", "id_2"}, indexed(repo, "golang"))
+	})
+	t.Run("Delete", func(t *testing.T) {
+		repo := newTagsRepo()
+		ids := changed(request(repo, "DELETE", "/tag", `{"notebook_name": "tags_notebook", "name": "web"}`))
+
+		assert.Equal(t, []string{"id_1", "id_2", "id_3"}, ids)
+		assert.Equal(t, []string{"rust"}, repo.notebooks["tags_notebook"].notes["id_3"].Tags)
+		assert.NotContains(t, repo.notebooks["tags_notebook"].tags, "web")
+		assert.Len(t, listTags(repo, `{"notebook_name": "tags_notebook"}`), 3)
+	})
+}
+
+func newHierarchyRepo() *NotebookRepo {
+	return newTestRepo("tree_notebook",
+		&Note{Id: "id_1", Title: "t1", Body: "b1", Tags: []string{"project/alpha/design"}},
+		&Note{Id: "id_2", Title: "t2", Body: "b2", Tags: []string{"project/alpha", "project/beta"}},
+		&Note{Id: "id_3", Title: "t3", Body: "b3", Tags: []string{"project/beta/api", "projects"}},
+	)
+}
+
+func TestHierarchicalTags(t *testing.T) {
+	request := func(repo *NotebookRepo, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router := newRouter(repo, newHealth(), defaultConfig())
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	noteIDs := func(repo *NotebookRepo, tags string) []string {
+		w := request(repo, "GET", "/notebook", `{"name": "tree_notebook", "tags": `+tags+`}`)
+		assert.Equal(t, 200, w.Code)
+		result := &GetNotebookResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		var ids []string
+		for _, note := range result.Notes {
+			ids = append(ids, note.Id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	t.Run("Filter/Descendants", func(t *testing.T) {
+		repo := newHierarchyRepo()
+
+		assert.Equal(t, []string{"id_1", "id_2", "id_3"}, noteIDs(repo, `["project"]`))
+		assert.Equal(t, []string{"id_1", "id_2"}, noteIDs(repo, `["project/alpha"]`))
+		assert.Equal(t, []string{"id_1"}, noteIDs(repo, `["project/alpha/design"]`))
+		assert.Equal(t, []string{"id_3"}, noteIDs(repo, `["projects"]`))
+	})
+	t.Run("Filter/UpdatedNote", func(t *testing.T) {
+		repo := newHierarchyRepo()
+		w := request(repo, "UPDATE", "/note", `{"notebook_name": "tree_notebook", "id": "id_3", "title": "t3", "body": "b3", "tags": ["project/gamma"]}`)
+		assert.Equal(t, 200, w.Code)
+
+		assert.Equal(t, []string{"id_1", "id_2"}, noteIDs(repo, `["project/beta", "project/alpha"]`))
+		assert.Equal(t, []string{"id_3"}, noteIDs(repo, `["project/gamma"]`))
+		assert.Nil(t, repo.notebooks["tree_notebook"].tree.find("project/beta/api"))
+	})
+	t.Run("List/Tree", func(t *testing.T) {
+		w := request(newHierarchyRepo(), "GET", "/tag", `{"notebook_name": "tree_notebook", "tree": true}`)
+		assert.Equal(t, 200, w.Code)
+		result := &ListTagsResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Empty(t, result.Tags)
+		assert.Equal(t, []*TagNode{
+			{Name: "project", Path: "project", Total: 3, Children: []*TagNode{
+				{Name: "alpha", Path: "project/alpha", Count: 1, Total: 2, Children: []*TagNode{
+					{Name: "design", Path: "project/alpha/design", Count: 1, Total: 1},
+				}},
+				{Name: "beta", Path: "project/beta", Count: 1, Total: 2, Children: []*TagNode{
+					{Name: "api", Path: "project/beta/api", Count: 1, Total: 1},
+				}},
+			}},
+			{Name: "projects", Path: "projects", Count: 1, Total: 1},
+		}, result.Tree)
+	})
+	t.Run("Rename/Subtree", func(t *testing.T) {
+		repo := newHierarchyRepo()
+		w := request(repo, "POST", "/tag/rename", `{"notebook_name": "tree_notebook", "name": "project/alpha", "new_name": "archive/alpha"}`)
+		assert.Equal(t, 200, w.Code)
+
+		notebook := repo.notebooks["tree_notebook"]
+		assert.Equal(t, []string{"archive/alpha/design"}, notebook.notes["id_1"].Tags)
+		assert.Equal(t, []string{"archive/alpha", "project/beta"}, notebook.notes["id_2"].Tags)
+		assert.Equal(t, []string{"archive/alpha", "archive/alpha/design"}, notebook.subtree("archive"))
+		assert.Empty(t, notebook.subtree("project/alpha"))
+		assert.Equal(t, []string{"id_1", "id_2"}, noteIDs(repo, `["archive"]`))
+	})
+	t.Run("Rename/IntermediateSegment", func(t *testing.T) {
+		repo := newHierarchyRepo()
+		w := request(repo, "POST", "/tag/rename", `{"notebook_name": "tree_notebook", "name": "project", "new_name": "work"}`)
+		assert.Equal(t, 200, w.Code)
+
+		assert.Equal(t, []string{"work/beta/api", "projects"}, repo.notebooks["tree_notebook"].notes["id_3"].Tags)
+		assert.Equal(t, []string{"id_1", "id_2", "id_3"}, noteIDs(repo, `["work"]`))
+	})
+	t.Run("Rename/DescendantConflict", func(t *testing.T) {
+		repo := newHierarchyRepo()
+		repo.notebooks["tree_notebook"].addNote(&Note{Id: "id_4", Title: "t4", Body: "b4", Tags: []string{"archive/alpha/design"}})
+		w := request(repo, "POST", "/tag/rename", `{"notebook_name": "tree_notebook", "name": "project/alpha", "new_name": "archive/alpha"}`)
+
+		assert.Equal(t, 409, w.Code)
+		assert.Equal(t, []string{"project/alpha/design"}, repo.notebooks["tree_notebook"].notes["id_1"].Tags)
+	})
+	t.Run("InvalidTag", func(t *testing.T) {
+		for _, tag := range []string{"/project", "project/", "project//alpha"} {
+			w := request(newHierarchyRepo(), "POST", "/note", `{"notebook_name": "tree_notebook", "title": "t", "body": "b", "tags": ["`+tag+`"]}`)
+			assert.Equal(t, 400, w.Code, tag)
+		}
+	})
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+)
+
+// maxTemplateOutput bounds the output of a template, and every string it
+// builds, to the largest note body
+const maxTemplateOutput = 1 << 20
+
+// templateBudget bounds the bytes built by the functions called while
+// executing a template, keeping execution linear in its size
+const templateBudget = 8 * maxTemplateOutput
+
+var (
+	errTemplateOutput = errors.New("template output too large")
+	errTemplateBudget = errors.New("template builds too much text")
+)
+
+// deniedTemplateFuncs are the text/template builtins templates may not
+// call, printf widths can build unbounded text and call runs functions
+var deniedTemplateFuncs = map[string]bool{"printf": true, "call": true}
+
+// templateSandbox executes note templates. Templates cannot loop nor call
+// other templates, their functions are limited to the logic and comparison
+// builtins of text/template along with the ones of funcs, each charging
+// the text it builds to budget
+type templateSandbox struct {
+	now    time.Time
+	budget int
+}
+
+func newTemplateSandbox(now time.Time) *templateSandbox {
+	return &templateSandbox{now: now.UTC(), budget: templateBudget}
+}
+
+// charge accounts for s being built, failing once the budget is spent
+func (s *templateSandbox) charge(result string) (string, error) {
+	if len(result) > maxTemplateOutput {
+		return "", errTemplateOutput
+	}
+	if s.budget -= len(result); s.budget < 0 {
+		return "", errTemplateBudget
+	}
+	return result, nil
+}
+
+func (s *templateSandbox) funcs() template.FuncMap {
+	bounded := func(f func(string) string) func(string) (string, error) {
+		return func(v string) (string, error) { return s.charge(f(v)) }
+	}
+	return template.FuncMap{
+		// builtins that can build unbounded text are replaced
+		"print":    func(args ...interface{}) (string, error) { return s.charge(fmt.Sprint(args...)) },
+		"println":  func(args ...interface{}) (string, error) { return s.charge(fmt.Sprintln(args...)) },
+		"html":     bounded(template.HTMLEscapeString),
+		"js":       bounded(template.JSEscapeString),
+		"urlquery": bounded(url.QueryEscape),
+
+		"upper": bounded(strings.ToUpper),
+		"lower": bounded(strings.ToLower),
+		"trim":  strings.TrimSpace,
+		"replace": func(v, old, new string) (string, error) {
+			if old == "" {
+				return v, nil
+			}
+			if len(new) > len(old) && len(v)+strings.Count(v, old)*(len(new)-len(old)) > maxTemplateOutput {
+				return "", errTemplateOutput
+			}
+			return s.charge(strings.Replace(v, old, new, -1))
+		},
+		"default": func(fallback, v string) string {
+			if v == "" {
+				return fallback
+			}
+			return v
+		},
+		"date": func(layout string) (string, error) { return s.charge(s.now.Format(layout)) },
+	}
+}
+
+// checkTemplateNode refuses the actions of node that could run for long
+func checkTemplateNode(node parse.Node) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, child := range node.Nodes {
+			if err := checkTemplateNode(child); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkTemplatePipe(node.Pipe)
+	case *parse.PipeNode:
+		return checkTemplatePipe(node)
+	case *parse.ChainNode:
+		// the field chained onto a parenthesized pipeline, as in (f).X
+		return checkTemplateNode(node.Node)
+	case *parse.IdentifierNode:
+		if deniedTemplateFuncs[node.Ident] {
+			return fmt.Errorf("%s is not allowed in templates", node.Ident)
+		}
+	case *parse.IfNode:
+		return checkTemplateBranch(&node.BranchNode)
+	case *parse.WithNode:
+		return checkTemplateBranch(&node.BranchNode)
+	case *parse.RangeNode:
+		return errors.New("range is not allowed in templates")
+	case *parse.TemplateNode:
+		return errors.New("template is not allowed in templates")
+	}
+	return nil
+}
+
+func checkTemplatePipe(pipe *parse.PipeNode) error {
+	if pipe == nil {
+		return nil
+	}
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			if err := checkTemplateNode(arg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkTemplateBranch(branch *parse.BranchNode) error {
+	if err := checkTemplatePipe(branch.Pipe); err != nil {
+		return err
+	}
+	if err := checkTemplateNode(branch.List); err != nil {
+		return err
+	}
+	return checkTemplateNode(branch.ElseList)
+}
+
+// parse parses source, refusing templates defining others or using
+// actions that could run for long
+func (s *templateSandbox) parse(name, source string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Funcs(s.funcs()).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Templates()) > 1 {
+		return nil, errors.New("define is not allowed in templates")
+	}
+	if t.Tree != nil {
+		if err := checkTemplateNode(t.Tree.Root); err != nil {
+			return nil, fmt.Errorf("template: %s: %v", name, err)
+		}
+	}
+	return t, nil
+}
+
+// limitedBuffer is a buffer failing writes past limit bytes
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errTemplateOutput
+	}
+	return b.Buffer.Write(p)
+}
+
+// execute parses and executes source with data
+func (s *templateSandbox) execute(name, source string, data interface{}) (string, error) {
+	t, err := s.parse(name, source)
+	if err != nil {
+		return "", err
+	}
+	out := &limitedBuffer{limit: maxTemplateOutput}
+	if err := t.Execute(out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// checkTemplateSources reports the sources of a template failing to parse
+func checkTemplateSources(title, body string, tags []string) []*FieldViolation {
+	s := newTemplateSandbox(time.Now())
+	var violations []*FieldViolation
+	check := func(field, source string) {
+		if _, err := s.parse(field, source); err != nil {
+			violations = append(violations, &FieldViolation{Field: field, Description: err.Error()})
+		}
+	}
+	check("title", title)
+	check("body", body)
+	for i, tag := range tags {
+		check(fmt.Sprintf("tags[%d]", i), tag)
+	}
+	return violations
+}
+
+// newNoteFromTemplate executes tmpl into a CreateNoteRequest, the template
+// tags yielding empty strings being dropped, and reports the fields that
+// failed to execute
+func newNoteFromTemplate(tmpl *NoteTemplate, body *CreateNoteFromTemplateRequest, author string, now time.Time) (*CreateNoteRequest, []*FieldViolation) {
+	s := newTemplateSandbox(now)
+	params := body.GetParams()
+	if params == nil {
+		params = make(map[string]string)
+	}
+	data := map[string]interface{}{
+		"date":     s.now.Format("2006-01-02"),
+		"time":     s.now.Format("15:04"),
+		"author":   author,
+		"notebook": body.GetNotebookName(),
+		"params":   params,
+	}
+
+	var violations []*FieldViolation
+	execute := func(field, source string) string {
+		out, err := s.execute(field, source, data)
+		if err != nil {
+			violations = append(violations, &FieldViolation{Field: field, Description: err.Error()})
+		}
+		return out
+	}
+	request := &CreateNoteRequest{
+		NotebookName: body.GetNotebookName(),
+		Title:        strings.TrimSpace(execute("title", tmpl.Title)),
+		Body:         execute("body", tmpl.Body),
+	}
+	seen := make(map[string]bool)
+	for i, source := range tmpl.Tags {
+		tag := strings.TrimSpace(execute(fmt.Sprintf("tags[%d]", i), source))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			request.Tags = append(request.Tags, tag)
+		}
+	}
+	for _, tag := range body.GetTags() {
+		if !seen[tag] {
+			seen[tag] = true
+			request.Tags = append(request.Tags, tag)
+		}
+	}
+	if len(violations) != 0 {
+		return nil, violations
+	}
+	return request, validateMessage(request)
+}
+
+// lookupTemplate returns the template named name of a notebook
+func (n *NotebookRepo) lookupTemplate(notebookName, name string) (Notebook, *NoteTemplate, error) {
+	notebook, err := n.lookupNotebook(notebookName)
+	if err != nil {
+		return Notebook{}, nil, err
+	}
+	tmpl, ok := notebook.templates[name]
+	if !ok {
+		return Notebook{}, nil, fmt.Errorf("Template with name '%s' does not exist", name)
+	}
+	return notebook, tmpl, nil
+}
+
+// CreateTemplate takes a request body attempting to deserialise it to a
+// CreateTemplateRequest object
+func (n *NotebookRepo) CreateTemplate(w http.ResponseWriter, r *http.Request) {
+	body := &CreateTemplateRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	if violations := checkTemplateSources(body.GetTitle(), body.GetBody(), body.GetTags()); len(violations) != 0 {
+		n.writeBadRequest(w, r, violations)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := notebook.templates[body.GetName()]; ok {
+		http.Error(w, fmt.Sprintf("Template with name '%s' already exists", body.GetName()), http.StatusConflict)
+		return
+	}
+	tmpl := &NoteTemplate{
+		Name:    body.GetName(),
+		Title:   body.GetTitle(),
+		Body:    body.GetBody(),
+		Tags:    body.GetTags(),
+		Created: ptypes.TimestampNow(),
+	}
+	notebook.templates[tmpl.Name] = tmpl
+
+	result := &CreateTemplateResponse{Template: tmpl}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// GetTemplate takes a request body attempting to deserialise it to a
+// GetTemplateRequest object
+func (n *NotebookRepo) GetTemplate(w http.ResponseWriter, r *http.Request) {
+	body := &GetTemplateRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	_, tmpl, err := n.lookupTemplate(body.GetNotebookName(), body.GetName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &GetTemplateResponse{Template: tmpl}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// ListTemplates takes a request body attempting to deserialise it to a
+// ListTemplatesRequest object
+func (n *NotebookRepo) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	body := &ListTemplatesRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	notebook, err := n.lookupNotebook(body.GetNotebookName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &ListTemplatesResponse{NotebookName: body.GetNotebookName()}
+	for _, tmpl := range notebook.templates {
+		result.Templates = append(result.Templates, tmpl)
+	}
+	sort.Slice(result.Templates, func(i, j int) bool { return result.Templates[i].Name < result.Templates[j].Name })
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// UpdateTemplate takes a request body attempting to deserialise it to an
+// UpdateTemplateRequest object
+func (n *NotebookRepo) UpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	body := &UpdateTemplateRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	if violations := checkTemplateSources(body.GetTitle(), body.GetBody(), body.GetTags()); len(violations) != 0 {
+		n.writeBadRequest(w, r, violations)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, old, err := n.lookupTemplate(body.GetNotebookName(), body.GetName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// templates are replaced rather than modified, those being executed
+	// outside of n.mu keep their sources
+	tmpl := &NoteTemplate{
+		Name:         old.Name,
+		Title:        body.GetTitle(),
+		Body:         body.GetBody(),
+		Tags:         body.GetTags(),
+		Created:      old.Created,
+		LastModified: ptypes.TimestampNow(),
+	}
+	notebook.templates[tmpl.Name] = tmpl
+
+	result := &UpdateTemplateResponse{Template: tmpl}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// DeleteTemplate takes a request body attempting to deserialise it to a
+// DeleteTemplateRequest object
+func (n *NotebookRepo) DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	body := &DeleteTemplateRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notebook, tmpl, err := n.lookupTemplate(body.GetNotebookName(), body.GetName())
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delete(notebook.templates, tmpl.Name)
+
+	result := &DeleteTemplateResponse{Name: tmpl.Name}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
+
+// CreateNoteFromTemplate takes a request body attempting to deserialise it
+// to a CreateNoteFromTemplateRequest object. The template is executed and
+// the note it yields is created as by CreateNote
+func (n *NotebookRepo) CreateNoteFromTemplate(w http.ResponseWriter, r *http.Request) {
+	body := &CreateNoteFromTemplateRequest{}
+	if !n.decodeRequest(w, r, body) {
+		return
+	}
+	n.mu.RLock()
+	_, tmpl, err := n.lookupTemplate(body.GetNotebookName(), body.GetTemplate())
+	n.mu.RUnlock()
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request, violations := newNoteFromTemplate(tmpl, body, principal(r), time.Now())
+	if len(violations) != 0 {
+		n.writeBadRequest(w, r, violations)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	note, err := n.createNote(request)
+	if err != nil {
+		n.log(r).Error(err.Error())
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	result := &CreateNoteFromTemplateResponse{Note: note}
+	response, err := json.Marshal(result)
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(response)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTemplatesRepo() *NotebookRepo {
+	repo := newTestRepo("tpl_notebook")
+	repo.notebooks["tpl_notebook"].templates["meeting"] = &NoteTemplate{
+		Name:  "meeting",
+		Title: "Meeting {{.date}} {{.params.topic}}",
+		Body:  "# {{.params.topic | upper}}\n\nby {{.author}} in {{.notebook}}, owner {{default \"nobody\" (index .params \"owner\")}}",
+		Tags:  []string{"meetings", "{{index .params \"team\"}}"},
+	}
+	return repo
+}
+
+func TestTemplates(t *testing.T) {
+	request := func(repo *NotebookRepo, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router := newRouter(repo, newHealth(), defaultConfig())
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	violations := func(w *httptest.ResponseRecorder) []*FieldViolation {
+		result := &BadRequest{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+		return result.Violations
+	}
+
+	t.Run("CRUD", func(t *testing.T) {
+		repo := newTemplatesRepo()
+		w := request(repo, "POST", "/template", `{"notebook_name": "tpl_notebook", "name": "incident", "title": "Incident {{.date}}", "body": "## Impact", "tags": ["incidents"]}`)
+		assert.Equal(t, 200, w.Code)
+		w = request(repo, "POST", "/template", `{"notebook_name": "tpl_notebook", "name": "incident", "title": "t", "body": "b"}`)
+		assert.Equal(t, 409, w.Code)
+
+		w = request(repo, "UPDATE", "/template", `{"notebook_name": "tpl_notebook", "name": "incident", "title": "Incident", "body": "## Timeline"}`)
+		assert.Equal(t, 200, w.Code)
+		w = request(repo, "GET", "/template", `{"notebook_name": "tpl_notebook", "name": "incident"}`)
+		assert.Equal(t, 200, w.Code)
+		got := &GetTemplateResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), got))
+		assert.Equal(t, "## Timeline", got.Template.Body)
+		assert.Empty(t, got.Template.Tags)
+		assert.NotNil(t, got.Template.Created)
+		assert.NotNil(t, got.Template.LastModified)
+
+		w = request(repo, "GET", "/notebook/templates", `{"notebook_name": "tpl_notebook"}`)
+		list := &ListTemplatesResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), list))
+		assert.Len(t, list.Templates, 2)
+		assert.Equal(t, "incident", list.Templates[0].Name)
+		assert.Equal(t, "meeting", list.Templates[1].Name)
+
+		w = request(repo, "DELETE", "/template", `{"notebook_name": "tpl_notebook", "name": "incident"}`)
+		assert.Equal(t, 200, w.Code)
+		w = request(repo, "GET", "/template", `{"notebook_name": "tpl_notebook", "name": "incident"}`)
+		assert.Equal(t, 400, w.Code)
+	})
+	t.Run("Create/Invalid", func(t *testing.T) {
+		for source, expected := range map[string]string{
+			`{{.date`:                                 "unclosed action",
+			`{{range .params}}x{{end}}`:               "range is not allowed",
+			`{{define "x"}}x{{end}}`:                  "define is not allowed",
+			`{{if true}}{{printf "%9999d" 1}}{{end}}`: "printf is not allowed",
+			`{{print (call .params.f)}}`:              "call is not allowed",
+			`{{(printf "%9999d" 1).X}}`:               "printf is not allowed",
+			`{{exec "rm"}}`:                           `function "exec" not defined`,
+		} {
+			body, _ := json.Marshal(&CreateTemplateRequest{NotebookName: "tpl_notebook", Name: "bad", Title: "t", Body: source})
+			w := request(newTemplatesRepo(), "POST", "/template", string(body))
+			assert.Equal(t, 400, w.Code, source)
+			found := violations(w)
+			if assert.Len(t, found, 1, source) {
+				assert.Equal(t, "body", found[0].Field)
+				assert.Contains(t, found[0].Description, expected)
+			}
+		}
+	})
+	t.Run("CreateNote", func(t *testing.T) {
+		repo := newTemplatesRepo()
+		w := request(repo, "POST", "/note/template", `{"notebook_name": "tpl_notebook", "template": "meeting", "params": {"topic": "retro", "team": "platform"}, "tags": ["weekly"]}`)
+		assert.Equal(t, 200, w.Code)
+		result := &CreateNoteFromTemplateResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		note := result.Note
+		assert.Equal(t, "Meeting "+time.Now().UTC().Format("2006-01-02")+" retro", note.Title)
+		assert.Equal(t, "# RETRO\n\nby anonymous in tpl_notebook, owner nobody", note.Body)
+		assert.Equal(t, []string{"meetings", "platform", "weekly"}, note.Tags)
+		notebook := repo.notebooks["tpl_notebook"]
+		assert.Equal(t, note, notebook.notes[note.Id])
+		assert.Equal(t, []string{note.Id}, notebook.tags["platform"])
+	})
+	t.Run("CreateNote/EmptyTagDropped", func(t *testing.T) {
+		repo := newTemplatesRepo()
+		w := request(repo, "POST", "/note/template", `{"notebook_name": "tpl_notebook", "template": "meeting", "params": {"topic": "retro"}}`)
+		assert.Equal(t, 200, w.Code)
+		result := &CreateNoteFromTemplateResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+
+		assert.Equal(t, []string{"meetings"}, result.Note.Tags)
+	})
+	t.Run("CreateNote/MissingParam", func(t *testing.T) {
+		w := request(newTemplatesRepo(), "POST", "/note/template", `{"notebook_name": "tpl_notebook", "template": "meeting"}`)
+		assert.Equal(t, 400, w.Code)
+		found := violations(w)
+
+		assert.Len(t, found, 2)
+		assert.Equal(t, "title", found[0].Field)
+		assert.Contains(t, found[0].Description, `map has no entry for key "topic"`)
+		assert.Equal(t, "body", found[1].Field)
+	})
+	t.Run("CreateNote/InvalidTag", func(t *testing.T) {
+		w := request(newTemplatesRepo(), "POST", "/note/template", `{"notebook_name": "tpl_notebook", "template": "meeting", "params": {"topic": "retro", "team": "two words"}}`)
+		assert.Equal(t, 400, w.Code)
+		found := violations(w)
+
+		assert.Len(t, found, 1)
+		assert.Equal(t, "tags[1]", found[0].Field)
+	})
+	t.Run("CreateNote/Quota", func(t *testing.T) {
+		repo := newTemplatesRepo()
+		repo.quota.MaxNotes = 1
+		repo.notebooks["tpl_notebook"].addNote(&Note{Id: "id_1", Title: "t", Body: "b"})
+		w := request(repo, "POST", "/note/template", `{"notebook_name": "tpl_notebook", "template": "meeting", "params": {"topic": "retro"}}`)
+
+		assert.Equal(t, 403, w.Code)
+	})
+	t.Run("CreateNote/UnknownTemplate", func(t *testing.T) {
+		w := request(newTemplatesRepo(), "POST", "/note/template", `{"notebook_name": "tpl_notebook", "template": "standup"}`)
+		assert.Equal(t, 400, w.Code)
+	})
+}
+
+func TestTemplateSandbox(t *testing.T) {
+	now := time.Date(2020, 3, 4, 9, 30, 0, 0, time.UTC)
+	execute := func(source string, params map[string]string) (string, error) {
+		return newTemplateSandbox(now).execute("body", source, map[string]interface{}{"params": params})
+	}
+
+	t.Run("Functions", func(t *testing.T) {
+		out, err := execute(`{{date "Jan 2"}} {{.params.a | lower | trim}} {{replace .params.a "B" "c"}} {{html "<b>"}}`, map[string]string{"a": " AB "})
+		assert.NoError(t, err)
+		assert.Equal(t, "Mar 4 ab  Ac  &lt;b&gt;", out)
+	})
+	t.Run("Budget", func(t *testing.T) {
+		source := `{{$a := .params.a}}` + strings.Repeat(`{{$a = print $a $a}}`, 40)
+		_, err := execute(source, map[string]string{"a": strings.Repeat("x", 4096)})
+		assert.Error(t, err)
+	})
+	t.Run("Output", func(t *testing.T) {
+		source := strings.Repeat(`{{.params.a}}`, 300)
+		_, err := execute(source, map[string]string{"a": strings.Repeat("x", 4096)})
+		assert.Contains(t, err.Error(), errTemplateOutput.Error())
+	})
+	t.Run("Replace", func(t *testing.T) {
+		_, err := execute(`{{replace (replace .params.a "x" .params.a) "x" .params.a}}`, map[string]string{"a": strings.Repeat("x", 4096)})
+		assert.Contains(t, err.Error(), errTemplateOutput.Error())
+	})
+}
+
+func TestTemplatesBackup(t *testing.T) {
+	repo := newTemplatesRepo()
+	var buf bytes.Buffer
+	assert.NoError(t, writeBackup(&buf, repo.snapshot(), nil))
+	_, backups, _, err := readBackup(&buf)
+	assert.NoError(t, err)
+
+	restored := restoreNotebook(backups[0], newGlobalIndex())
+	assert.Equal(t, "Meeting {{.date}} {{.params.topic}}", restored.templates["meeting"].Title)
+}
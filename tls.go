@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// client certificate policies accepted by api.tls.client_auth
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	clientAuthNone:     tls.NoClientCert,
+	clientAuthOptional: tls.VerifyClientCertIfGiven,
+	clientAuthRequire:  tls.RequireAndVerifyClientCert,
+}
+
+// certReloader serves the certificate and client CA bundle most recently
+// loaded from disk, so that reloading them only affects new handshakes
+type certReloader struct {
+	cfg        TLSConfig
+	clientAuth tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// newCertReloader loads the files referenced by cfg, failing when any of
+// them is unusable
+func newCertReloader(cfg TLSConfig) (*certReloader, error) {
+	clientAuth, ok := clientAuthTypes[cfg.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client auth '%s'", cfg.ClientAuth)
+	}
+	c := &certReloader{cfg: cfg, clientAuth: clientAuth}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate, key and client CA bundle again. The
+// previous ones are kept when any file fails to load
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if c.cfg.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read client CA bundle: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in client CA bundle %s", c.cfg.ClientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// getConfigForClient hands every handshake the current client CA bundle
+func (c *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+		ClientAuth:     c.clientAuth,
+		ClientCAs:      c.clientCAs,
+	}, nil
+}
+
+// tlsConfig returns the config of the API listener
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     c.getCertificate,
+		GetConfigForClient: c.getConfigForClient,
+	}
+}
+
+// certPrincipal maps a verified client certificate to a principal, the
+// subject common name when set and the full subject otherwise
+func certPrincipal(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
+
+// clientCertMiddleware records the principal of verified client
+// certificates. When allowed is not empty only the listed principals are
+// authorized to use the API
+func clientCertMiddleware(allowed []string) mux.MiddlewareFunc {
+	allowedSet := make(map[string]bool)
+	for _, p := range allowed {
+		allowedSet[p] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var p string
+			if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+				p = certPrincipal(r.TLS.VerifiedChains[0][0])
+				setPrincipal(r, p)
+			}
+			if len(allowedSet) != 0 && !allowedSet[p] {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
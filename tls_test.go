@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "notebook test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// issue returns a PEM encoded certificate and key for commonName
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) clientCert(t *testing.T, commonName string) tls.Certificate {
+	certPEM, keyPEM := ca.issue(t, commonName, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+	return cert
+}
+
+// writeServerCert writes a server certificate issued by ca to dir
+func writeServerCert(t *testing.T, ca *testCA, dir string) TLSConfig {
+	certPEM, keyPEM := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	cfg := TLSConfig{
+		CertFile:   filepath.Join(dir, "server.crt"),
+		KeyFile:    filepath.Join(dir, "server.key"),
+		ClientAuth: clientAuthNone,
+	}
+	assert.NoError(t, ioutil.WriteFile(cfg.CertFile, certPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(cfg.KeyFile, keyPEM, 0600))
+	return cfg
+}
+
+// serveTLS runs the API router behind TLS on a random port and returns its
+// base URL
+func serveTLS(t *testing.T, cfg *Config) string {
+	certs, err := newCertReloader(cfg.API.TLS)
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	srv := &http.Server{Handler: newRouter(NewNotebookRepo(nil), newHealth(), cfg)}
+	go srv.Serve(tls.NewListener(listener, certs.tlsConfig()))
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func tlsClient(ca *testCA, certs ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+	}}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "notebook-tls")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := tempDir(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, ioutil.WriteFile(caFile, ca.pem(), 0600))
+
+	cfg := defaultConfig()
+	cfg.API.TLS = writeServerCert(t, ca, dir)
+	cfg.API.TLS.ClientCAFile = caFile
+	cfg.API.TLS.ClientAuth = clientAuthRequire
+	cfg.API.TLS.AllowedPrincipals = []string{"alice"}
+	assert.NoError(t, cfg.validate())
+	url := serveTLS(t, cfg)
+
+	t.Run("AllowedPrincipal/Success", func(t *testing.T) {
+		resp, err := tlsClient(ca, ca.clientCert(t, "alice")).Get(url + "/healthz")
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		resp.Body.Close()
+	})
+	t.Run("NoClientCert/Rejected", func(t *testing.T) {
+		resp, err := tlsClient(ca).Get(url + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		assert.Error(t, err)
+	})
+	t.Run("UnknownCA/Rejected", func(t *testing.T) {
+		other := newTestCA(t)
+		resp, err := tlsClient(ca, other.clientCert(t, "alice")).Get(url + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		assert.Error(t, err)
+	})
+	t.Run("DisallowedPrincipal/Forbidden", func(t *testing.T) {
+		resp, err := tlsClient(ca, ca.clientCert(t, "mallory")).Get(url + "/healthz")
+
+		assert.NoError(t, err)
+		assert.Equal(t, 403, resp.StatusCode)
+		resp.Body.Close()
+	})
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := tempDir(t)
+	cfg := defaultConfig()
+	cfg.API.TLS = writeServerCert(t, ca, dir)
+	certs, err := newCertReloader(cfg.API.TLS)
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := &http.Server{Handler: newRouter(NewNotebookRepo(nil), newHealth(), cfg)}
+	go srv.Serve(tls.NewListener(listener, certs.tlsConfig()))
+	defer srv.Close()
+	url := "https://" + listener.Addr().String() + "/healthz"
+
+	// peerSerial requests url and returns the serial of the served certificate
+	peerSerial := func(client *http.Client) int64 {
+		resp, err := client.Get(url)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		assert.Equal(t, 200, resp.StatusCode)
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	established := tlsClient(ca)
+	before := peerSerial(established)
+
+	writeServerCert(t, ca, dir)
+	assert.NoError(t, certs.reload())
+
+	t.Run("NewConnection/NewCertificate", func(t *testing.T) {
+		assert.NotEqual(t, before, peerSerial(tlsClient(ca)))
+	})
+	t.Run("EstablishedConnection/Kept", func(t *testing.T) {
+		assert.Equal(t, before, peerSerial(established))
+	})
+	t.Run("InvalidFile/KeepsPrevious", func(t *testing.T) {
+		current := peerSerial(tlsClient(ca))
+		assert.NoError(t, ioutil.WriteFile(cfg.API.TLS.CertFile, []byte("garbage"), 0600))
+
+		assert.Error(t, certs.reload())
+		assert.Equal(t, current, peerSerial(tlsClient(ca)))
+	})
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	_, _, err := loadConfig(
+		[]string{"-tls-cert-file", "server.crt", "-tls-client-auth", "always"},
+		env(map[string]string{"NTBK_TLS_CLIENT_CA_FILE": "ca.crt"}),
+	)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cert_file and key_file must be set together")
+	assert.Contains(t, err.Error(), "api.tls.client_auth: unknown value 'always'")
+
+	_, _, err = loadConfig([]string{"-tls-client-auth", "require"}, env(nil))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "requires client_ca_file")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// patterns caches the compiled FieldRules patterns, they are declared in
+// notebook.proto so an invalid one is a programming error
+var patterns sync.Map
+
+func compilePattern(pattern string) *regexp.Regexp {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(pattern)
+	patterns.Store(pattern, re)
+	return re
+}
+
+// fieldRules returns the FieldRules declared on fd, or nil
+func fieldRules(fd protoreflect.FieldDescriptor) *FieldRules {
+	if fd.Options() == nil {
+		return nil
+	}
+	rules, _ := protov2.GetExtension(fd.Options(), E_Rules).(*FieldRules)
+	return rules
+}
+
+// validateString checks a single string against rules, repeated fields
+// check each of their items
+func validateString(field, s string, rules *FieldRules) []*FieldViolation {
+	var violations []*FieldViolation
+	violate := func(format string, args ...interface{}) {
+		violations = append(violations, &FieldViolation{Field: field, Description: fmt.Sprintf(format, args...)})
+	}
+
+	if !utf8.ValidString(s) {
+		violate("must be valid UTF-8")
+		return violations
+	}
+	if rules == nil {
+		return nil
+	}
+	if rules.Required && s == "" {
+		violate("must not be empty")
+	}
+	if rules.MaxLen != 0 && utf8.RuneCountInString(s) > int(rules.MaxLen) {
+		violate("must be at most %d characters long", rules.MaxLen)
+	}
+	if rules.MaxBytes != 0 && len(s) > int(rules.MaxBytes) {
+		violate("must be at most %d bytes long", rules.MaxBytes)
+	}
+	if rules.Pattern != "" && s != "" && !compilePattern(rules.Pattern).MatchString(s) {
+		violate("must match %s", rules.Pattern)
+	}
+	return violations
+}
+
+// validateMessage checks every field of m against the FieldRules declared
+// on it in notebook.proto, returning all the violations found
+func validateMessage(m proto.Message) []*FieldViolation {
+	return validateReflect("", proto.MessageReflect(m))
+}
+
+func validateReflect(prefix string, msg protoreflect.Message) []*FieldViolation {
+	var violations []*FieldViolation
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		field := prefix + string(fd.Name())
+		rules := fieldRules(fd)
+
+		switch {
+		case fd.IsList():
+			list := msg.Get(fd).List()
+			if rules != nil && rules.Required && list.Len() == 0 {
+				violations = append(violations, &FieldViolation{Field: field, Description: "must not be empty"})
+			}
+			if rules != nil && rules.MaxItems != 0 && list.Len() > int(rules.MaxItems) {
+				violations = append(violations, &FieldViolation{
+					Field:       field,
+					Description: fmt.Sprintf("must hold at most %d items", rules.MaxItems),
+				})
+			}
+			for j := 0; j < list.Len(); j++ {
+				item := fmt.Sprintf("%s[%d]", field, j)
+				switch fd.Kind() {
+				case protoreflect.StringKind:
+					violations = append(violations, validateString(item, list.Get(j).String(), rules)...)
+				case protoreflect.MessageKind:
+					violations = append(violations, validateReflect(item+".", list.Get(j).Message())...)
+				}
+			}
+		case fd.IsMap():
+			m := msg.Get(fd).Map()
+			if rules != nil && rules.MaxItems != 0 && m.Len() > int(rules.MaxItems) {
+				violations = append(violations, &FieldViolation{
+					Field:       field,
+					Description: fmt.Sprintf("must hold at most %d items", rules.MaxItems),
+				})
+			}
+			if fd.MapKey().Kind() != protoreflect.StringKind {
+				break
+			}
+			var keys []string
+			m.Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				keys = append(keys, key.String())
+				return true
+			})
+			sort.Strings(keys)
+			for _, key := range keys {
+				item := fmt.Sprintf("%s[%s]", field, key)
+				value := m.Get(protoreflect.ValueOfString(key).MapKey())
+				switch fd.MapValue().Kind() {
+				case protoreflect.StringKind:
+					violations = append(violations, validateString(item, value.String(), rules)...)
+				case protoreflect.MessageKind:
+					violations = append(violations, validateReflect(item+".", value.Message())...)
+				}
+			}
+		case fd.Kind() == protoreflect.StringKind:
+			violations = append(violations, validateString(field, msg.Get(fd).String(), rules)...)
+		case fd.Kind() == protoreflect.MessageKind && msg.Has(fd):
+			violations = append(violations, validateReflect(field+".", msg.Get(fd).Message())...)
+		}
+	}
+	return violations
+}
+
+// unmarshalRequest decodes a JSON object into msg, reporting every key
+// that is not a field of msg instead of ignoring it
+func unmarshalRequest(data []byte, msg proto.Message) []*FieldViolation {
+	if !utf8.Valid(data) {
+		return []*FieldViolation{{Description: "request body must be valid UTF-8"}}
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return []*FieldViolation{{Description: fmt.Sprintf("request body must be a JSON object: %v", err)}}
+	}
+
+	var unknown []string
+	fields := proto.MessageReflect(msg).Descriptor().Fields()
+	for key := range object {
+		if fields.ByName(protoreflect.Name(key)) == nil && fields.ByJSONName(key) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		violations := make([]*FieldViolation, len(unknown))
+		for i, key := range unknown {
+			violations[i] = &FieldViolation{Field: key, Description: "unknown field"}
+		}
+		return violations
+	}
+
+	if err := jsonpb.Unmarshal(bytes.NewReader(data), msg); err != nil {
+		return []*FieldViolation{{Description: err.Error()}}
+	}
+	return nil
+}
+
+// violationsError joins violations into a single error, for items that are
+// reported one at a time rather than as a BadRequest
+func violationsError(violations []*FieldViolation) error {
+	problems := make([]string, len(violations))
+	for i, violation := range violations {
+		problems[i] = strings.TrimSpace(violation.Field + " " + violation.Description)
+	}
+	return errors.New(strings.Join(problems, ", "))
+}
+
+// writeBadRequest responds with a BadRequest listing violations
+func (n *NotebookRepo) writeBadRequest(w http.ResponseWriter, r *http.Request, violations []*FieldViolation) {
+	n.log(r).Error("Invalid request", "violations", len(violations))
+	response, err := json.Marshal(&BadRequest{Violations: violations})
+	if err != nil {
+		n.log(r).Error("Unable to marshal response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(response)
+}
+
+// validRequest validates msg, responding with a BadRequest and returning
+// false when any of its fields is invalid
+func (n *NotebookRepo) validRequest(w http.ResponseWriter, r *http.Request, msg proto.Message) bool {
+	if violations := validateMessage(msg); len(violations) != 0 {
+		n.writeBadRequest(w, r, violations)
+		return false
+	}
+	return true
+}
+
+// errBodyTooLarge is the message of the error returned by the reader
+// http.MaxBytesReader wraps the body in, once limits.max_request_bytes is
+// exceeded
+const errBodyTooLarge = "http: request body too large"
+
+// readBody reads the body of r, responding with a RequestEntityTooLarge
+// when it is over limits.max_request_bytes or a BadRequest when it can't be
+// read, and returning false in both cases
+func (n *NotebookRepo) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil && err.Error() == errBodyTooLarge {
+		n.log(r).Error("Request body too large", "error", err)
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		n.writeBadRequest(w, r, []*FieldViolation{{Description: err.Error()}})
+		return nil, false
+	}
+	return data, true
+}
+
+// decodeRequest reads the JSON body of r into msg and validates it,
+// responding with a BadRequest and returning false when msg must not be
+// used
+func (n *NotebookRepo) decodeRequest(w http.ResponseWriter, r *http.Request, msg proto.Message) bool {
+	data, ok := n.readBody(w, r)
+	if !ok {
+		return false
+	}
+	if violations := unmarshalRequest(data, msg); len(violations) != 0 {
+		n.writeBadRequest(w, r, violations)
+		return false
+	}
+	return n.validRequest(w, r, msg)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+func TestFieldRulePatterns(t *testing.T) {
+	// every declared pattern must compile, compilePattern panics otherwise
+	found := 0
+	protoregistry.GlobalTypes.RangeMessages(func(mt protoreflect.MessageType) bool {
+		if mt.Descriptor().ParentFile().Path() != "notebook.proto" {
+			return true
+		}
+		fields := mt.Descriptor().Fields()
+		for i := 0; i < fields.Len(); i++ {
+			if rules := fieldRules(fields.Get(i)); rules != nil && rules.Pattern != "" {
+				found++
+				assert.NotPanics(t, func() { compilePattern(rules.Pattern) }, string(fields.Get(i).FullName()))
+			}
+		}
+		return true
+	})
+	assert.NotZero(t, found)
+}
+
+func TestValidateMessage(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		assert.Empty(t, validateMessage(&CreateNoteRequest{
+			NotebookName: "notebook_1",
+			Title:        "Título",
+			Body:         "body",
+			Tags:         []string{"tag_1", "étiquette"},
+		}))
+	})
+	t.Run("EveryViolation", func(t *testing.T) {
+		tags := make([]string, 33)
+		for i := range tags {
+			tags[i] = "tag"
+		}
+		tags[1] = "has space"
+
+		violations := validateMessage(&CreateNoteRequest{
+			NotebookName: "../etc",
+			Title:        strings.Repeat("é", 201),
+			Tags:         tags,
+		})
+
+		assert.Equal(t, []*FieldViolation{
+			{Field: "notebook_name", Description: "must match ^[A-Za-z0-9][A-Za-z0-9_.-]*$"},
+			{Field: "title", Description: "must be at most 200 characters long"},
+			{Field: "body", Description: "must not be empty"},
+			{Field: "tags", Description: "must hold at most 32 items"},
+			{Field: "tags[1]", Description: `must match ^[\pL\pN_-]+(/[\pL\pN_-]+)*$`},
+		}, violations)
+	})
+	t.Run("MaxBytes", func(t *testing.T) {
+		violations := validateMessage(&UpdateNoteRequest{
+			NotebookName: "notebook_1",
+			Id:           "id_1",
+			Body:         strings.Repeat("a", 1<<20+1),
+		})
+
+		assert.Equal(t, []*FieldViolation{{Field: "body", Description: "must be at most 1048576 bytes long"}}, violations)
+	})
+	t.Run("InvalidUTF8", func(t *testing.T) {
+		violations := validateMessage(&GetNoteRequest{NotebookName: "notebook_1", Id: "\xff"})
+
+		assert.Equal(t, []*FieldViolation{{Field: "id", Description: "must be valid UTF-8"}}, violations)
+	})
+	t.Run("Map", func(t *testing.T) {
+		params := map[string]string{"b": strings.Repeat("a", 4097), "a": "ok"}
+		for i := 0; i < 63; i++ {
+			params[strings.Repeat("k", i+1)] = "v"
+		}
+		violations := validateMessage(&CreateNoteFromTemplateRequest{NotebookName: "notebook_1", Template: "t", Params: params})
+
+		assert.Equal(t, []*FieldViolation{
+			{Field: "params", Description: "must hold at most 64 items"},
+			{Field: "params[b]", Description: "must be at most 4096 characters long"},
+		}, violations)
+	})
+}
+
+func TestDecodeRequest(t *testing.T) {
+	router := newRouter(NewNotebookRepo(nil), newHealth(), defaultConfig())
+	post := func(body string) (int, *BadRequest) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/notebook", bytes.NewBufferString(body)))
+		badRequest := &BadRequest{}
+		if w.Code == 400 {
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), badRequest))
+		}
+		return w.Code, badRequest
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		code, _ := post(`{"name": "notebook_1"}`)
+		assert.Equal(t, 200, code)
+	})
+	t.Run("UnknownFields", func(t *testing.T) {
+		code, badRequest := post(`{"name": "notebook_2", "title": "t", "colour": "red"}`)
+
+		assert.Equal(t, 400, code)
+		assert.True(t, proto.Equal(&BadRequest{Violations: []*FieldViolation{
+			{Field: "colour", Description: "unknown field"},
+			{Field: "title", Description: "unknown field"},
+		}}, badRequest))
+	})
+	t.Run("InvalidUTF8", func(t *testing.T) {
+		code, badRequest := post("{\"name\": \"\xff\"}")
+
+		assert.Equal(t, 400, code)
+		assert.Equal(t, "request body must be valid UTF-8", badRequest.Violations[0].Description)
+	})
+	t.Run("NotAnObject", func(t *testing.T) {
+		code, badRequest := post(`["notebook_3"]`)
+
+		assert.Equal(t, 400, code)
+		assert.Contains(t, badRequest.Violations[0].Description, "request body must be a JSON object")
+	})
+	t.Run("WrongType", func(t *testing.T) {
+		code, badRequest := post(`{"name": 3}`)
+
+		assert.Equal(t, 400, code)
+		assert.Len(t, badRequest.Violations, 1)
+	})
+	t.Run("Rules", func(t *testing.T) {
+		code, badRequest := post(`{"name": ""}`)
+
+		assert.Equal(t, 400, code)
+		assert.Equal(t, []*FieldViolation{{Field: "name", Description: "must not be empty"}}, badRequest.Violations)
+	})
+	t.Run("TooLarge", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Limits.MaxRequestBytes = 16
+		router := newRouter(NewNotebookRepo(nil), newHealth(), cfg)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/notebook", bytes.NewBufferString(`{"name": "a_rather_long_notebook_name"}`)))
+
+		assert.Equal(t, 413, w.Code)
+		assert.NotContains(t, w.Body.String(), "http:")
+	})
+}